@@ -1,6 +1,8 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/gorilla/context"
@@ -26,3 +28,33 @@ func SetContext(next http.Handler) http.Handler {
 
 	return http.HandlerFunc(fn)
 }
+
+// sealCredentials returns authOpts sealed with the server key, to be kept
+// with a provisioning, see models.Provisioning.
+func sealCredentials(authOpts models.AuthOpts) (string, error) {
+	if box == nil {
+		return "", errors.New("no secret box to seal the credentials with")
+	}
+	content, err := json.Marshal(authOpts)
+	if err != nil {
+		return "", err
+	}
+	return box.Seal(content)
+}
+
+// openCredentials returns the AuthOpts sealed by sealCredentials.
+func openCredentials(sealed string) (models.AuthOpts, error) {
+	authOpts := models.AuthOpts{}
+	if sealed == "" {
+		return authOpts, errors.New("provisioning has no credentials")
+	}
+	if box == nil {
+		return authOpts, errors.New("no secret box to open the credentials with")
+	}
+	content, err := box.Open(sealed)
+	if err != nil {
+		return authOpts, err
+	}
+	err = json.Unmarshal(content, &authOpts)
+	return authOpts, err
+}
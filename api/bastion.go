@@ -0,0 +1,112 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/sulochan/kaas/models"
+)
+
+// bastionKey logs in to the bastions, see SetBastionKey.
+var bastionKey ssh.Signer
+
+// SetBastionKey sets the key kaas logs in to the bastions with. It must be
+// called before the router starts serving requests.
+func SetBastionKey(key ssh.Signer) {
+	bastionKey = key
+}
+
+// bastion returns the jump host of the cluster: its own, else the one of its
+// region, nil if its nodes are reached directly.
+func (c *ApiCluster) bastion() *models.Bastion {
+	if c.Cluster.Bastion != nil {
+		return c.Cluster.Bastion
+	}
+	if b, ok := conf.SSH.Bastions[regionOf(&c.Cluster)]; ok {
+		return &b
+	}
+	return nil
+}
+
+// checkBastionHostKey returns the host key callback of the connections to
+// bastion b, whose key must be the one configured.
+func checkBastionHostKey(b *models.Bastion) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		if fingerprint != b.HostKey {
+			return fmt.Errorf("host key mismatch for bastion %s: got %s, expected %s, refusing to connect",
+				hostname, fingerprint, b.HostKey)
+		}
+		return nil
+	}
+}
+
+// dialBastion opens an ssh connection to the jump host of node n, nil if n
+// is reached directly.
+func (c *ApiCluster) dialBastion(n *models.Node) (*ssh.Client, error) {
+	b := c.bastion()
+	if b == nil {
+		return nil, nil
+	}
+
+	if b.FirstMaster {
+		m := c.firstMaster()
+		if m == nil {
+			return nil, errors.New("first master not found to jump through")
+		}
+		if m.UUID == n.UUID {
+			return nil, nil
+		}
+		return c.connect(m)
+	}
+
+	if bastionKey == nil {
+		return nil, errors.New("no bastion key to log in to " + b.Address + " with")
+	}
+	return ssh.Dial("tcp", b.Address, &ssh.ClientConfig{
+		User:            b.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(bastionKey)},
+		Timeout:         sshDialTimeout,
+		HostKeyCallback: checkBastionHostKey(b),
+	})
+}
+
+// dial opens an ssh connection to node n with sshConfig, through the
+// bastion of the cluster if it has one. Behind a bastion n is reached on its
+// private address.
+func (c *ApiCluster) dial(n *models.Node, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	jump, err := c.dialBastion(n)
+	if err != nil {
+		return nil, fmt.Errorf("bastion of %s: %v", n.Name, err)
+	}
+	if jump == nil {
+		return ssh.Dial("tcp", n.IP+":22", sshConfig)
+	}
+
+	ip := n.InternalIP
+	if ip == "" {
+		ip = n.IP
+	}
+	addr := ip + ":22"
+	conn, err := jump.Dial("tcp", addr)
+	if err != nil {
+		jump.Close()
+		return nil, err
+	}
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	if err != nil {
+		conn.Close()
+		jump.Close()
+		return nil, err
+	}
+	client := ssh.NewClient(clientConn, chans, reqs)
+	// the bastion connection lives as long as the one to the node
+	go func() {
+		client.Wait()
+		jump.Close()
+	}()
+	return client, nil
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/sulochan/kaas/config"
+	"github.com/sulochan/kaas/models"
+	"github.com/sulochan/kaas/provider"
+	"github.com/sulochan/kaas/provider/openstack"
+)
+
+// conf is the server configuration, see SetConfig.
+var conf = config.Default()
+
+// SetConfig sets the configuration the handlers and the provisioning worker
+// run with. It must be called before the router starts serving requests.
+func SetConfig(c *config.Config) {
+	conf = c
+}
+
+// newProvider returns the cloud provider of cluster, acting with the
+// credentials of a request.
+var newProvider = func(authOpts models.AuthOpts, cluster *models.Cluster) (provider.Provider, error) {
+	p, err := openstack.New(authOpts, openstack.Options{
+		IdentityURL:     conf.OpenStack.IdentityURL,
+		Region:          regionOf(cluster),
+		LoadBalancer:    cluster.LBProvider,
+		OctaviaSubnetID: conf.LoadBalancer.OctaviaSubnet,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SetProvider sets the function the handlers and the provisioning worker get
+// their cloud provider from. It must be called before the router starts
+// serving requests.
+func SetProvider(f func(authOpts models.AuthOpts, cluster *models.Cluster) (provider.Provider, error)) {
+	newProvider = f
+}
+
+// regionOf returns the region of cluster, clusters created before it was
+// recorded are in the configured one.
+func regionOf(cluster *models.Cluster) string {
+	if cluster.Region == "" {
+		return conf.OpenStack.Region
+	}
+	return cluster.Region
+}
+
+func validLBProvider(lbProvider string) bool {
+	return lbProvider == models.LBProviderCloudLB || lbProvider == models.LBProviderOctavia
+}
+
+// upgradeLegacyLB moves the Rackspace lb of a cluster created before
+// providers existed into LoadBalancer.
+func upgradeLegacyLB(cluster *models.Cluster) {
+	if cluster.LoadBalancer == nil && cluster.LBNode != nil {
+		cluster.LoadBalancer = openstack.NewLoadBalancer(cluster.LBNode)
+	}
+}
+
+// reservedMetadata are the metadata keys kaas finds the VMs of a cluster by.
+var reservedMetadata = []string{"k8saas", "cluster", "cluster_uuid"}
+
+// checkMachines fills in the flavor and image left empty in machines from
+// the configuration, then checks every spec against the catalog of cloud.
+// A spec that cannot work is reported as problem, err is only set when the
+// catalog could not be read.
+func checkMachines(cloud provider.Provider, machines *models.MachineSpecs) (problem string, err error) {
+	for _, role := range []string{"master", "worker", "etcd"} {
+		spec := machines.For(role)
+		if spec.Flavor == "" {
+			spec.Flavor = conf.Machine.Flavor
+		}
+		if spec.Image == "" {
+			spec.Image = conf.Machine.Image
+		}
+		if spec.VolumeSize < 0 {
+			return fmt.Sprintf("%s volume_size cannot be negative", role), nil
+		}
+		if spec.VolumeType != "" && spec.VolumeSize == 0 {
+			return fmt.Sprintf("%s volume_type needs a volume_size", role), nil
+		}
+		for k := range spec.Metadata {
+			if stringInSlice(k, reservedMetadata) {
+				return fmt.Sprintf("%s metadata key %s is reserved", role, k), nil
+			}
+		}
+
+		flavor, err := cloud.GetFlavor(spec.Flavor)
+		if err == provider.ErrNotFound {
+			return fmt.Sprintf("%s flavor %s does not exist", role, spec.Flavor), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		image, err := cloud.GetImage(spec.Image)
+		if err == provider.ErrNotFound {
+			return fmt.Sprintf("%s image %s does not exist", role, spec.Image), nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if image.Status != provider.ImageActive {
+			return fmt.Sprintf("%s image %s is %s", role, image.ID, image.Status), nil
+		}
+		if flavor.RAM < image.MinRAM {
+			return fmt.Sprintf("%s image %s needs %dMB of RAM, flavor %s has %dMB",
+				role, image.ID, image.MinRAM, flavor.ID, flavor.RAM), nil
+		}
+		disk := flavor.Disk
+		if spec.VolumeSize > 0 {
+			disk = spec.VolumeSize
+		}
+		// a flavor without disk only boots from volume, the cloud decides
+		if disk > 0 && disk < image.MinDisk {
+			return fmt.Sprintf("%s image %s needs a %dGB disk, %s has %dGB",
+				role, image.ID, image.MinDisk, role, disk), nil
+		}
+	}
+	return "", nil
+}
+
+// CreateVM creates VM number count of role serverType in cluster, following
+// the machine spec of the role.
+func CreateVM(cloud provider.Provider, cluster *models.Cluster, serverType string, count int) (*models.Node, error) {
+	serverData, err := userData(cluster, serverType)
+	if err != nil {
+		return &models.Node{}, err
+	}
+
+	spec := *cluster.Machines.For(serverType)
+	if spec.Flavor == "" {
+		spec.Flavor = conf.Machine.Flavor
+	}
+	if spec.Image == "" {
+		spec.Image = conf.Machine.Image
+	}
+
+	metadata := map[string]string{}
+	for k, v := range spec.Metadata {
+		metadata[k] = v
+	}
+	metadata["k8saas"] = "true"
+	metadata["cluster"] = cluster.Name
+	metadata["cluster_uuid"] = cluster.UUID
+
+	servername := fmt.Sprintf("k8s-%s-%s-%v", cluster.Name, serverType, count)
+	server, err := cloud.CreateServer(provider.CreateServerOpts{
+		Name:             servername,
+		FlavorRef:        spec.Flavor,
+		ImageRef:         spec.Image,
+		AvailabilityZone: spec.AvailabilityZone,
+		VolumeSize:       spec.VolumeSize,
+		VolumeType:       spec.VolumeType,
+		Metadata:         metadata,
+		UserData:         serverData,
+	})
+	if err != nil {
+		fmt.Printf("Unable to create server: %s\n", err)
+		return &models.Node{}, err
+	}
+
+	// nodes are logged in to with the ssh key of the cluster, the root
+	// password is not kept
+	serverNode := models.Node{Name: servername, UUID: server.ID}
+	fmt.Println("Returning serverNode -> ", serverNode)
+	return &serverNode, nil
+}
+
+// findClusterVMs - ids of the servers named servername that belong to the
+// cluster clusterUUID, all of them if servername is empty.
+func findClusterVMs(cloud provider.Provider, clusterUUID string, servername string) ([]string, error) {
+	list, err := cloud.ListServers(servername)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, s := range list {
+		if s.Metadata["cluster_uuid"] == clusterUUID {
+			ids = append(ids, s.ID)
+		}
+	}
+	return ids, nil
+}
+
+// DeleteVM - delete cs vm.
+func DeleteVM(cloud provider.Provider, uuid string) error {
+	return cloud.DeleteServer(uuid)
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sulochan/kaas/cloudinit"
+	"github.com/sulochan/kaas/models"
+)
+
+// cloudInit renders the user-data of the VMs, see SetCloudInit.
+var cloudInit *cloudinit.Templates
+
+// SetCloudInit sets the templates the user-data of the VMs is rendered from.
+// It must be called before the router starts serving requests.
+func SetCloudInit(t *cloudinit.Templates) {
+	cloudInit = t
+}
+
+var (
+	rePackage     = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]*(=[A-Za-z0-9.:~+-]+)?$`)
+	reSysctlKey   = regexp.MustCompile(`^[a-z0-9_]+(\.[a-z0-9_-]+)+$`)
+	reSysctlValue = regexp.MustCompile(`^[A-Za-z0-9 ._:/-]+$`)
+)
+
+// cloudInitSpec returns the cloud-init spec of cluster, with the default
+// container runtime if it has none.
+func cloudInitSpec(cluster *models.Cluster) models.CloudInitSpec {
+	spec := cluster.CloudInit
+	if spec.ContainerRuntime == "" {
+		spec.ContainerRuntime = models.RuntimeContainerd
+	}
+	return spec
+}
+
+// checkProxy returns what is wrong with proxy url u, nothing if it is empty.
+func checkProxy(name, u string) string {
+	if u == "" {
+		return ""
+	}
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Sprintf("invalid %s %q", name, u)
+	}
+	return ""
+}
+
+// checkCloudInit returns what is wrong with spec, nothing if it can be
+// rendered.
+func checkCloudInit(spec models.CloudInitSpec) string {
+	if spec.ContainerRuntime != models.RuntimeContainerd && spec.ContainerRuntime != models.RuntimeDocker {
+		return fmt.Sprintf("unknown container_runtime %q, use containerd or docker", spec.ContainerRuntime)
+	}
+	if problem := checkProxy("http_proxy", spec.HTTPProxy); problem != "" {
+		return problem
+	}
+	if problem := checkProxy("https_proxy", spec.HTTPSProxy); problem != "" {
+		return problem
+	}
+	if strings.ContainsAny(spec.NoProxy, " \t\n\"'") {
+		return fmt.Sprintf("invalid no_proxy %q", spec.NoProxy)
+	}
+	for _, m := range spec.RegistryMirrors {
+		if problem := checkProxy("registry mirror", m); problem != "" {
+			return problem
+		}
+	}
+	for _, p := range spec.ExtraPackages {
+		if !rePackage.MatchString(p) {
+			return fmt.Sprintf("invalid extra package %q", p)
+		}
+	}
+	for key, value := range spec.Sysctls {
+		if !reSysctlKey.MatchString(key) || !reSysctlValue.MatchString(value) {
+			return fmt.Sprintf("invalid sysctl %s = %q", key, value)
+		}
+	}
+	return ""
+}
+
+// cloudInitData returns what the user-data of a VM of role in cluster is
+// rendered with.
+func cloudInitData(cluster *models.Cluster, role string) cloudinit.Data {
+	spec := cloudInitSpec(cluster)
+	data := cloudinit.Data{
+		Role:              role,
+		ClusterName:       cluster.Name,
+		ClusterUUID:       cluster.UUID,
+		KubernetesVersion: cluster.KubernetesVersion,
+		Packages:          "kubelet kubeadm kubectl",
+		ContainerRuntime:  spec.ContainerRuntime,
+		HTTPProxy:         spec.HTTPProxy,
+		HTTPSProxy:        spec.HTTPSProxy,
+		NoProxy:           spec.NoProxy,
+		RegistryMirrors:   spec.RegistryMirrors,
+		ExtraPackages:     spec.ExtraPackages,
+		Sysctls:           spec.Sysctls,
+	}
+	if cluster.SSHPublicKey != "" {
+		data.SSHAuthorizedKeys = []string{cluster.SSHPublicKey}
+	}
+	// clusters created before versions were recorded get the latest
+	// packages
+	if cluster.KubernetesVersion != "" {
+		data.PackageVersion = conf.Kubernetes.PackageVersion(cluster.KubernetesVersion)
+		data.Packages = fmt.Sprintf("kubelet=%[1]s kubeadm=%[1]s kubectl=%[1]s", data.PackageVersion)
+	}
+	if spec.HTTPProxy != "" {
+		data.ProxyEnv += "http_proxy=" + spec.HTTPProxy + " "
+	}
+	if spec.HTTPSProxy != "" {
+		data.ProxyEnv += "https_proxy=" + spec.HTTPSProxy + " "
+	}
+	if data.ProxyEnv != "" && spec.NoProxy != "" {
+		data.ProxyEnv += "no_proxy=" + spec.NoProxy + " "
+	}
+	return data
+}
+
+// userData returns the cloud-init of a VM of role in cluster.
+func userData(cluster *models.Cluster, role string) ([]byte, error) {
+	if cloudInit == nil {
+		return nil, errors.New("no cloud-init templates loaded")
+	}
+	return cloudInit.Render(role, cloudInitData(cluster, role))
+}
+
+// PreviewCloudInit - render the user-data a VM of the ?role= role (master,
+// worker or etcd) would boot with, for the cluster spec in the body.
+func PreviewCloudInit(w http.ResponseWriter, r *http.Request) {
+	role := r.URL.Query().Get("role")
+	if role == "" {
+		role = "worker"
+	}
+	known := false
+	for _, rl := range cloudinit.Roles {
+		known = known || rl == role
+	}
+	if !known {
+		http.Error(w, "Unknown role, use one of "+strings.Join(cloudinit.Roles, ", "), 400)
+		return
+	}
+
+	cluster := models.Cluster{}
+	if err := json.NewDecoder(r.Body).Decode(&cluster); err != nil {
+		log.Error("Error decoding json for cloud-init preview: ", err)
+		http.Error(w, "Error decoding the json data in request", 400)
+		return
+	}
+	if cluster.Name == "" {
+		cluster.Name = defaultClusterName
+	}
+	if problem := checkClusterName(cluster.Name); problem != "" {
+		http.Error(w, "Invalid name: "+problem, 400)
+		return
+	}
+	if cluster.KubernetesVersion == "" {
+		cluster.KubernetesVersion = conf.Kubernetes.DefaultVersion
+	}
+	if !conf.Kubernetes.Supports(cluster.KubernetesVersion) {
+		http.Error(w, "Unsupported kubernetes_version, use one of "+strings.Join(conf.Kubernetes.Versions, ", "), 400)
+		return
+	}
+	cluster.CloudInit = cloudInitSpec(&cluster)
+	if problem := checkCloudInit(cluster.CloudInit); problem != "" {
+		http.Error(w, "Invalid cloud_init: "+problem, 400)
+		return
+	}
+
+	content, err := userData(&cluster, role)
+	if err != nil {
+		log.Error("Error rendering cloud-init preview: ", err)
+		http.Error(w, "Error rendering cloud-init: "+err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/cloud-config")
+	w.Write(content)
+}
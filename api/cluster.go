@@ -1,25 +1,50 @@
 package api
 
 import (
+	gocontext "context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
+	"strings"
 	"time"
 
 	"net/http"
 
-	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
-	"github.com/gophercloud/gophercloud/pagination"
-	"github.com/os-pc/gocloudlb/loadbalancers"
-
 	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
 	"github.com/pborman/uuid"
 	log "github.com/sirupsen/logrus"
-	db "github.com/sulochan/kaas/db/mongodb"
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/executor"
 	"github.com/sulochan/kaas/models"
+	"github.com/sulochan/kaas/provider"
+	"golang.org/x/crypto/ssh"
 )
 
+// defaultClusterName is the name of clusters created without one.
+const defaultClusterName = "newcluster"
+
+// maxClusterNameLength leaves room in the 63 characters of a hostname for
+// the k8s- prefix and the -worker-<n> suffix of the node names.
+const maxClusterNameLength = 40
+
+// reClusterName matches a DNS-1123 label. The name ends up in hostnames, the
+// kubernetes node names and the commands run on the nodes.
+var reClusterName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// checkClusterName returns what is wrong with the name of a new cluster,
+// nothing if it can be used.
+func checkClusterName(name string) string {
+	if len(name) > maxClusterNameLength {
+		return fmt.Sprintf("at most %d characters", maxClusterNameLength)
+	}
+	if !reClusterName.MatchString(name) {
+		return "lowercase letters, digits and '-' only, starting and ending with a letter or digit"
+	}
+	return ""
+}
+
 func stringInSlice(a string, list []string) bool {
 	for _, b := range list {
 		if b == a {
@@ -29,91 +54,168 @@ func stringInSlice(a string, list []string) bool {
 	return false
 }
 
-// GetAllClusters - get k8s clusters
-func GetCluster(w http.ResponseWriter, r *http.Request) {
-	authOpts := context.Get(r, "authOpts").(models.AuthOpts)
+// etag returns the entity tag of the stored cluster, its quoted revision.
+func etag(cluster *models.Cluster) string {
+	return fmt.Sprintf("\"%d\"", cluster.Revision)
+}
 
-	fmt.Println("Get clusters got called")
-	public := models.Public{}
-	names := []string{}
-	data := []models.Node{}
+// ifMatch reports whether the If-Match header of r, if any, matches the
+// current revision of cluster.
+func ifMatch(r *http.Request, cluster *models.Cluster) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag(cluster) {
+			return true
+		}
+	}
+	return false
+}
+
+// errPrecondition is returned by updateIfMatch when the cluster is no longer
+// at a revision If-Match names.
+var errPrecondition = errors.New("cluster was modified, If-Match does not match")
+
+// updateIfMatch applies mutate to the stored cluster and writes it back.
+// Without If-Match, or with If-Match: *, it retries on conflicts like
+// db.UpdateClusterWithRetry. Otherwise the write is a single compare-and-swap
+// against a revision the client sent, errPrecondition if the cluster moved
+// on since.
+func updateIfMatch(r *http.Request, projectid string, uuid string, mutate func(cluster *models.Cluster) error) (*models.Cluster, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return db.UpdateClusterWithRetry(store, projectid, uuid, mutate)
+	}
 
-	client, err := GetComputeServcie(authOpts)
+	cluster, err := store.GetCluster(projectid, uuid)
 	if err != nil {
-		http.Error(w, "Error creating openstack client to get servers", 500)
-		return
+		return nil, err
+	}
+	if !ifMatch(r, cluster) {
+		return nil, errPrecondition
 	}
-	sopts := servers.ListOpts{Name: "k8s-*"}
-	pager := servers.List(client, sopts)
+	if err := mutate(cluster); err != nil {
+		return nil, err
+	}
+	err = store.UpdateCluster(cluster)
+	if err == db.Conflict {
+		return nil, errPrecondition
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cluster, nil
+}
 
-	err = pager.EachPage(func(page pagination.Page) (bool, error) {
-		serverList, err := servers.ExtractServers(page)
-		if err != nil {
-			fmt.Println("Error: ", err)
-		}
-		for _, s := range serverList {
-			// "s" will be a servers.Server
-			cluster, cluster_ok := s.Metadata["cluster"]
-			roles, roles_ok := s.Metadata["roles"]
-
-			_, ok := s.Metadata["k8saas"]
-			if ok {
-				node := models.Node{IP: s.AccessIPv4}
-				if cluster_ok {
-					if !stringInSlice(cluster, names) {
-						names = append(names, cluster)
-					}
-					node.Cluster = cluster
-				}
-				if roles_ok {
-					node.Roles = []string{roles}
-				}
-				data = append(data, node)
-			}
-		}
-		return true, nil
-	})
+// nodeResponse - the public view of a models.Node
+type nodeResponse struct {
+	UUID       string   `json:"uuid"`
+	Name       string   `json:"name"`
+	IP         string   `json:"ip"`
+	InternalIP string   `json:"internal_ip"`
+	Roles      []string `json:"roles"`
+	HostKeys   []string `json:"host_keys"`
+}
 
-	public.Names = names
-	public.Nodes = data
+// clusterResponse - the public view of a models.Cluster
+type clusterResponse struct {
+	UUID         string               `json:"uuid"`
+	Name         string               `json:"name"`
+	Masters      int                  `json:"masters"`
+	Workers      int                  `json:"workers"`
+	Etcd         int                  `json:"etcd"`
+	ExternalEtcd bool                 `json:"external_etc"`
+	MasterNodes  []nodeResponse       `json:"master_nodes"`
+	WorkerNodes  []nodeResponse       `json:"worker_nodes"`
+	EtcdNodes    []nodeResponse       `json:"etcd_nodes"`
+	Status       string               `json:"status"`
+	StatusReason string               `json:"status_reason"`
+	Revision     int64                `json:"revision"`
+	LBProvider   string               `json:"lb_provider"`
+	Region       string               `json:"region"`
+	Machines     models.MachineSpecs  `json:"machines"`
+	Kubeadm      models.KubeadmSpec   `json:"kubeadm"`
+	CNI          models.CNISpec       `json:"cni"`
+	Version      string               `json:"kubernetes_version"`
+	CloudInit    models.CloudInitSpec `json:"cloud_init"`
+	SSHKey       string               `json:"ssh_public_key"`
+	Bastion      *models.Bastion      `json:"bastion"`
+	CreatedAt    time.Time            `json:"created_at"`
+	CreatedBy    string               `json:"created_by"`
+}
 
-	publicData := map[string][]models.Node{}
-	for _, j := range public.Names {
-		for _, l := range public.Nodes {
-			if l.Cluster == j {
-				publicData[j] = append(publicData[j], l)
-			}
-		}
+func newNodeResponse(n *models.Node) nodeResponse {
+	return nodeResponse{UUID: n.UUID, Name: n.Name, IP: n.IP, InternalIP: n.InternalIP, Roles: n.Roles, HostKeys: n.HostKeys}
+}
+
+func newNodeResponses(nodes []*models.Node) []nodeResponse {
+	resp := []nodeResponse{}
+	for _, n := range nodes {
+		resp = append(resp, newNodeResponse(n))
 	}
-	json.NewEncoder(w).Encode(publicData)
-	return
+	return resp
+}
 
+func newClusterResponse(c *models.Cluster) clusterResponse {
+	lbProvider := c.LBProvider
+	if lbProvider == "" {
+		lbProvider = models.LBProviderCloudLB
+	}
+	return clusterResponse{LBProvider: lbProvider, Region: regionOf(c), Machines: c.Machines, Kubeadm: c.Kubeadm.WithDefaults(), CNI: cniSpec(c), Version: c.KubernetesVersion, CloudInit: cloudInitSpec(c), SSHKey: c.SSHPublicKey, Bastion: c.Bastion, UUID: c.UUID, Name: c.Name, Masters: c.Master, Workers: c.Worker, Etcd: c.Etcd,
+		ExternalEtcd: c.ExternalEtcd, MasterNodes: newNodeResponses(c.MasterNodes),
+		WorkerNodes: newNodeResponses(c.WorkerNodes), EtcdNodes: newNodeResponses(c.EtcdNodes),
+		Status: c.Status, StatusReason: c.StatusReason, Revision: c.Revision, CreatedAt: c.CreatedAt, CreatedBy: c.CreatedBy}
+}
+
+// GetCluster - get a k8s cluster, its ETag is the cluster revision
+func GetCluster(w http.ResponseWriter, r *http.Request) {
+	projectid := context.Get(r, "projectid").(string)
+	vars := mux.Vars(r)
+
+	cluster, err := store.GetCluster(projectid, vars["cluster"])
+	if err == db.NotFound {
+		http.Error(w, "Cluster not found", 404)
+		return
+	}
+	if err != nil {
+		log.Error("Error getting cluster from db: ", err)
+		http.Error(w, "Error getting cluster from the db", 500)
+		return
+	}
+
+	w.Header().Set("ETag", etag(cluster))
+	json.NewEncoder(w).Encode(newClusterResponse(cluster))
 }
 
 // GetCluster - get available clusters for this account
 func GetAllClusters(w http.ResponseWriter, r *http.Request) {
 	projectid := context.Get(r, "projectid")
 
-	clusters, err := db.GetAllClusters(projectid.(string))
+	clusters, err := store.GetAllClusters(projectid.(string))
 	if err != nil {
 		fmt.Println(err)
 	}
 
 	type resp struct {
-		UUID         string `json:"uuid"`
-		Name         string `json:"name"`
-		Masters      int    `json:"masters"`
-		Workers      int    `json:"workers"`
-		ExternalEtcd bool   `json:"external_etc"`
-		//Status string
-		CreatedAt time.Time `json:"created_at"`
-		CreatedBy string    `json:"created_by"`
+		UUID         string    `json:"uuid"`
+		Name         string    `json:"name"`
+		Masters      int       `json:"masters"`
+		Workers      int       `json:"workers"`
+		ExternalEtcd bool      `json:"external_etc"`
+		Status       string    `json:"status"`
+		StatusReason string    `json:"status_reason"`
+		CreatedAt    time.Time `json:"created_at"`
+		CreatedBy    string    `json:"created_by"`
 	}
 
 	response := []resp{}
 	for _, i := range clusters {
 		response = append(response, resp{UUID: i.UUID, Name: i.Name, Masters: i.Master,
-			Workers: i.Worker, ExternalEtcd: i.ExternalEtcd, CreatedAt: i.CreatedAt, CreatedBy: i.CreatedBy})
+			Workers: i.Worker, ExternalEtcd: i.ExternalEtcd, Status: i.Status, StatusReason: i.StatusReason,
+			CreatedAt: i.CreatedAt, CreatedBy: i.CreatedBy})
 	}
 
 	json.NewEncoder(w).Encode(response)
@@ -123,6 +225,33 @@ func GetAllClusters(w http.ResponseWriter, r *http.Request) {
 // ApiCluster - a local version of models.Cluster
 type ApiCluster struct {
 	Cluster models.Cluster
+	// cloud is the provider the cluster is built on, acting for the user
+	// who created it
+	cloud provider.Provider
+	// signer is the opened ssh key of the cluster, see sshAuth
+	signer ssh.Signer
+	// exec runs the commands on the nodes, see executor
+	exec   executor.Executor
+	output *commandOutput
+	// ctx is the context of the request the commands run for, if any
+	ctx gocontext.Context
+}
+
+// createRequest is the body of POST /api/clusters. Everything else about a
+// cluster, its nodes, lb and secrets included, is kaas' own.
+type createRequest struct {
+	Name              string               `json:"name"`
+	Worker            int                  `json:"worker"`
+	Etcd              int                  `json:"etcd"`
+	ExternalEtcd      bool                 `json:"externaletcd"`
+	Region            string               `json:"region"`
+	LBProvider        string               `json:"lb_provider"`
+	Machines          models.MachineSpecs  `json:"machines"`
+	Kubeadm           models.KubeadmSpec   `json:"kubeadm"`
+	CNI               models.CNISpec       `json:"cni"`
+	KubernetesVersion string               `json:"kubernetes_version"`
+	CloudInit         models.CloudInitSpec `json:"cloud_init"`
+	Bastion           *models.Bastion      `json:"bastion"`
 }
 
 // CreateCluster - creates a new k8s cluster
@@ -132,76 +261,144 @@ func CreateCluster(w http.ResponseWriter, r *http.Request) {
 	username := context.Get(r, "username")
 
 	decoder := json.NewDecoder(r.Body)
-	c := ApiCluster{}
+	req := createRequest{}
 
-	err := decoder.Decode(&c.Cluster)
+	err := decoder.Decode(&req)
 	if err != nil {
 		log.Error("Error decoding json for new cluster create: ", err)
 		http.Error(w, "Error decoding the json data in request", 500)
 		return
 	}
 
-	fmt.Println("got cluster created -> ", c.Cluster)
-
+	c := ApiCluster{Cluster: models.Cluster{
+		Name:              req.Name,
+		Worker:            req.Worker,
+		Etcd:              req.Etcd,
+		ExternalEtcd:      req.ExternalEtcd,
+		Region:            req.Region,
+		LBProvider:        req.LBProvider,
+		Machines:          req.Machines,
+		Kubeadm:           req.Kubeadm,
+		CNI:               req.CNI,
+		KubernetesVersion: req.KubernetesVersion,
+		CloudInit:         req.CloudInit,
+		Bastion:           req.Bastion,
+	}}
 	c.Cluster.Master = 3
 	c.Cluster.UUID = uuid.New()
 	c.Cluster.CreatedAt = time.Now()
 
 	if c.Cluster.Name == "" {
-		c.Cluster.Name = "NewCluster"
+		c.Cluster.Name = defaultClusterName
+	}
+	if problem := checkClusterName(c.Cluster.Name); problem != "" {
+		http.Error(w, "Invalid name: "+problem, 400)
+		return
 	}
 	c.Cluster.ProjectId = projectid.(string)
 	c.Cluster.CreatedBy = username.(string)
-	c.Cluster.Status = "Building"
-
-	err = db.CreateNewCluster(&c.Cluster)
+	if c.Cluster.Region == "" {
+		c.Cluster.Region = conf.OpenStack.Region
+	}
+	c.Cluster.Status = models.StatusPending
+	c.Cluster.StatusReason = "Waiting for provisioning to start"
+	credentials, err := sealCredentials(authOpts)
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, "Error creating cluster in the db", 500)
+		log.Error("Error sealing credentials: ", err)
+		http.Error(w, "Error sealing credentials", 500)
 		return
 	}
+	c.Cluster.Provisioning = models.NewProvisioning(credentials)
 
-	client, err := GetComputeServcie(authOpts)
+	if c.Cluster.LBProvider == "" {
+		c.Cluster.LBProvider = conf.LoadBalancer.Provider
+	}
+	if !validLBProvider(c.Cluster.LBProvider) {
+		http.Error(w, "Unknown lb_provider, use cloudlb or octavia", 400)
+		return
+	}
+	if c.Cluster.Bastion != nil {
+		if problem := conf.SSH.CheckBastion(*c.Cluster.Bastion); problem != "" {
+			http.Error(w, "Invalid bastion: "+problem, 400)
+			return
+		}
+	}
+
+	c.Cluster.Kubeadm = c.Cluster.Kubeadm.WithDefaults()
+	if problem := checkKubeadm(&c.Cluster.Kubeadm); problem != "" {
+		http.Error(w, "Invalid kubeadm spec: "+problem, 400)
+		return
+	}
+	if c.Cluster.KubernetesVersion == "" {
+		c.Cluster.KubernetesVersion = conf.Kubernetes.DefaultVersion
+	}
+	if !conf.Kubernetes.Supports(c.Cluster.KubernetesVersion) {
+		http.Error(w, "Unsupported kubernetes_version, use one of "+strings.Join(conf.Kubernetes.Versions, ", "), 400)
+		return
+	}
+	c.Cluster.CloudInit = cloudInitSpec(&c.Cluster)
+	if problem := checkCloudInit(c.Cluster.CloudInit); problem != "" {
+		http.Error(w, "Invalid cloud_init: "+problem, 400)
+		return
+	}
+	if c.Cluster.CNI.Plugin == "" {
+		c.Cluster.CNI.Plugin = conf.CNI.Plugin
+	}
+	c.Cluster.CNI = cniSpec(&c.Cluster)
+	if problem := checkCNI(c.Cluster.CNI); problem != "" {
+		http.Error(w, "Invalid cni: "+problem, 400)
+		return
+	}
+	if !c.Cluster.ExternalEtcd {
+		// stacked etcd runs on the masters
+		c.Cluster.Etcd = 0
+	} else if !validEtcdCount(c.Cluster.Etcd) {
+		http.Error(w, "External etcd needs 1, 3, 5 or 7 etcd nodes", 400)
+		return
+	}
+
+	cloud, err := newProvider(authOpts, &c.Cluster)
 	if err != nil {
 		http.Error(w, "Error creating client for openstack service", 500)
 		return
 	}
 
-	// Set OS client for the cluster
-	c.Cluster.OSClient = client
-
-	// create the api lb first
-	go c.CreateLB(authOpts)
+	// nothing is created before the machine specs are known to work
+	problem, err := checkMachines(cloud, &c.Cluster.Machines)
+	if err != nil {
+		log.Error("Error checking machine specs: ", err)
+		http.Error(w, "Error checking flavors and images", 500)
+		return
+	}
+	if problem != "" {
+		http.Error(w, "Invalid machine spec: "+problem, 400)
+		return
+	}
 
-	for i := 1; i <= c.Cluster.Master; i++ {
-		masterNode, err := CreateVM(c.Cluster.Name, "master", i, authOpts)
-		if err != nil {
-			http.Error(w, "Error creating VMs for cluster", 500)
-		}
-		c.Cluster.MasterNodes = append(c.Cluster.MasterNodes, masterNode)
+	op, err := newOperation(models.OperationCreate, &c.Cluster, c.Cluster.CreatedBy)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error creating operation in the db", 500)
+		return
 	}
+	c.Cluster.Provisioning.OperationId = op.ID
 
-	for i := 1; i <= c.Cluster.Worker; i++ {
-		workerNode, err := CreateVM(c.Cluster.Name, "worker", i, authOpts)
-		if err != nil {
-			http.Error(w, "Error creating VMs for cluster", 500)
-		}
-		c.Cluster.WorkerNodes = append(c.Cluster.WorkerNodes, workerNode)
+	err = store.CreateNewCluster(&c.Cluster)
+	if err != nil {
+		fmt.Println(err)
+		finishOperation(op.ProjectId, op.ID, err)
+		http.Error(w, "Error creating cluster in the db", 500)
+		return
 	}
 
-	go c.goRunClusterSetup(authOpts)
-	return
-}
+	// Set cloud provider for the cluster
+	c.cloud = cloud
 
-func (c *ApiCluster) goRunClusterSetup(authOpts models.AuthOpts) {
-	c.TrackVMBuild(authOpts)
-	c.AttachFirstMaster(authOpts)
-	c.RunDeploy(authOpts)
-	c.AttachMastersToLB(authOpts)
-}
+	// the lb, the VMs and the k8s deploy are all created by the
+	// provisioning worker, see provision.go
+	go c.goRunClusterSetup()
 
-// UpdateCluster - update a cluster.
-func UpdateCluster(w http.ResponseWriter, r *http.Request) {
+	writeAccepted(w, op)
 }
 
 // DeleteCluster - delete a given cluster.
@@ -211,332 +408,657 @@ func DeleteCluster(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	cluster := vars["cluster"]
 
-	dbCluster, err := db.GetCluster(projectid, cluster)
+	dbCluster, err := store.GetCluster(projectid, cluster)
+	if err == db.NotFound {
+		http.Error(w, "Cluster not found", 404)
+		return
+	}
 	if err != nil {
 		fmt.Println(err)
+		http.Error(w, "Error getting cluster from the db", 500)
 		return
 	}
 
-	// first delete all nodes
-	for _, worker := range dbCluster.WorkerNodes {
-		DeleteVM(worker.UUID, authOpts)
+	if !ifMatch(r, dbCluster) {
+		http.Error(w, "Cluster was modified, If-Match does not match", http.StatusPreconditionFailed)
+		return
 	}
-
-	for _, master := range dbCluster.MasterNodes {
-		DeleteVM(master.UUID, authOpts)
+	if dbCluster.Status == models.StatusDeleting {
+		http.Error(w, "Cluster is already being deleted", http.StatusConflict)
+		return
 	}
 
-	for _, etcd := range dbCluster.EtcdNodes {
-		DeleteVM(etcd.UUID, authOpts)
+	// stops the provisioning worker of the cluster, if any
+	dbCluster, err = updateIfMatch(r, projectid, cluster, func(c *models.Cluster) error {
+		if c.Status == models.StatusDeleting {
+			return errDeleting
+		}
+		c.Status = models.StatusDeleting
+		c.StatusReason = "Deleting nodes and LB"
+		c.Provisioning.Active = false
+		c.Provisioning.Credentials = ""
+		return nil
+	})
+	if err == errPrecondition {
+		http.Error(w, "Cluster was modified, If-Match does not match", http.StatusPreconditionFailed)
+		return
+	}
+	if err == errDeleting {
+		http.Error(w, "Cluster is already being deleted", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error updating cluster in the db", 500)
+		return
 	}
 
-	// delete cloud lb
-	if dbCluster.LBNode != nil {
-		deleteLoadbalancer(dbCluster.LBNode, authOpts)
+	op, err := newOperation(models.OperationDelete, dbCluster, context.Get(r, "username").(string))
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error creating operation in the db", 500)
+		return
 	}
-	//deleteLoadbalancer(dbCluster.LBNode, authOpts)
 
-	// update dbCluster as deleted in db
-	dbCluster.Deleted = 1
-	err = db.UpdateCluster(dbCluster)
+	cloud, err := newProvider(authOpts, dbCluster)
 	if err != nil {
-		// this is bad
-		fmt.Println("*** Could not find active cluster in db. ***")
+		finishOperation(op.ProjectId, op.ID, err)
+		http.Error(w, "Error creating client for openstack service", 500)
 		return
 	}
 
-}
+	go goDeleteCluster(dbCluster, op, cloud)
 
-// GetClusterNodes - get k8s cluster nodes.
-func GetClusterNodes(w http.ResponseWriter, r *http.Request) {
+	writeAccepted(w, op)
 }
 
-// DeleteClusterNode - get k8s cluster node.
-func DeleteClusterNode(w http.ResponseWriter, r *http.Request) {
+// goDeleteCluster deletes every VM and the LB of dbCluster, then marks it
+// deleted, reporting progress on op.
+func goDeleteCluster(dbCluster *models.Cluster, op *models.Operation, cloud provider.Provider) {
+	// first delete all nodes
+	nodes := append([]*models.Node{}, dbCluster.WorkerNodes...)
+	nodes = append(nodes, dbCluster.MasterNodes...)
+	nodes = append(nodes, dbCluster.EtcdNodes...)
+
+	deleted := map[string]bool{}
+	for i, node := range nodes {
+		setOperationProgress(op.ProjectId, op.ID, 100*i/(len(nodes)+1), "Deleting VM "+node.Name)
+		if err := DeleteVM(cloud, node.UUID); err != nil {
+			log.Error("Error deleting VM ", node.UUID, ": ", err)
+		}
+		deleted[node.UUID] = true
+	}
+
+	// a provisioning worker may have created VMs the snapshot above misses,
+	// before it noticed the cluster is being deleted
+	ids, err := findClusterVMs(cloud, dbCluster.UUID, "")
+	if err != nil {
+		log.Error("Error listing VMs of cluster ", dbCluster.UUID, ": ", err)
+	}
+	for _, id := range ids {
+		if deleted[id] {
+			continue
+		}
+		log.Info("Deleting unrecorded VM ", id, " of cluster ", dbCluster.UUID)
+		if err := DeleteVM(cloud, id); err != nil {
+			log.Error("Error deleting VM ", id, ": ", err)
+		}
+	}
+
+	// delete cloud lb
+	upgradeLegacyLB(dbCluster)
+	if dbCluster.LoadBalancer != nil {
+		setOperationProgress(op.ProjectId, op.ID, 100*len(nodes)/(len(nodes)+1), "Deleting LB")
+		if err := cloud.DeleteLoadBalancer(dbCluster.LoadBalancer.ID); err != nil {
+			log.Error("Error deleting LB ", dbCluster.LoadBalancer.ID, ": ", err)
+		}
+	}
+
+	// update dbCluster as deleted in db
+	_, err = db.UpdateClusterWithRetry(store, dbCluster.ProjectId, dbCluster.UUID, func(c *models.Cluster) error {
+		c.Deleted = 1
+		c.Status = models.StatusDeleted
+		c.StatusReason = "Cluster deleted"
+		return nil
+	})
+	if err != nil {
+		// this is bad
+		fmt.Println("*** Could not find active cluster in db. ***")
+	}
+	finishOperation(op.ProjectId, op.ID, err)
 }
 
+// CreateLB creates the api lb of the cluster, unless a previous attempt
+// already did, and waits for it to become ACTIVE.
 func (c *ApiCluster) CreateLB(authOpts models.AuthOpts) error {
-	lb := loadbalancers.LoadBalancer{}
-	lb.Name = c.Cluster.Name + "-k8s-lb"
-	lb.Protocol = "HTTPS"
-	lb.Port = 6443
+	lb := c.Cluster.LoadBalancer
+	if lb == nil {
+		opts := provider.CreateLoadBalancerOpts{}
+		opts.Name = fmt.Sprintf("%s-k8s-lb-%s", c.Cluster.Name, c.Cluster.UUID)
+		opts.Protocol = "HTTPS"
+		opts.Port = 6443
+
+		// a previous attempt may have died between creating the lb and
+		// saving it, the cluster uuid in the name makes it safe to adopt
+		existing, err := c.cloud.ListLoadBalancers()
+		if err != nil {
+			return err
+		}
+		for i := range existing {
+			if existing[i].Name == opts.Name {
+				lb = &existing[i]
+				break
+			}
+		}
 
-	raxlb, err := createLoadbalancer(lb, authOpts)
-	if err != nil {
-		return err
+		if lb == nil {
+			lb, err = c.cloud.CreateLoadBalancer(opts)
+			if err != nil {
+				return err
+			}
+		}
+		c.Cluster.LoadBalancer = lb
+		if err := c.saveLB(lb); err != nil {
+			return err
+		}
 	}
 
 	startTime := time.Now()
 
 	for {
-		lb := getLoadbalancer(raxlb, authOpts)
-		if lb.Status == "ACTIVE" {
-			c.Cluster.LBNode = lb
-			break
+		lb, err := c.cloud.GetLoadBalancer(c.Cluster.LoadBalancer.ID)
+		if err != nil {
+			fmt.Println("Error getting lb: ", err)
+		}
+		if err == nil && lb.Status == provider.LBActive {
+			c.Cluster.LoadBalancer = lb
+			return c.saveLB(lb)
 		}
 
-		time.Sleep(20 * time.Second)
+		time.Sleep(pollInterval)
 		now := time.Now()
 		if now.Sub(startTime).Minutes() > float64(10) {
-			log.Println("LB not active after 10m of build... quitting nodes attach.")
-			// lb did not come online, break out of the loop
-			break
+			// lb did not come online
+			return errors.New("LB not active after 10m of build")
 		}
 	}
+}
 
+// saveLB records lb on the stored cluster without touching any other field.
+func (c *ApiCluster) saveLB(lb *models.LoadBalancer) error {
+	_, err := db.UpdateClusterWithRetry(store, c.Cluster.ProjectId, c.Cluster.UUID, func(cluster *models.Cluster) error {
+		cluster.LoadBalancer = lb
+		cluster.LBNode = nil
+		return nil
+	})
+	if err != nil {
+		log.Error("Error saving LB of cluster ", c.Cluster.UUID, ": ", err)
+	}
+	return err
+}
+
+// errDeleting stops the provisioning worker of a cluster being deleted.
+var errDeleting = errors.New("cluster is being deleted")
+
+// setStatus records status and the reason for it on the cluster. A cluster
+// that is Deleting or Deleted keeps its status; errDeleting is returned
+// instead, which stops a provisioning worker racing with DeleteCluster.
+func (c *ApiCluster) setStatus(status string, reason string) error {
+	_, err := db.UpdateClusterWithRetry(store, c.Cluster.ProjectId, c.Cluster.UUID, func(cluster *models.Cluster) error {
+		if cluster.Status == models.StatusDeleting || cluster.Status == models.StatusDeleted {
+			return errDeleting
+		}
+		cluster.Status = status
+		cluster.StatusReason = reason
+		return nil
+	})
+	if err != nil {
+		log.Error("Error saving status of cluster ", c.Cluster.UUID, ": ", err)
+		return err
+	}
+	c.Cluster.Status = status
+	c.Cluster.StatusReason = reason
 	return nil
 }
 
-func (c *ApiCluster) AttachFirstMaster(authOpts models.AuthOpts) {
-	if c.Cluster.LBNode.Status != "ACTIVE" {
-		fmt.Println("Error: LB not ready. LB status is not ACTIVE.")
-		return
+// saveNodes records the node lists of the cluster without touching any other
+// field. Like setStatus it returns errDeleting for a cluster being deleted.
+func (c *ApiCluster) saveNodes() error {
+	_, err := db.UpdateClusterWithRetry(store, c.Cluster.ProjectId, c.Cluster.UUID, func(cluster *models.Cluster) error {
+		if cluster.Status == models.StatusDeleting || cluster.Status == models.StatusDeleted {
+			return errDeleting
+		}
+		cluster.MasterNodes = c.Cluster.MasterNodes
+		cluster.WorkerNodes = c.Cluster.WorkerNodes
+		cluster.EtcdNodes = c.Cluster.EtcdNodes
+		return nil
+	})
+	if err != nil {
+		log.Error("Error saving nodes of cluster ", c.Cluster.UUID, ": ", err)
 	}
+	return err
+}
 
-	n := []string{}
+// CreateVMs creates master, worker and external etcd VMs until the cluster
+// has as many as it asks for. Each VM is saved as soon as it is created, so a resumed build
+// never creates the same VM twice.
+func (c *ApiCluster) CreateVMs(authOpts models.AuthOpts) error {
+	if err := c.ensureVMs("master", c.Cluster.Master, &c.Cluster.MasterNodes, authOpts); err != nil {
+		return err
+	}
+	if err := c.ensureVMs("worker", c.Cluster.Worker, &c.Cluster.WorkerNodes, authOpts); err != nil {
+		return err
+	}
+	if !c.Cluster.ExternalEtcd {
+		return nil
+	}
+	return c.ensureVMs("etcd", c.Cluster.Etcd, &c.Cluster.EtcdNodes, authOpts)
+}
 
-	for _, m := range c.Cluster.MasterNodes {
-		servername := fmt.Sprintf("k8s-%s-master-1", c.Cluster.Name)
-		if m.Name == servername {
-			n = append(n, m.IP)
-			attachNodesToLoadbalancer(c.Cluster.LBNode, n, authOpts)
-			break
+// ensureVMs creates VMs of serverType until nodes has count of them, each
+// one numbered with the lowest number not in use.
+func (c *ApiCluster) ensureVMs(serverType string, count int, nodes *[]*models.Node, authOpts models.AuthOpts) error {
+	for len(*nodes) < count {
+		i := 1
+		for c.hasNode(*nodes, fmt.Sprintf("k8s-%s-%s-%v", c.Cluster.Name, serverType, i)) {
+			i++
+		}
+		if err := c.ensureVM(serverType, i, nodes, authOpts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ApiCluster) hasNode(nodes []*models.Node, name string) bool {
+	for _, n := range nodes {
+		if n.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureVM creates VM number count of serverType and appends it to nodes,
+// unless nodes already has it.
+func (c *ApiCluster) ensureVM(serverType string, count int, nodes *[]*models.Node, authOpts models.AuthOpts) error {
+	servername := fmt.Sprintf("k8s-%s-%s-%v", c.Cluster.Name, serverType, count)
+	if c.hasNode(*nodes, servername) {
+		return nil
+	}
+
+	// a previous attempt may have died between creating the VM and saving
+	// it. Nothing of it, like its host keys, was recorded, so delete it and
+	// start over.
+	orphans, err := findClusterVMs(c.cloud, c.Cluster.UUID, servername)
+	if err != nil {
+		return err
+	}
+	for _, orphan := range orphans {
+		log.Info("Deleting unrecorded VM ", orphan, " of cluster ", c.Cluster.UUID)
+		if err := DeleteVM(c.cloud, orphan); err != nil {
+			return err
+		}
+	}
+
+	node, err := CreateVM(c.cloud, &c.Cluster, serverType, count)
+	if err != nil {
+		return err
+	}
+	*nodes = append(*nodes, node)
+	err = c.saveNodes()
+	if err == errDeleting {
+		// DeleteCluster may have listed the VMs of the cluster before this
+		// one was created
+		if err := DeleteVM(c.cloud, node.UUID); err != nil {
+			log.Error("Error deleting VM ", node.UUID, " of deleted cluster: ", err)
+		}
+	}
+	return err
+}
+
+// isFirstMaster reports whether m is the first master, see firstMaster.
+func (c *ApiCluster) isFirstMaster(m *models.Node) bool {
+	return m == c.firstMaster()
+}
+
+// firstMaster returns the oldest master of the cluster, or nil if there is
+// none. That is master 1, the node kubeadm init runs on, until it is removed.
+// It is also the node every later kubeadm and kubectl command runs on.
+func (c *ApiCluster) firstMaster() *models.Node {
+	if len(c.Cluster.MasterNodes) == 0 {
+		return nil
+	}
+	return c.Cluster.MasterNodes[0]
+}
+
+// attachToLB attaches the addresses in ips that are not yet attached to the
+// lb of the cluster.
+func (c *ApiCluster) attachToLB(ips []string, authOpts models.AuthOpts) error {
+	lb, err := c.cloud.GetLoadBalancer(c.Cluster.LoadBalancer.ID)
+	if err != nil {
+		return err
+	}
+
+	n := []string{}
+	for _, ip := range ips {
+		attached := false
+		for _, address := range lb.Nodes {
+			if address == ip {
+				attached = true
+				break
+			}
+		}
+		if !attached {
+			n = append(n, ip)
 		}
 	}
+	if len(n) == 0 {
+		return nil
+	}
+	return c.cloud.AttachNodes(lb.ID, n)
+}
+
+func (c *ApiCluster) AttachFirstMaster(authOpts models.AuthOpts) error {
+	if c.Cluster.LoadBalancer == nil || c.Cluster.LoadBalancer.Status != provider.LBActive {
+		return errors.New("LB not ready, LB status is not ACTIVE")
+	}
+
+	m := c.firstMaster()
+	if m == nil {
+		return errors.New("first master not found")
+	}
+	return c.attachToLB([]string{m.IP}, authOpts)
 }
 
-func (c *ApiCluster) AttachMastersToLB(authOpts models.AuthOpts) {
+func (c *ApiCluster) AttachMastersToLB(authOpts models.AuthOpts) error {
 	n := []string{}
 
 	for _, m := range c.Cluster.MasterNodes {
-		servername := fmt.Sprintf("k8s-%s-master-1", c.Cluster.Name)
-		if m.Name != servername {
+		if !c.isFirstMaster(m) {
 			n = append(n, m.IP)
 		}
 	}
 
-	attachNodesToLoadbalancer(c.Cluster.LBNode, n, authOpts)
+	return c.attachToLB(n, authOpts)
 }
 
-func isActive(c *ApiCluster, server string) bool {
-	s, err := servers.Get(c.Cluster.OSClient, server).Extract()
-	fmt.Println("Checking server status for server ", s.Name)
+// isActive reports whether server finished building. A server that went
+// into ERROR is reported as an error.
+func isActive(c *ApiCluster, server string) (bool, error) {
+	s, err := c.cloud.GetServer(server)
 	if err != nil {
 		fmt.Println("Cant get server status from API")
+		return false, nil
 	}
+	fmt.Println("Checking server status for server ", s.Name)
 
-	if s.Status == "ACTIVE" {
-		return true
+	if s.Status == provider.ServerActive {
+		return true, nil
+	}
+	if s.Status == provider.ServerError {
+		return false, fmt.Errorf("server %s went into ERROR", s.Name)
 	}
 	fmt.Println(s.Name, " not active yet...")
-	return false
+	return false, nil
 }
 
-func (c *ApiCluster) SetNodeFacts() {
+// setAddresses sets the addresses of node from its server. A server without
+// a public address is reached on its private one, through a bastion.
+func setAddresses(node *models.Node, s *provider.Server) {
+	node.IP = s.AccessIPv4
+	node.InternalIP = s.PrivateIPv4
+	if node.IP == "" {
+		node.IP = s.PrivateIPv4
+	}
+}
+
+func (c *ApiCluster) SetNodeFacts() error {
 	for _, node := range c.Cluster.MasterNodes {
-		s, err := servers.Get(c.Cluster.OSClient, node.UUID).Extract()
+		s, err := c.cloud.GetServer(node.UUID)
 		if err != nil {
 			fmt.Println("Cant get server status from API")
 			continue
 		}
 		node.Name = s.Name
-		node.IP = s.AccessIPv4
-		node.InternalIP = ""
+		setAddresses(node, s)
 		node.Roles = []string{"master", "controlplane"}
 	}
 
 	for _, node := range c.Cluster.EtcdNodes {
-		s, err := servers.Get(c.Cluster.OSClient, node.UUID).Extract()
+		s, err := c.cloud.GetServer(node.UUID)
 		if err != nil {
 			fmt.Println("Cant get server status from API")
 			continue
 		}
 		node.Name = s.Name
-		node.IP = s.AccessIPv4
-		node.InternalIP = ""
+		setAddresses(node, s)
 		node.Roles = []string{"etcd", "controlplane"}
 	}
 
 	for _, node := range c.Cluster.WorkerNodes {
-		s, err := servers.Get(c.Cluster.OSClient, node.UUID).Extract()
+		s, err := c.cloud.GetServer(node.UUID)
 		if err != nil {
 			fmt.Println("Cant get server status from API")
 			continue
 		}
 		node.Name = s.Name
-		node.IP = s.AccessIPv4
-		node.InternalIP = ""
+		setAddresses(node, s)
 		node.Roles = []string{"worker"}
 	}
 
 	// save the cluster nodes in db
-	cluster, err := db.GetCluster(c.Cluster.ProjectId, c.Cluster.UUID)
-	if err != nil {
-		// this is bad
-		fmt.Println("*** Could not find active cluster in db. ***")
-		return
-	}
-
-	cluster.MasterNodes = c.Cluster.MasterNodes
-	cluster.WorkerNodes = c.Cluster.WorkerNodes
-	cluster.EtcdNodes = c.Cluster.EtcdNodes
-	cluster.LBNode = c.Cluster.LBNode
-
-	err = db.UpdateCluster(cluster)
-	if err != nil {
-		// this is bad
-		fmt.Println("*** Could not find active cluster in db. ***")
-		return
-	}
+	return c.saveNodes()
 }
 
-func (c *ApiCluster) TrackVMBuild(authOpts models.AuthOpts) {
+// vmBuildTimeout is how long TrackVMBuild waits for a VM to become ACTIVE.
+const vmBuildTimeout = 30 * time.Minute
+
+func (c *ApiCluster) TrackVMBuild(authOpts models.AuthOpts) error {
 	fmt.Println("Tracking vm builds ...")
-	nodes := append(c.Cluster.MasterNodes, c.Cluster.WorkerNodes...)
+	nodes := append([]*models.Node{}, c.Cluster.MasterNodes...)
+	nodes = append(nodes, c.Cluster.WorkerNodes...)
 	nodes = append(nodes, c.Cluster.EtcdNodes...)
-	msg := make(chan string)
+	msg := make(chan error)
 
 	for _, server := range nodes {
 		go func(server models.Node) {
+			startTime := time.Now()
 			for {
-				if isActive(c, server.UUID) {
-					time.Sleep(30 * time.Second)
+				active, err := isActive(c, server.UUID)
+				if err != nil {
+					msg <- err
+					return
+				}
+				if active {
+					time.Sleep(settleDelay)
 					break
 				}
-				time.Sleep(30 * time.Second)
+				if time.Since(startTime) > vmBuildTimeout {
+					msg <- fmt.Errorf("server %s not active after %v", server.Name, vmBuildTimeout)
+					return
+				}
+				time.Sleep(pollInterval)
 			}
-			msg <- server.UUID
+			fmt.Println("Active servers: ", server.UUID)
+			msg <- nil
 		}(*server)
 	}
 
-	for _, _ = range nodes {
-		fmt.Println("Active servers: ", <-msg)
+	var buildErr error
+	for range nodes {
+		if err := <-msg; err != nil && buildErr == nil {
+			buildErr = err
+		}
+	}
+	if buildErr != nil {
+		return buildErr
 	}
 
 	// At this point they are all active
-	c.SetNodeFacts()
+	if err := c.SetNodeFacts(); err != nil {
+		return err
+	}
+	return c.pinHostKeys()
 }
 
-// RunDeploy - starts a k8s deploy and return the config if succesful
-func (c *ApiCluster) RunDeploy(authOpts models.AuthOpts) (string, error) {
-	// wait 60 sec to let servers settle down
-	time.Sleep(60 * time.Second)
+// initFirstMaster runs kubeadm init on master m with the CA, bootstrap
+// token and certificate key the other nodes join with. If a previous attempt
+// already initialized m, fresh join credentials are minted instead.
+func (c *ApiCluster) initFirstMaster(m *models.Node, vip string) error {
+	if err := c.ensureKubeadmSecrets(m); err != nil {
+		return err
+	}
+	if c.fileExists("/etc/kubernetes/admin.conf", m) {
+		fmt.Println("Master 1 already initialized, creating new join credentials")
+		if err := c.newJoinToken(m); err != nil {
+			return err
+		}
+		return c.uploadCerts(m, vip)
+	}
 
-	// first deploy the fist master node
-	for _, m := range c.Cluster.MasterNodes {
-		fmt.Println("Master -> ", m)
-		servername := fmt.Sprintf("k8s-%s-master-1", c.Cluster.Name)
-		if m.Name == servername {
-			sshHost := m.IP + ":22"
+	config, err := c.initConfig(m, vip)
+	if err != nil {
+		return err
+	}
+	ca, err := openKeyPair(c.Cluster.CA)
+	if err != nil {
+		return err
+	}
+	files := map[string][]byte{
+		caCertPath:        ca.Cert,
+		caKeyPath:         ca.Key,
+		kubeadmConfigPath: config,
+	}
+	for path, content := range files {
+		if err := c.writeFile(path, content, m); err != nil {
+			return err
+		}
+	}
 
-			cmd := fmt.Sprintf("sudo /usr/bin/kubeadm init --control-plane-endpoint '%s:6443' --upload-certs", c.Cluster.LBNode.VirtualIps[0].Address)
-			fmt.Println("Running cluster init on master 1")
+	fmt.Println("Running cluster init on master 1")
+	_, err = c.runCommand("kubeadm init --config "+kubeadmConfigPath+" --upload-certs", m)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
 
-			out, err := runCommand(cmd, sshHost, m.Password)
-			if err != nil {
-				fmt.Println(err)
-				return "", err
-			}
+// RunDeploy - starts a k8s deploy and return the config if succesful. Nodes
+// that already joined the cluster in a previous attempt are skipped.
+func (c *ApiCluster) RunDeploy(authOpts models.AuthOpts) (string, error) {
+	// wait to let servers settle down
+	time.Sleep(deployDelay)
 
-			reToken := regexp.MustCompile(`--token \w+.\w+`)
-			reHash := regexp.MustCompile(`--discovery-token-ca-cert-hash \w+:\w+`)
-			reCert := regexp.MustCompile(`--certificate-key \w+`)
+	m := c.firstMaster()
+	if m == nil {
+		return "", errors.New("first master not found")
+	}
+	if c.Cluster.LoadBalancer == nil || c.Cluster.LoadBalancer.VIP == "" {
+		return "", errors.New("LB has no virtual ip")
+	}
+	vip := c.Cluster.LoadBalancer.VIP
 
-			kubeadmToken := reToken.Find([]byte(out))
-			kubeadmHash := reHash.Find([]byte(out))
-			kubeadmCert := reCert.Find([]byte(out))
+	// first deploy the fist master node
+	if err := c.initFirstMaster(m, vip); err != nil {
+		return "", err
+	}
 
-			//fmt.Println(string(out))
+	if err := c.setStatus(models.StatusJoining, "Joining masters and workers"); err != nil {
+		return "", err
+	}
 
-			// restart kubelet after 2 mins
-			go c.restartKubelet()
+	// restart kubelet after 2 mins, with connections of its own as it
+	// outlives this step
+	go (&ApiCluster{Cluster: c.Cluster, ctx: c.ctx}).restartKubelet()
 
-			for _, m := range c.Cluster.MasterNodes {
-				servername := fmt.Sprintf("k8s-%s-master-1", c.Cluster.Name)
-				if m.Name != servername {
-					sshHost := m.IP + ":22"
+	if err := c.joinMasters(vip); err != nil {
+		return "", err
+	}
 
-					// join control plane node
-					cmd := fmt.Sprintf("kubeadm join %s:6443 %s %s --control-plane %s", c.Cluster.LBNode.VirtualIps[0].Address, kubeadmToken, kubeadmHash, kubeadmCert)
-					fmt.Println("join command => ", cmd)
-					fmt.Println("Running join command on ", " ip ", m.IP, " password ", m.Password)
+	if err := c.deployCNI(m); err != nil {
+		fmt.Println(err)
+		return "", err
+	}
 
-					out, err := runCommand(cmd, sshHost, m.Password)
-					if err != nil {
-						fmt.Println(err)
-						return "", err
-					}
-					fmt.Println(out)
-				}
-			}
+	if err := c.joinWorkers(vip); err != nil {
+		return "", err
+	}
 
-			// install calico
-			calicoCmd := "curl https://docs.projectcalico.org/manifests/calico.yaml -o calico.yaml && /usr/bin/kubectl --kubeconfig=/etc/kubernetes/admin.conf apply -f calico.yaml"
-			out, err = runCommand(calicoCmd, sshHost, m.Password)
-			if err != nil {
-				fmt.Println(err)
-				return "", err
-			}
+	for _, node := range c.Cluster.EtcdNodes {
+		fmt.Println("Etcd -> ", node.Name, node.IP)
+	}
 
-			for _, m := range c.Cluster.WorkerNodes {
-				// join control plane node
-				cmd := fmt.Sprintf("kubeadm join %s:6443 %s %s", c.Cluster.LBNode.VirtualIps[0].Address, kubeadmToken, kubeadmHash)
-				fmt.Println("join command => ", cmd)
-				sshHost := m.IP + ":22"
-				out, err := runCommand(cmd, sshHost, m.Password)
-				if err != nil {
-					fmt.Println(err)
-					return "", err
-				}
-				fmt.Println(out)
-			}
+	for _, node := range c.Cluster.WorkerNodes {
+		fmt.Println("Worker -> ", node.Name, node.IP)
+	}
 
+	return c.fetchKubeconfig(m, vip)
+}
+
+// joinMasters joins every master but the first one that is not part of the
+// control plane yet, with the join credentials of the cluster.
+func (c *ApiCluster) joinMasters(vip string) error {
+	for _, m := range c.Cluster.MasterNodes {
+		if c.isFirstMaster(m) {
+			continue
+		}
+		if err := c.joinNode(m, vip, true); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	for _, node := range c.Cluster.EtcdNodes {
-		fmt.Println("Etcd -> ", node)
+// joinWorkers joins every worker that is not part of the cluster yet, with
+// the join credentials of the cluster.
+func (c *ApiCluster) joinWorkers(vip string) error {
+	for _, m := range c.Cluster.WorkerNodes {
+		if err := c.joinNode(m, vip, false); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	for _, node := range c.Cluster.WorkerNodes {
-		fmt.Println("Worker -> ", node)
+// joinNode runs kubeadm join on node n, unless it already joined.
+func (c *ApiCluster) joinNode(n *models.Node, vip string, controlPlane bool) error {
+	if c.fileExists("/etc/kubernetes/kubelet.conf", n) {
+		return nil
 	}
 
-	return "", nil
+	config, err := c.joinConfig(n, vip, controlPlane)
+	if err != nil {
+		return err
+	}
+	if err := c.writeFile(kubeadmConfigPath, config, n); err != nil {
+		return err
+	}
+
+	fmt.Println("Running join command on ", n.Name, " ip ", n.IP)
+	out, err := c.runCommand("kubeadm join --config "+kubeadmConfigPath, n)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	fmt.Println(out)
+	return nil
 }
 
 // this is a hack, when cluster init is done for some reason, on 2nd or 3rd node
 // kubelet does not start etcd container, as a result cluster join waits for it,
 // a simple kubelet restart does the trick.
 func (c *ApiCluster) restartKubelet() {
+	defer c.closeExecutor()
 	for _, m := range c.Cluster.MasterNodes {
 		time.Sleep(time.Minute * 2)
-		servername := fmt.Sprintf("k8s-%s-master-1", c.Cluster.Name)
-		if m.Name != servername {
-			sshHost := m.IP + ":22"
+		if !c.isFirstMaster(m) {
 			// stop kubelet
 			kubeletcmd := "service kubelet restart"
-			_, err := runCommand(kubeletcmd, sshHost, m.Password)
+			_, err := c.runCommand(kubeletcmd, m)
 			if err != nil {
 				fmt.Println(err)
 			}
 		}
 	}
 }
-
-func runCommand(cmd, host, pass string) (string, error) {
-	client, session, err := connectToHost("root", pass, host)
-	if err != nil {
-		fmt.Println(err)
-		return "", err
-	}
-
-	out, err := session.CombinedOutput(cmd)
-	if err != nil {
-		fmt.Println(err)
-		return "", err
-	}
-
-	client.Close()
-	return string(out), nil
-}
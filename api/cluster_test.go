@@ -0,0 +1,44 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCreateClusterName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr string
+	}{
+		{name: "Prod", wantErr: "Invalid name: lowercase letters"},
+		{name: "prod;reboot", wantErr: "Invalid name: lowercase letters"},
+		{name: "prod cluster", wantErr: "Invalid name: lowercase letters"},
+		{name: "-prod", wantErr: "Invalid name: lowercase letters"},
+		{name: "prod-", wantErr: "Invalid name: lowercase letters"},
+		{name: "prod.example", wantErr: "Invalid name: lowercase letters"},
+		{name: strings.Repeat("a", maxClusterNameLength+1), wantErr: "Invalid name: at most"},
+	}
+	router, s, _ := testServer(t)
+	for _, tt := range tests {
+		w := do(router, "POST", "/api/clusters", map[string]interface{}{"name": tt.name})
+		if w.Code != http.StatusBadRequest || !strings.HasPrefix(w.Body.String(), tt.wantErr) {
+			t.Errorf("%q: got %d %s, want 400 %s", tt.name, w.Code, w.Body.String(), tt.wantErr)
+		}
+	}
+	clusters, err := s.GetAllClusters(testProject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 0 {
+		t.Errorf("created %d clusters with invalid names", len(clusters))
+	}
+}
+
+func TestCheckClusterName(t *testing.T) {
+	for _, name := range []string{defaultClusterName, "prod", "prod-2", "0", strings.Repeat("a", maxClusterNameLength)} {
+		if problem := checkClusterName(name); problem != "" {
+			t.Errorf("%q: %s", name, problem)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sulochan/kaas/models"
+)
+
+// cniManifestPath is where the CNI manifest is written on the first master.
+const cniManifestPath = "/etc/kubernetes/cni.yaml"
+
+// cniPlugin is how a CNI manifest is found upstream and turned into a
+// template.
+type cniPlugin struct {
+	defaultVersion string
+	// url is the upstream manifest, with %s for the version.
+	url string
+	// podCIDR matches the pod network setting of the upstream manifest,
+	// podCIDRTemplate replaces it.
+	podCIDR         *regexp.Regexp
+	podCIDRTemplate string
+}
+
+var cniPlugins = map[string]cniPlugin{
+	models.CNICalico: {
+		defaultVersion:  "v3.24.5",
+		url:             "https://raw.githubusercontent.com/projectcalico/calico/%s/manifests/calico.yaml",
+		podCIDR:         regexp.MustCompile(`(?m)^( *)# - name: CALICO_IPV4POOL_CIDR\n *#   value: "[^"]*"`),
+		podCIDRTemplate: "${1}- name: CALICO_IPV4POOL_CIDR\n${1}  value: \"{{ .PodSubnet }}\"",
+	},
+	models.CNIFlannel: {
+		defaultVersion:  "v0.20.2",
+		url:             "https://raw.githubusercontent.com/flannel-io/flannel/%s/Documentation/kube-flannel.yml",
+		podCIDR:         regexp.MustCompile(`"Network": "[^"]*"`),
+		podCIDRTemplate: `"Network": "{{ .PodSubnet }}"`,
+	},
+	models.CNICilium: {
+		defaultVersion:  "v1.10.3",
+		url:             "https://raw.githubusercontent.com/cilium/cilium/%s/install/kubernetes/quick-install.yaml",
+		podCIDR:         regexp.MustCompile(`cluster-pool-ipv4-cidr: "[^"]*"`),
+		podCIDRTemplate: `cluster-pool-ipv4-cidr: "{{ .PodSubnet }}"`,
+	},
+}
+
+var reCNIVersion = regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+$`)
+
+// cniClient downloads the upstream manifests.
+var cniClient = &http.Client{Timeout: time.Minute}
+
+// cniSpec returns the CNI of cluster, with the default version of its
+// plugin if it has none.
+func cniSpec(cluster *models.Cluster) models.CNISpec {
+	spec := cluster.CNI
+	if spec.Plugin == "" {
+		spec.Plugin = models.CNICalico
+	}
+	if spec.Version == "" {
+		spec.Version = cniPlugins[spec.Plugin].defaultVersion
+	}
+	return spec
+}
+
+// checkCNI returns what is wrong with spec, nothing if it can be deployed.
+func checkCNI(spec models.CNISpec) string {
+	if spec.Plugin == models.CNINone {
+		if spec.Version != "" {
+			return "cni none has no version"
+		}
+		return ""
+	}
+	if _, ok := cniPlugins[spec.Plugin]; !ok {
+		return fmt.Sprintf("unknown cni plugin %q, use one of %s", spec.Plugin, strings.Join(models.CNIPlugins, ", "))
+	}
+	if !reCNIVersion.MatchString(spec.Version) {
+		return fmt.Sprintf("cni version %q must look like v1.2.3", spec.Version)
+	}
+	if _, err := os.Stat(cniTemplatePath(spec)); err != nil && cniSHA256(spec) == "" && !cniDefault(spec) {
+		return fmt.Sprintf("cni %s %s has no template in the manifest dir and no configured sha256", spec.Plugin, spec.Version)
+	}
+	return ""
+}
+
+// cniDefault reports whether spec is the default version of its plugin.
+func cniDefault(spec models.CNISpec) bool {
+	return spec.Version == cniPlugins[spec.Plugin].defaultVersion
+}
+
+// cniTemplatePath is where the manifest template of spec is cached.
+func cniTemplatePath(spec models.CNISpec) string {
+	return filepath.Join(conf.CNI.ManifestDir, spec.Plugin, spec.Version+".yaml")
+}
+
+// cniSHA256 returns the configured checksum of the upstream manifest of
+// spec, empty if it has none.
+func cniSHA256(spec models.CNISpec) string {
+	return conf.CNI.SHA256[spec.Plugin][spec.Version]
+}
+
+// cniTemplate returns the manifest template of spec from the manifest dir,
+// downloading it from upstream into the dir first if it is not there.
+// Concurrent downloads of the same version each write a temp file and the
+// last rename wins, they are identical.
+func cniTemplate(spec models.CNISpec) (*template.Template, error) {
+	path := cniTemplatePath(spec)
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		content, err = downloadCNI(spec)
+		if err != nil {
+			return nil, err
+		}
+		if err := cacheCNI(path, content); err != nil {
+			return nil, err
+		}
+		log.Info("Cached ", spec.Plugin, " ", spec.Version, " manifest in ", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return template.New(filepath.Base(path)).Option("missingkey=error").Parse(string(content))
+}
+
+// cacheCNI writes content to path aside and renames it, a half written
+// template is never read.
+func cacheCNI(path string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// downloadCNI returns the upstream manifest of spec made into a template:
+// its own braces escaped and its pod network setting replaced. The manifest
+// must match the configured checksum. Only the default version of a plugin
+// may be downloaded without one; the first download is then trusted, and
+// cached for every later cluster.
+func downloadCNI(spec models.CNISpec) ([]byte, error) {
+	plugin := cniPlugins[spec.Plugin]
+	url := fmt.Sprintf(plugin.url, spec.Version)
+	sum := cniSHA256(spec)
+	if sum == "" && !cniDefault(spec) {
+		return nil, fmt.Errorf("no sha256 configured for cni %s %s", spec.Plugin, spec.Version)
+	}
+
+	resp, err := cniClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	manifest, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	got := sha256.Sum256(manifest)
+	if sum == "" {
+		log.Warn("Trusting the first download of cni ", spec.Plugin, " ", spec.Version, ", pin it with sha256 ", hex.EncodeToString(got[:]))
+	} else if hex.EncodeToString(got[:]) != sum {
+		return nil, fmt.Errorf("%s: sha256 %x does not match the configured %s", url, got, sum)
+	}
+
+	manifest = bytes.Replace(manifest, []byte("{{"), []byte(`{{"{{"}}`), -1)
+	if !plugin.podCIDR.Match(manifest) {
+		return nil, errors.New("no pod network setting in " + url + ", put a template in the manifest dir")
+	}
+	return plugin.podCIDR.ReplaceAll(manifest, []byte(plugin.podCIDRTemplate)), nil
+}
+
+// cniManifest returns the CNI manifest of the cluster, nil if it has none.
+func (c *ApiCluster) cniManifest() ([]byte, error) {
+	spec := cniSpec(&c.Cluster)
+	if spec.Plugin == models.CNINone {
+		return nil, nil
+	}
+	tmpl, err := cniTemplate(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	kubeadm := c.Cluster.Kubeadm.WithDefaults()
+	out := bytes.Buffer{}
+	err = tmpl.Execute(&out, map[string]string{
+		"PodSubnet":     kubeadm.PodSubnet,
+		"ServiceSubnet": kubeadm.ServiceSubnet,
+		"Version":       spec.Version,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// deployCNI applies the CNI manifest of the cluster from master m.
+func (c *ApiCluster) deployCNI(m *models.Node) error {
+	manifest, err := c.cniManifest()
+	if err != nil || manifest == nil {
+		return err
+	}
+	if err := c.writeFile(cniManifestPath, manifest, m); err != nil {
+		return err
+	}
+	_, err = c.kubectlOn(m, "apply", "-f", cniManifestPath)
+	return err
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sulochan/kaas/config"
+	"github.com/sulochan/kaas/models"
+)
+
+func TestCheckCNI(t *testing.T) {
+	cfg := config.Default()
+	cfg.CNI.ManifestDir = t.TempDir()
+	cfg.CNI.SHA256 = map[string]map[string]string{
+		models.CNICalico: {"v3.24.5": strings.Repeat("a", 64)},
+	}
+	SetConfig(cfg)
+	if err := os.MkdirAll(filepath.Join(cfg.CNI.ManifestDir, models.CNIFlannel), 0755); err != nil {
+		t.Fatal(err)
+	}
+	template := filepath.Join(cfg.CNI.ManifestDir, models.CNIFlannel, "v0.20.2.yaml")
+	if err := ioutil.WriteFile(template, []byte("kind: List\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		spec        models.CNISpec
+		wantProblem bool
+	}{
+		{name: "none", spec: models.CNISpec{Plugin: models.CNINone}},
+		{name: "none with a version", spec: models.CNISpec{Plugin: models.CNINone, Version: "v1.0.0"}, wantProblem: true},
+		{name: "configured checksum", spec: models.CNISpec{Plugin: models.CNICalico, Version: "v3.24.5"}},
+		{name: "template in the manifest dir", spec: models.CNISpec{Plugin: models.CNIFlannel, Version: "v0.20.2"}},
+		{name: "default version", spec: models.CNISpec{Plugin: models.CNICilium, Version: "v1.10.3"}},
+		{name: "neither", spec: models.CNISpec{Plugin: models.CNICalico, Version: "v3.25.0"}, wantProblem: true},
+		{name: "checksum of another plugin", spec: models.CNISpec{Plugin: models.CNICilium, Version: "v3.24.5"}, wantProblem: true},
+		{name: "unknown plugin", spec: models.CNISpec{Plugin: "weave", Version: "v2.8.1"}, wantProblem: true},
+		{name: "bad version", spec: models.CNISpec{Plugin: models.CNICalico, Version: "3.24"}, wantProblem: true},
+		{name: "path in version", spec: models.CNISpec{Plugin: models.CNIFlannel, Version: "../flannel/v0.20.2"}, wantProblem: true},
+	}
+	for _, tt := range tests {
+		problem := checkCNI(tt.spec)
+		if (problem != "") != tt.wantProblem {
+			t.Errorf("%s: got problem %q, want problem %v", tt.name, problem, tt.wantProblem)
+		}
+	}
+}
+
+func TestCNITemplate(t *testing.T) {
+	manifest := "kind: ConfigMap\ndata:\n  note: \"{{ not a template }}\"\n  net-conf.json: |\n    {\"Network\": \"10.244.0.0/16\"}\n"
+	sum := sha256.Sum256([]byte(manifest))
+	pinned := hex.EncodeToString(sum[:])
+	downloads := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		w.Write([]byte(manifest))
+	}))
+	defer upstream.Close()
+	plugin := cniPlugins[models.CNIFlannel]
+	defer func() { cniPlugins[models.CNIFlannel] = plugin }()
+	served := plugin
+	served.url = upstream.URL + "/%s/kube-flannel.yml"
+	cniPlugins[models.CNIFlannel] = served
+
+	tests := []struct {
+		name          string
+		version       string
+		sha256        string
+		wantErr       string
+		wantDownloads int
+	}{
+		{name: "pinned", version: "v0.21.0", sha256: pinned, wantDownloads: 1},
+		{name: "pin mismatch", version: "v0.21.0", sha256: strings.Repeat("0", 64), wantErr: "does not match the configured", wantDownloads: 1},
+		{name: "default version unpinned", version: plugin.defaultVersion, wantDownloads: 1},
+		{name: "other version unpinned", version: "v0.21.0", wantErr: "no sha256 configured", wantDownloads: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.CNI.ManifestDir = t.TempDir()
+			if tt.sha256 != "" {
+				cfg.CNI.SHA256 = map[string]map[string]string{models.CNIFlannel: {tt.version: tt.sha256}}
+			}
+			SetConfig(cfg)
+			downloads = 0
+			c := &ApiCluster{Cluster: models.Cluster{CNI: models.CNISpec{Plugin: models.CNIFlannel, Version: tt.version}}}
+
+			// the second time the cached template is used
+			for i := 0; i < 2; i++ {
+				out, err := c.cniManifest()
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Fatalf("got error %v, want %s", err, tt.wantErr)
+					}
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := strings.Replace(manifest, "10.244.0.0/16", models.KubeadmSpec{}.WithDefaults().PodSubnet, 1)
+				if string(out) != want {
+					t.Errorf("got manifest\n%s\nwant\n%s", out, want)
+				}
+			}
+			if downloads != tt.wantDownloads {
+				t.Errorf("downloaded %d times, want %d", downloads, tt.wantDownloads)
+			}
+		})
+	}
+}
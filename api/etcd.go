@@ -0,0 +1,279 @@
+package api
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/executor"
+	"github.com/sulochan/kaas/models"
+	"github.com/sulochan/kaas/pki"
+)
+
+// Files of the external etcd members.
+const (
+	etcdPKIDir   = "/etc/etcd/pki"
+	etcdDataDir  = "/var/lib/etcd"
+	etcdUnitPath = "/etc/systemd/system/etcd.service"
+)
+
+// Files the api servers talk to an external etcd with, where kubeadm
+// expects them.
+const (
+	etcdClientCA   = "/etc/kubernetes/pki/etcd/ca.crt"
+	etcdClientCert = "/etc/kubernetes/pki/apiserver-etcd-client.crt"
+	etcdClientKey  = "/etc/kubernetes/pki/apiserver-etcd-client.key"
+)
+
+// etcdCertValidity is how long the member and client certificates are valid.
+const etcdCertValidity = 5 * 365 * 24 * time.Hour
+
+// validEtcdCount reports whether n is an etcd cluster size that keeps a
+// quorum when a member fails.
+func validEtcdCount(n int) bool {
+	return n == 1 || n == 3 || n == 5 || n == 7
+}
+
+// etcdEndpoints returns the client urls of the external etcd members.
+func (c *ApiCluster) etcdEndpoints() []string {
+	endpoints := []string{}
+	for _, n := range c.Cluster.EtcdNodes {
+		endpoints = append(endpoints, "https://"+n.IP+":2379")
+	}
+	return endpoints
+}
+
+// ensureEtcdCA creates the etcd CA of the cluster, unless a previous attempt
+// already did.
+func (c *ApiCluster) ensureEtcdCA() error {
+	if c.Cluster.EtcdCA != nil {
+		return nil
+	}
+	ca, err := pki.NewCA("etcd-ca")
+	if err != nil {
+		return err
+	}
+	sealed, err := sealKeyPair(ca)
+	if err != nil {
+		return err
+	}
+	cluster, err := db.UpdateClusterWithRetry(store, c.Cluster.ProjectId, c.Cluster.UUID, func(cluster *models.Cluster) error {
+		if cluster.EtcdCA == nil {
+			cluster.EtcdCA = sealed
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.Cluster.EtcdCA = cluster.EtcdCA
+	return nil
+}
+
+// etcdUnit returns the systemd unit of member n of an etcd cluster whose
+// members are listed in initialCluster.
+func etcdUnit(n *models.Node, initialCluster string) string {
+	name := nodeName(n)
+	return fmt.Sprintf(`[Unit]
+Description=etcd
+After=network-online.target
+
+[Service]
+Type=notify
+ExecStart=/usr/local/bin/etcd --name %[1]s --data-dir %[3]s \
+  --listen-client-urls https://%[2]s:2379,https://127.0.0.1:2379 \
+  --advertise-client-urls https://%[2]s:2379 \
+  --listen-peer-urls https://%[2]s:2380 \
+  --initial-advertise-peer-urls https://%[2]s:2380 \
+  --initial-cluster %[4]s --initial-cluster-state new \
+  --client-cert-auth --trusted-ca-file %[5]s/ca.crt \
+  --cert-file %[5]s/server.crt --key-file %[5]s/server.key \
+  --peer-client-cert-auth --peer-trusted-ca-file %[5]s/ca.crt \
+  --peer-cert-file %[5]s/peer.crt --peer-key-file %[5]s/peer.key
+Restart=always
+RestartSec=5
+
+[Install]
+WantedBy=multi-user.target
+`, name, n.IP, etcdDataDir, initialCluster, etcdPKIDir)
+}
+
+// unameArches maps the machine names of uname -m to the archs of the etcd
+// releases.
+var unameArches = map[string]string{
+	"x86_64":  "amd64",
+	"aarch64": "arm64",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+}
+
+// etcdReleases is where the etcd release archives and their SHA256SUMS are
+// published, with %s for the version.
+const etcdReleases = "https://github.com/etcd-io/etcd/releases/download/%s/"
+
+// installEtcd installs the etcd release of the configuration on n, unless it
+// already has etcd. The release archive is checked against its configured
+// checksum, or against the SHA256SUMS published with the release when the
+// configuration has none for the arch of n, before anything is unpacked
+// from it.
+func (c *ApiCluster) installEtcd(n *models.Node) error {
+	if c.fileExists("/usr/local/bin/etcd", n) {
+		return nil
+	}
+
+	out, err := c.runCommand("uname -m", n)
+	if err != nil {
+		return err
+	}
+	arch, ok := unameArches[strings.TrimSpace(out)]
+	if !ok {
+		return fmt.Errorf("no etcd release for the %q machine of %s", strings.TrimSpace(out), n.Name)
+	}
+
+	release := fmt.Sprintf("etcd-%s-linux-%s", conf.Etcd.Version, arch)
+	url := fmt.Sprintf(etcdReleases, conf.Etcd.Version)
+	dir := "/tmp/" + release
+	check := fmt.Sprintf("curl -fsSL %sSHA256SUMS | grep ' %s.tar.gz$'", url, release)
+	if sum, ok := conf.Etcd.SHA256[arch]; ok {
+		check = fmt.Sprintf("echo '%s  %s.tar.gz'", sum, release)
+	}
+	install := fmt.Sprintf("mkdir -p %[1]s && cd %[1]s && curl -fsSL -o %[2]s.tar.gz %[3]s%[2]s.tar.gz"+
+		" && %[4]s | sha256sum -c -"+
+		" && tar xzf %[2]s.tar.gz -C /usr/local/bin --strip-components=1 %[2]s/etcd %[2]s/etcdctl",
+		dir, release, url, check)
+	_, err = c.runCommand(install, n)
+	c.runCommand("rm -rf "+dir, n)
+	return err
+}
+
+// deployEtcdMember installs etcd on n with certificates for it signed by ca,
+// and starts it without waiting for the other members.
+func (c *ApiCluster) deployEtcdMember(n *models.Node, ca *models.KeyPair, initialCluster string) error {
+	if _, err := c.runCommand("systemctl is-active --quiet etcd", n); err == nil {
+		return nil
+	}
+
+	ip := net.ParseIP(n.IP)
+	if ip == nil {
+		return fmt.Errorf("etcd node %s has no ip", n.Name)
+	}
+	files := map[string][]byte{etcdPKIDir + "/ca.crt": ca.Cert}
+	for _, kind := range []string{"server", "peer"} {
+		cert, err := pki.Sign(ca, pki.CertOpts{
+			CommonName: nodeName(n),
+			IPs:        []net.IP{ip, net.ParseIP("127.0.0.1")},
+			DNSNames:   []string{nodeName(n), "localhost"},
+			Usages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			Validity:   etcdCertValidity,
+		})
+		if err != nil {
+			return err
+		}
+		files[etcdPKIDir+"/"+kind+".crt"] = cert.Cert
+		files[etcdPKIDir+"/"+kind+".key"] = cert.Key
+	}
+	files[etcdUnitPath] = []byte(etcdUnit(n, initialCluster))
+
+	for path, content := range files {
+		if err := c.writeFile(path, content, n); err != nil {
+			return err
+		}
+	}
+
+	if err := c.installEtcd(n); err != nil {
+		return err
+	}
+
+	// a new member blocks its start until a quorum is up
+	_, err := c.runCommand("mkdir -p "+etcdDataDir+" && systemctl daemon-reload && systemctl enable etcd && systemctl start --no-block etcd", n)
+	return err
+}
+
+// etcdHealthTimeout is how long DeployEtcd waits for the members of a new
+// etcd cluster to find each other.
+var etcdHealthTimeout = 10 * time.Minute
+
+// waitEtcdHealthy waits for every member of the etcd cluster to be healthy,
+// asking etcdctl on member n.
+func (c *ApiCluster) waitEtcdHealthy(n *models.Node) error {
+	health := executor.Command{
+		Cmd: fmt.Sprintf("ETCDCTL_API=3 /usr/local/bin/etcdctl --endpoints %s --cacert %[2]s/ca.crt --cert %[2]s/server.crt --key %[2]s/server.key endpoint health",
+			strings.Join(c.etcdEndpoints(), ","), etcdPKIDir),
+		Timeout: probeTimeout,
+	}
+	startTime := time.Now()
+	for {
+		_, err := c.run(n, health)
+		if err == nil {
+			return nil
+		}
+		if time.Since(startTime) > etcdHealthTimeout {
+			return fmt.Errorf("etcd cluster not healthy after %v: %v", etcdHealthTimeout, err)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// DeployEtcd bootstraps the external etcd cluster of the cluster with its
+// own CA, and gives every master the client certificate of the api server.
+// Clusters with stacked etcd have nothing to do.
+func (c *ApiCluster) DeployEtcd(authOpts models.AuthOpts) error {
+	if !c.Cluster.ExternalEtcd {
+		return nil
+	}
+	if len(c.Cluster.EtcdNodes) == 0 {
+		return errors.New("external etcd cluster has no etcd nodes")
+	}
+	if err := c.ensureEtcdCA(); err != nil {
+		return err
+	}
+	ca, err := openKeyPair(c.Cluster.EtcdCA)
+	if err != nil {
+		return err
+	}
+
+	members := []string{}
+	for _, n := range c.Cluster.EtcdNodes {
+		members = append(members, nodeName(n)+"=https://"+n.IP+":2380")
+	}
+	initialCluster := strings.Join(members, ",")
+
+	for _, n := range c.Cluster.EtcdNodes {
+		log.Info("Deploying etcd on ", n.Name, " of cluster ", c.Cluster.UUID)
+		if err := c.deployEtcdMember(n, ca, initialCluster); err != nil {
+			return err
+		}
+	}
+
+	if err := c.waitEtcdHealthy(c.Cluster.EtcdNodes[0]); err != nil {
+		return err
+	}
+
+	client, err := pki.Sign(ca, pki.CertOpts{
+		CommonName:   "kube-apiserver-etcd-client",
+		Organization: []string{"system:masters"},
+		Usages:       []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		Validity:     etcdCertValidity,
+	})
+	if err != nil {
+		return err
+	}
+	for _, m := range c.Cluster.MasterNodes {
+		files := map[string][]byte{
+			etcdClientCA:   ca.Cert,
+			etcdClientCert: client.Cert,
+			etcdClientKey:  client.Key,
+		}
+		for path, content := range files {
+			if err := c.writeFile(path, content, m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
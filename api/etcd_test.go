@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sulochan/kaas/config"
+	"github.com/sulochan/kaas/executor"
+	fakeexec "github.com/sulochan/kaas/executor/fake"
+	"github.com/sulochan/kaas/models"
+)
+
+func TestInstallEtcd(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+	tests := []struct {
+		name      string
+		machine   string
+		installed bool
+		pinned    map[string]string
+		// wantCheck is what the archive is checked against, empty when
+		// nothing is installed
+		wantCheck string
+		wantErr   string
+	}{
+		{name: "pinned checksum", machine: "x86_64", pinned: map[string]string{"amd64": sum},
+			wantCheck: "echo '" + sum + "  etcd-v3.4.16-linux-amd64.tar.gz' | sha256sum -c -"},
+		{name: "published checksums", machine: "aarch64", pinned: map[string]string{"amd64": sum},
+			wantCheck: "curl -fsSL https://github.com/etcd-io/etcd/releases/download/v3.4.16/SHA256SUMS | grep ' etcd-v3.4.16-linux-arm64.tar.gz$' | sha256sum -c -"},
+		{name: "already installed", machine: "x86_64", installed: true},
+		{name: "unknown machine", machine: "mips", wantErr: `no etcd release for the "mips" machine`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Etcd.SHA256 = tt.pinned
+			SetConfig(cfg)
+			nodes := fakeexec.New(nil)
+			nodes.Handle("uname -m", func(n *models.Node, cmd string) (string, int, error) {
+				return tt.machine + "\n", 0, nil
+			})
+			n := &models.Node{UUID: "etcd-1", Name: "k8s-test-etcd-1"}
+			if tt.installed {
+				nodes.Upload(context.Background(), n, "/usr/local/bin/etcd", []byte("etcd"), executor.FileOpts{})
+			}
+			c := &ApiCluster{exec: nodes}
+
+			err := c.installEtcd(n)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			installs := 0
+			for _, cmd := range commands(nodes.Runs()) {
+				if !strings.Contains(cmd, "tar xzf") {
+					continue
+				}
+				installs++
+				if !strings.Contains(cmd, " && "+tt.wantCheck+" && ") {
+					t.Errorf("install %s does not check %s", cmd, tt.wantCheck)
+				}
+			}
+			want := 1
+			if tt.wantCheck == "" {
+				want = 0
+			}
+			if installs != want {
+				t.Errorf("installed %d times, want %d", installs, want)
+			}
+		})
+	}
+}
+
+func TestWaitEtcdHealthy(t *testing.T) {
+	SetDelays(0, time.Millisecond, 0, 0)
+	timeout := etcdHealthTimeout
+	defer func() { etcdHealthTimeout = timeout }()
+	etcdHealthTimeout = 50 * time.Millisecond
+
+	tests := []struct {
+		name     string
+		failures int
+		wantErr  bool
+	}{
+		{name: "healthy", failures: 0},
+		{name: "members finding each other", failures: 3},
+		{name: "never healthy", failures: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		nodes := fakeexec.New(nil)
+		checks := 0
+		nodes.Handle("endpoint health", func(n *models.Node, cmd string) (string, int, error) {
+			checks++
+			if tt.failures < 0 || checks <= tt.failures {
+				return "unhealthy", 1, nil
+			}
+			return "healthy", 0, nil
+		})
+		n := &models.Node{Name: "k8s-test-etcd-1", IP: "10.0.0.4"}
+		c := &ApiCluster{Cluster: models.Cluster{EtcdNodes: []*models.Node{n}}, exec: nodes}
+
+		err := c.waitEtcdHealthy(n)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+		if !tt.wantErr && checks != tt.failures+1 {
+			t.Errorf("%s: checked %d times, want %d", tt.name, checks, tt.failures+1)
+		}
+	}
+}
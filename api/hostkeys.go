@@ -0,0 +1,122 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/models"
+)
+
+// Markers around the ssh host keys cloud-init prints on the console.
+const (
+	hostKeysBegin = "-----BEGIN SSH HOST KEY KEYS-----"
+	hostKeysEnd   = "-----END SSH HOST KEY KEYS-----"
+)
+
+// hostKeyTimeout is how long pinHostKeys waits for a node to print its host
+// keys once it is ACTIVE.
+const hostKeyTimeout = 15 * time.Minute
+
+// parseHostKeys returns the SHA256 fingerprints of the host keys in the last
+// block cloud-init printed on console, none if it did not print one yet.
+func parseHostKeys(console string) ([]string, error) {
+	begin := strings.LastIndex(console, hostKeysBegin)
+	if begin < 0 {
+		return nil, nil
+	}
+	block := console[begin+len(hostKeysBegin):]
+	end := strings.Index(block, hostKeysEnd)
+	if end < 0 {
+		return nil, nil
+	}
+
+	fingerprints := []string{}
+	for _, line := range strings.Split(block[:end], "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("invalid host key %q on console: %v", line, err)
+		}
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(key))
+	}
+	return fingerprints, nil
+}
+
+// pinHostKeys reads the host keys of every node that has none from its
+// console, waiting for cloud-init to print them, and saves them.
+func (c *ApiCluster) pinHostKeys() error {
+	for _, n := range clusterNodes(&c.Cluster) {
+		if len(n.HostKeys) > 0 {
+			continue
+		}
+		startTime := time.Now()
+		for {
+			console, err := c.cloud.ConsoleOutput(n.UUID)
+			if err != nil {
+				return err
+			}
+			keys, err := parseHostKeys(console)
+			if err != nil {
+				return fmt.Errorf("%s: %v", n.Name, err)
+			}
+			if len(keys) > 0 {
+				log.Info("Pinned host keys of ", n.Name, ": ", strings.Join(keys, ", "))
+				n.HostKeys = keys
+				break
+			}
+			if time.Since(startTime) > hostKeyTimeout {
+				return fmt.Errorf("%s did not print its host keys on console after %v", n.Name, hostKeyTimeout)
+			}
+			time.Sleep(pollInterval)
+		}
+	}
+	return c.saveNodes()
+}
+
+// checkHostKey returns the host key callback of the connections to node n.
+// The key must be one of the pinned keys of n. Only a node created before
+// clusters had a key, and keys were pinned, trusts the key it presents
+// first, which is then saved: one of a cluster without a key, or one still
+// logged into with its root password while the key is authorized on it.
+func (c *ApiCluster) checkHostKey(n *models.Node) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		if len(n.HostKeys) == 0 {
+			if c.Cluster.SSHPublicKey != "" && n.Password == "" {
+				return fmt.Errorf("no pinned host key for %s at %s, refusing to connect", n.Name, hostname)
+			}
+			log.Warn("No pinned host key for ", n.Name, ", trusting ", fingerprint)
+			n.HostKeys = []string{fingerprint}
+			return c.saveHostKeys(n)
+		}
+		for _, pinned := range n.HostKeys {
+			if pinned == fingerprint {
+				return nil
+			}
+		}
+		return fmt.Errorf("host key mismatch for %s at %s: got %s, pinned %s, refusing to connect",
+			n.Name, hostname, fingerprint, strings.Join(n.HostKeys, ", "))
+	}
+}
+
+// saveHostKeys saves the host keys of node n.
+func (c *ApiCluster) saveHostKeys(n *models.Node) error {
+	_, err := db.UpdateClusterWithRetry(store, c.Cluster.ProjectId, c.Cluster.UUID, func(cluster *models.Cluster) error {
+		for _, node := range clusterNodes(cluster) {
+			if node.UUID == n.UUID {
+				node.HostKeys = n.HostKeys
+			}
+		}
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/sulochan/kaas/db/memory"
+	"github.com/sulochan/kaas/models"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestCheckHostKey(t *testing.T) {
+	key := newHostKey(t)
+	other := newHostKey(t)
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	tests := []struct {
+		name string
+		// clusterKey is the ssh public key of the cluster, empty for a
+		// cluster created before clusters had one
+		clusterKey string
+		node       models.Node
+		wantErr    string
+		wantPinned []string
+	}{
+		{
+			name:       "pinned key",
+			clusterKey: "ssh-ed25519 AAAA",
+			node:       models.Node{HostKeys: []string{ssh.FingerprintSHA256(other), fingerprint}},
+			wantPinned: []string{ssh.FingerprintSHA256(other), fingerprint},
+		},
+		{
+			name:       "key mismatch",
+			clusterKey: "ssh-ed25519 AAAA",
+			node:       models.Node{HostKeys: []string{ssh.FingerprintSHA256(other)}},
+			wantErr:    "host key mismatch for node-1 at 10.0.0.4:22: got " + fingerprint + ", pinned " + ssh.FingerprintSHA256(other),
+			wantPinned: []string{ssh.FingerprintSHA256(other)},
+		},
+		{
+			name:       "legacy cluster without a key",
+			node:       models.Node{},
+			wantPinned: []string{fingerprint},
+		},
+		{
+			name:       "password node",
+			clusterKey: "ssh-ed25519 AAAA",
+			node:       models.Node{Password: "secret"},
+			wantPinned: []string{fingerprint},
+		},
+		{
+			name:       "unpinned node of a cluster with a key",
+			clusterKey: "ssh-ed25519 AAAA",
+			node:       models.Node{},
+			wantErr:    "no pinned host key for node-1 at 10.0.0.4:22, refusing to connect",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := memory.New()
+			SetStore(s)
+			n := tt.node
+			n.UUID, n.Name = "server-1", "node-1"
+			c := &ApiCluster{Cluster: models.Cluster{ProjectId: "p", UUID: "c1", SSHPublicKey: tt.clusterKey,
+				MasterNodes: []*models.Node{&n}}}
+			if err := s.CreateNewCluster(&c.Cluster); err != nil {
+				t.Fatal(err)
+			}
+
+			err := c.checkHostKey(&n)("10.0.0.4:22", &net.TCPAddr{IP: net.ParseIP("10.0.0.4"), Port: 22}, key)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+
+			stored, err := s.GetCluster("p", "c1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := stored.MasterNodes[0].HostKeys; strings.Join(got, ",") != strings.Join(tt.wantPinned, ",") {
+				t.Errorf("stored host keys %v, want %v", got, tt.wantPinned)
+			}
+		})
+	}
+}
+
+func TestParseHostKeys(t *testing.T) {
+	key := newHostKey(t)
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	block := hostKeysBegin + "\n" + line + " root@node-1\n" + hostKeysEnd + "\n"
+
+	tests := []struct {
+		name    string
+		console string
+		want    []string
+		wantErr bool
+	}{
+		{name: "not printed yet", console: "Booting\n"},
+		{name: "printed", console: "Booting\n" + block + "login:", want: []string{ssh.FingerprintSHA256(key)}},
+		{name: "cut off", console: hostKeysBegin + "\n" + line},
+		{name: "last block wins", console: hostKeysBegin + "\nssh-ed25519 invalid\n" + hostKeysEnd + "\n" + block,
+			want: []string{ssh.FingerprintSHA256(key)}},
+		{name: "invalid key", console: hostKeysBegin + "\nssh-ed25519 invalid\n" + hostKeysEnd, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseHostKeys(tt.console)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
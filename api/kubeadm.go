@@ -0,0 +1,418 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/models"
+	"github.com/sulochan/kaas/pki"
+)
+
+// kubeadmConfigPath is where the kubeadm configuration of a node is written.
+const kubeadmConfigPath = "/etc/kubernetes/kubeadm-config.yaml"
+
+// kubeadmAPIVersion is the version of the kubeadm configuration types below.
+const kubeadmAPIVersion = "kubeadm.k8s.io/v1beta2"
+
+// bootstrapTokenTTL is how long a bootstrap token minted by kaas is valid,
+// every join round mints a new one.
+const bootstrapTokenTTL = "2h"
+
+// Files of the kubernetes CA on the masters.
+const (
+	caCertPath = "/etc/kubernetes/pki/ca.crt"
+	caKeyPath  = "/etc/kubernetes/pki/ca.key"
+)
+
+type bootstrapToken struct {
+	Token string `yaml:"token"`
+	TTL   string `yaml:"ttl"`
+}
+
+type nodeRegistration struct {
+	Name             string            `yaml:"name"`
+	KubeletExtraArgs map[string]string `yaml:"kubeletExtraArgs,omitempty"`
+}
+
+// initConfiguration is the kubeadm InitConfiguration, with the fields kaas
+// sets.
+type initConfiguration struct {
+	APIVersion       string           `yaml:"apiVersion"`
+	Kind             string           `yaml:"kind"`
+	BootstrapTokens  []bootstrapToken `yaml:"bootstrapTokens"`
+	NodeRegistration nodeRegistration `yaml:"nodeRegistration"`
+	CertificateKey   string           `yaml:"certificateKey"`
+}
+
+type externalEtcd struct {
+	Endpoints []string `yaml:"endpoints"`
+	CAFile    string   `yaml:"caFile"`
+	CertFile  string   `yaml:"certFile"`
+	KeyFile   string   `yaml:"keyFile"`
+}
+
+type etcdConfig struct {
+	External *externalEtcd `yaml:"external,omitempty"`
+}
+
+type networking struct {
+	PodSubnet     string `yaml:"podSubnet"`
+	ServiceSubnet string `yaml:"serviceSubnet"`
+}
+
+type apiServer struct {
+	CertSANs  []string          `yaml:"certSANs"`
+	ExtraArgs map[string]string `yaml:"extraArgs,omitempty"`
+}
+
+type controlPlaneComponent struct {
+	ExtraArgs map[string]string `yaml:"extraArgs,omitempty"`
+}
+
+// clusterConfiguration is the kubeadm ClusterConfiguration, with the fields
+// kaas sets.
+type clusterConfiguration struct {
+	APIVersion           string                `yaml:"apiVersion"`
+	Kind                 string                `yaml:"kind"`
+	KubernetesVersion    string                `yaml:"kubernetesVersion,omitempty"`
+	ControlPlaneEndpoint string                `yaml:"controlPlaneEndpoint"`
+	Networking           networking            `yaml:"networking"`
+	APIServer            apiServer             `yaml:"apiServer"`
+	ControllerManager    controlPlaneComponent `yaml:"controllerManager"`
+	Scheduler            controlPlaneComponent `yaml:"scheduler"`
+	Etcd                 etcdConfig            `yaml:"etcd"`
+}
+
+type bootstrapTokenDiscovery struct {
+	APIServerEndpoint string   `yaml:"apiServerEndpoint"`
+	Token             string   `yaml:"token"`
+	CACertHashes      []string `yaml:"caCertHashes"`
+}
+
+type discovery struct {
+	BootstrapToken bootstrapTokenDiscovery `yaml:"bootstrapToken"`
+}
+
+type joinControlPlane struct {
+	CertificateKey string `yaml:"certificateKey"`
+}
+
+// joinConfiguration is the kubeadm JoinConfiguration, with the fields kaas
+// sets. ControlPlane is only set on masters.
+type joinConfiguration struct {
+	APIVersion       string            `yaml:"apiVersion"`
+	Kind             string            `yaml:"kind"`
+	NodeRegistration nodeRegistration  `yaml:"nodeRegistration"`
+	Discovery        discovery         `yaml:"discovery"`
+	ControlPlane     *joinControlPlane `yaml:"controlPlane,omitempty"`
+}
+
+var (
+	reFeatureGate = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+	reKubeletArg  = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+)
+
+// checkKubeadm returns what is wrong with spec, nothing if it can be
+// rendered.
+func checkKubeadm(spec *models.KubeadmSpec) string {
+	_, pods, err := net.ParseCIDR(spec.PodSubnet)
+	if err != nil {
+		return fmt.Sprintf("invalid pod_subnet %q", spec.PodSubnet)
+	}
+	_, services, err := net.ParseCIDR(spec.ServiceSubnet)
+	if err != nil {
+		return fmt.Sprintf("invalid service_subnet %q", spec.ServiceSubnet)
+	}
+	if pods.Contains(services.IP) || services.Contains(pods.IP) {
+		return "pod_subnet and service_subnet overlap"
+	}
+	for _, san := range spec.CertSANs {
+		if san == "" || strings.ContainsAny(san, " \t\n,") {
+			return fmt.Sprintf("invalid cert_sans entry %q", san)
+		}
+	}
+	for name := range spec.FeatureGates {
+		if !reFeatureGate.MatchString(name) {
+			return fmt.Sprintf("invalid feature gate %q", name)
+		}
+	}
+	for name := range spec.KubeletExtraArgs {
+		if !reKubeletArg.MatchString(name) {
+			return fmt.Sprintf("invalid kubelet arg %q", name)
+		}
+		if name == "feature-gates" {
+			return "set feature gates through feature_gates"
+		}
+	}
+	return ""
+}
+
+// featureGates returns the feature-gates flag value of gates, in name order.
+func featureGates(gates map[string]bool) string {
+	names := []string{}
+	for name := range gates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	flags := []string{}
+	for _, name := range names {
+		flags = append(flags, name+"="+strconv.FormatBool(gates[name]))
+	}
+	return strings.Join(flags, ",")
+}
+
+// componentArgs returns the extra args of the control plane components.
+func componentArgs(spec models.KubeadmSpec) map[string]string {
+	if len(spec.FeatureGates) == 0 {
+		return nil
+	}
+	return map[string]string{"feature-gates": featureGates(spec.FeatureGates)}
+}
+
+// registration returns the node registration of node n.
+func (c *ApiCluster) registration(n *models.Node) nodeRegistration {
+	spec := c.Cluster.Kubeadm.WithDefaults()
+	args := map[string]string{}
+	for name, value := range spec.KubeletExtraArgs {
+		args[name] = value
+	}
+	if len(spec.FeatureGates) > 0 {
+		args["feature-gates"] = featureGates(spec.FeatureGates)
+	}
+	return nodeRegistration{Name: nodeName(n), KubeletExtraArgs: args}
+}
+
+// marshalDocuments returns docs as a single YAML stream.
+func marshalDocuments(docs ...interface{}) ([]byte, error) {
+	out := []byte{}
+	for i, doc := range docs {
+		if i > 0 {
+			out = append(out, "---\n"...)
+		}
+		b, err := yaml.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
+	}
+	return out, nil
+}
+
+// clusterConfig returns the ClusterConfiguration of the cluster, with the
+// control plane behind vip.
+func (c *ApiCluster) clusterConfig(vip string) clusterConfiguration {
+	spec := c.Cluster.Kubeadm.WithDefaults()
+	config := clusterConfiguration{
+		APIVersion:           kubeadmAPIVersion,
+		Kind:                 "ClusterConfiguration",
+		KubernetesVersion:    c.Cluster.KubernetesVersion,
+		ControlPlaneEndpoint: vip + ":6443",
+		Networking: networking{
+			PodSubnet:     spec.PodSubnet,
+			ServiceSubnet: spec.ServiceSubnet,
+		},
+		APIServer: apiServer{
+			CertSANs:  append([]string{vip}, spec.CertSANs...),
+			ExtraArgs: componentArgs(spec),
+		},
+		ControllerManager: controlPlaneComponent{ExtraArgs: componentArgs(spec)},
+		Scheduler:         controlPlaneComponent{ExtraArgs: componentArgs(spec)},
+	}
+	if c.Cluster.ExternalEtcd {
+		config.Etcd.External = &externalEtcd{
+			Endpoints: c.etcdEndpoints(),
+			CAFile:    etcdClientCA,
+			CertFile:  etcdClientCert,
+			KeyFile:   etcdClientKey,
+		}
+	}
+	return config
+}
+
+// initConfig returns the kubeadm init configuration of master m.
+func (c *ApiCluster) initConfig(m *models.Node, vip string) ([]byte, error) {
+	token, err := openSecret(c.Cluster.BootstrapToken)
+	if err != nil {
+		return nil, err
+	}
+	certificateKey, err := openSecret(c.Cluster.CertificateKey)
+	if err != nil {
+		return nil, err
+	}
+	return marshalDocuments(initConfiguration{
+		APIVersion:       kubeadmAPIVersion,
+		Kind:             "InitConfiguration",
+		BootstrapTokens:  []bootstrapToken{{Token: string(token), TTL: bootstrapTokenTTL}},
+		NodeRegistration: c.registration(m),
+		CertificateKey:   string(certificateKey),
+	}, c.clusterConfig(vip))
+}
+
+// joinConfig returns the kubeadm join configuration of node n, joining the
+// control plane if controlPlane is set.
+func (c *ApiCluster) joinConfig(n *models.Node, vip string, controlPlane bool) ([]byte, error) {
+	if c.Cluster.CA == nil {
+		return nil, errors.New("cluster has no CA")
+	}
+	hash, err := pki.PublicKeyHash(c.Cluster.CA.Cert)
+	if err != nil {
+		return nil, err
+	}
+	token, err := openSecret(c.Cluster.BootstrapToken)
+	if err != nil {
+		return nil, err
+	}
+
+	config := joinConfiguration{
+		APIVersion:       kubeadmAPIVersion,
+		Kind:             "JoinConfiguration",
+		NodeRegistration: c.registration(n),
+		Discovery: discovery{BootstrapToken: bootstrapTokenDiscovery{
+			APIServerEndpoint: vip + ":6443",
+			Token:             string(token),
+			CACertHashes:      []string{hash},
+		}},
+	}
+	if controlPlane {
+		certificateKey, err := openSecret(c.Cluster.CertificateKey)
+		if err != nil {
+			return nil, err
+		}
+		config.ControlPlane = &joinControlPlane{CertificateKey: string(certificateKey)}
+	}
+	return marshalDocuments(config)
+}
+
+// newBootstrapToken returns a random token in the [a-z0-9]{6}.[a-z0-9]{16}
+// format of kubeadm.
+func newBootstrapToken() (string, error) {
+	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
+	token := make([]byte, 22)
+	for i := range token {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			return "", err
+		}
+		token[i] = chars[n.Int64()]
+	}
+	return string(token[:6]) + "." + string(token[6:]), nil
+}
+
+// newCertificateKey returns a random key to encrypt the uploaded control
+// plane certificates with.
+func newCertificateKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// saveKubeadmSecrets saves the CA, bootstrap token and certificate key of
+// the cluster, as sealed.
+func (c *ApiCluster) saveKubeadmSecrets() error {
+	_, err := db.UpdateClusterWithRetry(store, c.Cluster.ProjectId, c.Cluster.UUID, func(cluster *models.Cluster) error {
+		cluster.CA = c.Cluster.CA
+		cluster.BootstrapToken = c.Cluster.BootstrapToken
+		cluster.CertificateKey = c.Cluster.CertificateKey
+		return nil
+	})
+	return err
+}
+
+// ensureKubeadmSecrets generates the CA, bootstrap token and certificate key
+// the cluster misses. The CA of a cluster master m already initialized
+// without one is read from m.
+func (c *ApiCluster) ensureKubeadmSecrets(m *models.Node) error {
+	if c.Cluster.CA != nil && c.Cluster.BootstrapToken != "" && c.Cluster.CertificateKey != "" {
+		return nil
+	}
+
+	if c.Cluster.CA == nil {
+		if c.fileExists("/etc/kubernetes/admin.conf", m) {
+			cert, err := c.readFile(caCertPath, m)
+			if err != nil {
+				return err
+			}
+			c.Cluster.CA = &models.SealedKeyPair{Cert: cert}
+		} else {
+			ca, err := pki.NewCA("kubernetes")
+			if err != nil {
+				return err
+			}
+			if c.Cluster.CA, err = sealKeyPair(ca); err != nil {
+				return err
+			}
+		}
+	}
+	if c.Cluster.BootstrapToken == "" {
+		token, err := newBootstrapToken()
+		if err != nil {
+			return err
+		}
+		if c.Cluster.BootstrapToken, err = sealSecret([]byte(token)); err != nil {
+			return err
+		}
+	}
+	if c.Cluster.CertificateKey == "" {
+		key, err := newCertificateKey()
+		if err != nil {
+			return err
+		}
+		if c.Cluster.CertificateKey, err = sealSecret([]byte(key)); err != nil {
+			return err
+		}
+	}
+	return c.saveKubeadmSecrets()
+}
+
+// newJoinToken creates a fresh bootstrap token on master m and saves it.
+func (c *ApiCluster) newJoinToken(m *models.Node) error {
+	if err := c.ensureKubeadmSecrets(m); err != nil {
+		return err
+	}
+	token, err := newBootstrapToken()
+	if err != nil {
+		return err
+	}
+	sealed, err := sealSecret([]byte(token))
+	if err != nil {
+		return err
+	}
+	cmd := fmt.Sprintf("kubeadm token create %s --ttl %s", token, bootstrapTokenTTL)
+	if _, err := c.runCommand(cmd, m); err != nil {
+		return err
+	}
+	c.Cluster.BootstrapToken = sealed
+	return c.saveKubeadmSecrets()
+}
+
+// uploadCerts uploads the control plane certificates from master m again,
+// encrypted with the certificate key of the cluster, for masters that join
+// after the upload of kubeadm init expired.
+func (c *ApiCluster) uploadCerts(m *models.Node, vip string) error {
+	if err := c.ensureKubeadmSecrets(m); err != nil {
+		return err
+	}
+	config, err := c.initConfig(m, vip)
+	if err != nil {
+		return err
+	}
+	if err := c.writeFile(kubeadmConfigPath, config, m); err != nil {
+		return err
+	}
+	_, err = c.runCommand("kubeadm init phase upload-certs --upload-certs --config "+kubeadmConfigPath, m)
+	return err
+}
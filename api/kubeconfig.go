@@ -0,0 +1,237 @@
+package api
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/models"
+	"github.com/sulochan/kaas/pki"
+)
+
+// maxUserCertValidity is the longest a kubeconfig minted for a user is
+// valid, and how long it is valid unless asked for less.
+const maxUserCertValidity = 24 * time.Hour
+
+type kubeconfigCluster struct {
+	Server                   string `yaml:"server"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data"`
+}
+
+type namedCluster struct {
+	Name    string            `yaml:"name"`
+	Cluster kubeconfigCluster `yaml:"cluster"`
+}
+
+type kubeconfigContext struct {
+	Cluster string `yaml:"cluster"`
+	User    string `yaml:"user"`
+}
+
+type namedContext struct {
+	Name    string            `yaml:"name"`
+	Context kubeconfigContext `yaml:"context"`
+}
+
+type kubeconfigUser struct {
+	ClientCertificateData string `yaml:"client-certificate-data"`
+	ClientKeyData         string `yaml:"client-key-data"`
+}
+
+type namedUser struct {
+	Name string         `yaml:"name"`
+	User kubeconfigUser `yaml:"user"`
+}
+
+// kubeconfig is a client certificate kubeconfig, like the admin.conf of
+// kubeadm.
+type kubeconfig struct {
+	APIVersion     string         `yaml:"apiVersion"`
+	Kind           string         `yaml:"kind"`
+	Clusters       []namedCluster `yaml:"clusters"`
+	Contexts       []namedContext `yaml:"contexts"`
+	CurrentContext string         `yaml:"current-context"`
+	Users          []namedUser    `yaml:"users"`
+}
+
+// fetchKubeconfig reads the admin kubeconfig from master m, points it at the
+// lb vip and stores it sealed. It returns the kubeconfig.
+func (c *ApiCluster) fetchKubeconfig(m *models.Node, vip string) (string, error) {
+	if box == nil {
+		return "", errors.New("no secret box to seal the kubeconfig with")
+	}
+	out, err := c.readFile("/etc/kubernetes/admin.conf", m)
+	if err != nil {
+		return "", err
+	}
+
+	config := kubeconfig{}
+	if err := yaml.Unmarshal(out, &config); err != nil {
+		return "", fmt.Errorf("admin.conf: %v", err)
+	}
+	url := "https://" + vip + ":6443"
+	for i := range config.Clusters {
+		config.Clusters[i].Cluster.Server = url
+	}
+	content, err := yaml.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := box.Seal(content)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.UpdateClusterWithRetry(store, c.Cluster.ProjectId, c.Cluster.UUID, func(cluster *models.Cluster) error {
+		cluster.Config = sealed
+		cluster.URL = url
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	c.Cluster.Config = sealed
+	c.Cluster.URL = url
+	return string(content), nil
+}
+
+// userKubeconfig returns a kubeconfig for user in groups, with a client
+// certificate valid for validity signed by the cluster CA.
+func userKubeconfig(cluster *models.Cluster, user string, groups []string, validity time.Duration) ([]byte, error) {
+	ca, err := openKeyPair(cluster.CA)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := pki.Sign(ca, pki.CertOpts{
+		CommonName:   user,
+		Organization: groups,
+		Usages:       []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		Validity:     validity,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	context := user + "@" + cluster.Name
+	return yaml.Marshal(kubeconfig{
+		APIVersion: "v1",
+		Kind:       "Config",
+		Clusters: []namedCluster{{Name: cluster.Name, Cluster: kubeconfigCluster{
+			Server:                   cluster.URL,
+			CertificateAuthorityData: base64.StdEncoding.EncodeToString(cluster.CA.Cert),
+		}}},
+		Contexts:       []namedContext{{Name: context, Context: kubeconfigContext{Cluster: cluster.Name, User: user}}},
+		CurrentContext: context,
+		Users: []namedUser{{Name: user, User: kubeconfigUser{
+			ClientCertificateData: base64.StdEncoding.EncodeToString(cert.Cert),
+			ClientKeyData:         base64.StdEncoding.EncodeToString(cert.Key),
+		}}},
+	})
+}
+
+// GetKubeconfig - get the admin kubeconfig of a cluster, or with ?user= a
+// short lived one for that user in the ?group= groups. ?ttl= shortens the
+// validity of the latter. The caller must authenticate to the cloud project
+// of the cluster.
+func GetKubeconfig(w http.ResponseWriter, r *http.Request) {
+	authOpts := context.Get(r, "authOpts").(models.AuthOpts)
+	projectid := context.Get(r, "projectid").(string)
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+
+	dbCluster, err := store.GetCluster(projectid, vars["cluster"])
+	if err == db.NotFound {
+		http.Error(w, "Cluster not found", 404)
+		return
+	}
+	if err != nil {
+		log.Error("Error getting cluster from db: ", err)
+		http.Error(w, "Error getting cluster from the db", 500)
+		return
+	}
+
+	// the kubeconfigs are cluster-admin or signed by the cluster CA, nothing
+	// is opened or signed for a caller the cloud does not know
+	if _, err := newProvider(authOpts, dbCluster); err != nil {
+		log.Error("Error authenticating kubeconfig request for cluster ", dbCluster.UUID, ": ", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if dbCluster.Config == "" {
+		if dbCluster.Status != models.StatusReady && dbCluster.Status != models.StatusDegraded {
+			http.Error(w, "Cluster is "+dbCluster.Status+", no kubeconfig yet", http.StatusConflict)
+			return
+		}
+		// clusters deployed before kubeconfigs were stored
+		c := &ApiCluster{Cluster: *dbCluster, ctx: r.Context()}
+		defer c.closeExecutor()
+		m := c.firstMaster()
+		if m == nil || c.Cluster.LoadBalancer == nil || c.Cluster.LoadBalancer.VIP == "" {
+			http.Error(w, "Cluster has no master or lb to get a kubeconfig from", http.StatusConflict)
+			return
+		}
+		if _, err := c.fetchKubeconfig(m, c.Cluster.LoadBalancer.VIP); err != nil {
+			log.Error("Error fetching kubeconfig of cluster ", dbCluster.UUID, ": ", err)
+			http.Error(w, "Error fetching kubeconfig from the cluster", 500)
+			return
+		}
+		dbCluster = &c.Cluster
+	}
+
+	user := query.Get("user")
+	if user == "" {
+		content, err := box.Open(dbCluster.Config)
+		if err != nil {
+			log.Error("Error opening kubeconfig of cluster ", dbCluster.UUID, ": ", err)
+			http.Error(w, "Error reading kubeconfig", 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(content)
+		return
+	}
+
+	groups := query["group"]
+	for _, g := range groups {
+		if g == "" || strings.HasPrefix(g, "system:") {
+			http.Error(w, "Invalid group "+g+", system: groups are reserved, use the admin kubeconfig for cluster-admin", 400)
+			return
+		}
+	}
+	if strings.HasPrefix(user, "system:") {
+		http.Error(w, "Invalid user, system: names are reserved", 400)
+		return
+	}
+	validity := maxUserCertValidity
+	if v := query.Get("ttl"); v != "" {
+		validity, err = time.ParseDuration(v)
+		if err != nil || validity <= 0 || validity > maxUserCertValidity {
+			http.Error(w, "ttl must be a duration of at most "+maxUserCertValidity.String(), 400)
+			return
+		}
+	}
+	if dbCluster.CA == nil || dbCluster.CA.Key == "" {
+		http.Error(w, "Cluster CA key is not known to kaas, only the admin kubeconfig is available", http.StatusConflict)
+		return
+	}
+
+	content, err := userKubeconfig(dbCluster, user, groups, validity)
+	if err != nil {
+		log.Error("Error creating kubeconfig for ", user, ": ", err)
+		http.Error(w, "Error creating kubeconfig", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(content)
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sulochan/kaas/models"
+)
+
+// waitOperation waits for the operation answered in w to finish and fails
+// the test unless it succeeded.
+func waitOperation(t *testing.T, router http.Handler, w *httptest.ResponseRecorder) *models.Operation {
+	t.Helper()
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got %d %s, want 202", w.Code, w.Body.String())
+	}
+	op := &models.Operation{}
+	if err := json.Unmarshal(w.Body.Bytes(), op); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for op.State != models.OperationSucceeded {
+		if op.State == models.OperationFailed {
+			t.Fatalf("%s operation failed: %s", op.Type, op.Error)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s operation still %s: %s", op.Type, op.State, op.Message)
+		}
+		time.Sleep(5 * time.Millisecond)
+		w := do(router, "GET", "/api/operations/"+op.ID, nil)
+		if err := json.Unmarshal(w.Body.Bytes(), op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return op
+}
+
+func getCluster(t *testing.T, router http.Handler, uuid string) clusterResponse {
+	t.Helper()
+	w := do(router, "GET", "/api/clusters/"+uuid, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("get cluster: %d %s", w.Code, w.Body.String())
+	}
+	c := clusterResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClusterLifecycle(t *testing.T) {
+	router, s, cloud := testServer(t)
+
+	op := waitOperation(t, router, do(router, "POST", "/api/clusters", map[string]interface{}{
+		"name":               "test",
+		"worker":             1,
+		"kubernetes_version": "v1.20.8",
+		"cni":                map[string]string{"plugin": models.CNINone},
+	}))
+	uuid := op.ClusterUUID
+	c := getCluster(t, router, uuid)
+	if c.Status != models.StatusReady || len(c.MasterNodes) != 3 || len(c.WorkerNodes) != 1 {
+		t.Fatalf("created cluster is %s with %d masters and %d workers", c.Status, len(c.MasterNodes), len(c.WorkerNodes))
+	}
+	for _, n := range append(c.MasterNodes, c.WorkerNodes...) {
+		if len(n.HostKeys) == 0 {
+			t.Errorf("node %s has no pinned host keys", n.Name)
+		}
+	}
+	stored, err := s.GetCluster(testProject, uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Provisioning.Credentials != "" {
+		t.Error("credentials kept after provisioning finished")
+	}
+
+	w := do(router, "GET", "/api/clusters/"+uuid+"/kubeconfig", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "server: "+stored.URL) {
+		t.Fatalf("admin kubeconfig: %d %s", w.Code, w.Body.String())
+	}
+	w = do(router, "GET", "/api/clusters/"+uuid+"/kubeconfig?user=alice&group=system:nodes", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("kubeconfig in a system: group: got %d, want 400", w.Code)
+	}
+	w = do(router, "GET", "/api/clusters/"+uuid+"/kubeconfig?user=alice&group=dev", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "alice@test") {
+		t.Fatalf("user kubeconfig: %d %s", w.Code, w.Body.String())
+	}
+
+	waitOperation(t, router, do(router, "POST", "/api/clusters/"+uuid, map[string]int{"worker": 3}))
+	if c := getCluster(t, router, uuid); c.Status != models.StatusReady || len(c.WorkerNodes) != 3 {
+		t.Fatalf("scaled up cluster is %s with %d workers", c.Status, len(c.WorkerNodes))
+	}
+	waitOperation(t, router, do(router, "POST", "/api/clusters/"+uuid, map[string]int{"worker": 2}))
+	if c := getCluster(t, router, uuid); c.Status != models.StatusReady || len(c.WorkerNodes) != 2 {
+		t.Fatalf("scaled down cluster is %s with %d workers", c.Status, len(c.WorkerNodes))
+	}
+
+	waitOperation(t, router, do(router, "POST", "/api/clusters/"+uuid+"/upgrade", map[string]string{"kubernetes_version": "v1.21.2"}))
+	if c := getCluster(t, router, uuid); c.Status != models.StatusReady || c.Version != "v1.21.2" {
+		t.Fatalf("upgraded cluster is %s at %s", c.Status, c.Version)
+	}
+
+	waitOperation(t, router, do(router, "DELETE", "/api/clusters/"+uuid, nil))
+	servers, err := cloud.ListServers("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 0 {
+		t.Errorf("%d servers left after delete", len(servers))
+	}
+}
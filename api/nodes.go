@@ -0,0 +1,427 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/models"
+)
+
+// Readiness of a node, the status of its kubernetes Ready condition.
+const (
+	nodeReady   = "True"
+	nodeUnknown = "Unknown"
+)
+
+type taint struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Effect string `json:"effect"`
+}
+
+// nodeStatusResponse - a node of a cluster with its live cloud and
+// kubernetes status.
+type nodeStatusResponse struct {
+	nodeResponse
+	// ServerStatus is the compute status of the VM, empty if it could not
+	// be read.
+	ServerStatus string `json:"server_status"`
+	// Ready is True, False or Unknown when kubernetes could not be asked or
+	// does not know the node.
+	Ready          string  `json:"ready"`
+	KubeletVersion string  `json:"kubelet_version"`
+	Taints         []taint `json:"taints"`
+}
+
+// k8sNode is the part of a kubernetes Node object kaas reports.
+type k8sNode struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		Taints []taint `json:"taints"`
+	} `json:"spec"`
+	Status struct {
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+		NodeInfo struct {
+			KubeletVersion string `json:"kubeletVersion"`
+		} `json:"nodeInfo"`
+	} `json:"status"`
+}
+
+// ready returns the status of the Ready condition of n, Unknown if it has
+// none.
+func (n k8sNode) ready() string {
+	for _, cond := range n.Status.Conditions {
+		if cond.Type == "Ready" {
+			return cond.Status
+		}
+	}
+	return nodeUnknown
+}
+
+// deployed reports whether cluster runs kubernetes, i.e. its build went
+// through and it is not being deleted.
+func deployed(cluster *models.Cluster) bool {
+	switch cluster.Status {
+	case models.StatusReady, models.StatusDegraded, models.StatusScaling, models.StatusRepairing, models.StatusUpgrading:
+		return true
+	}
+	return false
+}
+
+// k8sNodes returns the kubernetes nodes of the cluster by name.
+func (c *ApiCluster) k8sNodes() (map[string]k8sNode, error) {
+	out, err := c.kubectl("get", "nodes", "-o", "json")
+	if err != nil {
+		return nil, err
+	}
+
+	list := struct {
+		Items []k8sNode `json:"items"`
+	}{}
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		return nil, err
+	}
+
+	nodes := map[string]k8sNode{}
+	for _, n := range list.Items {
+		nodes[n.Metadata.Name] = n
+	}
+	return nodes, nil
+}
+
+// GetClusterNodes - get k8s cluster nodes, merged with the status of their
+// VM and of the kubernetes node. The role (master, worker or etcd) and ready
+// (true or false) query parameters filter the nodes.
+func GetClusterNodes(w http.ResponseWriter, r *http.Request) {
+	authOpts := context.Get(r, "authOpts").(models.AuthOpts)
+	projectid := context.Get(r, "projectid").(string)
+	vars := mux.Vars(r)
+	role := r.URL.Query().Get("role")
+	ready := r.URL.Query().Get("ready")
+
+	if role != "" && role != "master" && role != "worker" && role != "etcd" {
+		http.Error(w, "role must be master, worker or etcd", 400)
+		return
+	}
+	if ready != "" && ready != "true" && ready != "false" {
+		http.Error(w, "ready must be true or false", 400)
+		return
+	}
+
+	cluster, err := store.GetCluster(projectid, vars["cluster"])
+	if err == db.NotFound {
+		http.Error(w, "Cluster not found", 404)
+		return
+	}
+	if err != nil {
+		log.Error("Error getting cluster from db: ", err)
+		http.Error(w, "Error getting cluster from the db", 500)
+		return
+	}
+
+	cloud, err := newProvider(authOpts, cluster)
+	if err != nil {
+		http.Error(w, "Error creating client for openstack service", 500)
+		return
+	}
+	c := &ApiCluster{Cluster: *cluster, cloud: cloud, ctx: r.Context()}
+	defer c.closeExecutor()
+
+	// a cluster still being built has no kubernetes to ask, its nodes are
+	// reported Unknown. Its nodes are not even connected to before the build
+	// pinned their host keys.
+	k8s := map[string]k8sNode{}
+	if deployed(cluster) {
+		k8s, err = c.k8sNodes()
+		if err != nil {
+			log.Error("Error getting kubernetes nodes of cluster ", cluster.UUID, ": ", err)
+		}
+	}
+
+	byRole := map[string][]*models.Node{
+		"master": cluster.MasterNodes,
+		"worker": cluster.WorkerNodes,
+		"etcd":   cluster.EtcdNodes,
+	}
+	response := []nodeStatusResponse{}
+	for _, nodeRole := range []string{"master", "worker", "etcd"} {
+		if role != "" && role != nodeRole {
+			continue
+		}
+		for _, n := range byRole[nodeRole] {
+			resp := nodeStatusResponse{
+				nodeResponse: newNodeResponse(n),
+				Ready:        nodeUnknown,
+				Taints:       []taint{},
+			}
+
+			s, err := cloud.GetServer(n.UUID)
+			if err != nil {
+				fmt.Println("Cant get server status from API: ", err)
+			} else {
+				resp.ServerStatus = s.Status
+			}
+
+			if k, ok := k8s[nodeName(n)]; ok {
+				resp.Ready = k.ready()
+				resp.KubeletVersion = k.Status.NodeInfo.KubeletVersion
+				if k.Spec.Taints != nil {
+					resp.Taints = k.Spec.Taints
+				}
+			}
+
+			if ready == "true" && resp.Ready != nodeReady || ready == "false" && resp.Ready == nodeReady {
+				continue
+			}
+			response = append(response, resp)
+		}
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// findNode returns the node of cluster with the uuid or name id, and its
+// role, or nil if there is none.
+func findNode(cluster *models.Cluster, id string) (*models.Node, string) {
+	byRole := map[string][]*models.Node{
+		"master": cluster.MasterNodes,
+		"worker": cluster.WorkerNodes,
+		"etcd":   cluster.EtcdNodes,
+	}
+	for role, nodes := range byRole {
+		for _, n := range nodes {
+			if n.UUID == id || n.Name == id {
+				return n, role
+			}
+		}
+	}
+	return nil, ""
+}
+
+// DeleteClusterNode - remove a node from a cluster. With replace=true a new
+// node of the same role is created in its place, which repairs a broken
+// node. The removal runs as provisioning steps, see models.NewNodeRemoval.
+func DeleteClusterNode(w http.ResponseWriter, r *http.Request) {
+	authOpts := context.Get(r, "authOpts").(models.AuthOpts)
+	projectid := context.Get(r, "projectid").(string)
+	username := context.Get(r, "username").(string)
+	vars := mux.Vars(r)
+
+	replace := false
+	if v := r.URL.Query().Get("replace"); v != "" {
+		var err error
+		if replace, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "replace must be true or false", 400)
+			return
+		}
+	}
+
+	dbCluster, err := store.GetCluster(projectid, vars["cluster"])
+	if err == db.NotFound {
+		http.Error(w, "Cluster not found", 404)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error getting cluster from the db", 500)
+		return
+	}
+
+	if !ifMatch(r, dbCluster) {
+		http.Error(w, "Cluster was modified, If-Match does not match", http.StatusPreconditionFailed)
+		return
+	}
+	node, role := findNode(dbCluster, vars["node"])
+	if node == nil {
+		http.Error(w, "Node not found", 404)
+		return
+	}
+	if role == "etcd" {
+		http.Error(w, "Removing etcd nodes is not supported", 400)
+		return
+	}
+	if role == "master" && len(dbCluster.MasterNodes) <= 1 {
+		// a replacement would have no control plane to join
+		http.Error(w, "The last master cannot be removed", http.StatusConflict)
+		return
+	}
+	if dbCluster.Status != models.StatusReady && dbCluster.Status != models.StatusDegraded {
+		http.Error(w, "Cluster is "+dbCluster.Status+", nodes can only be removed from Ready or Degraded clusters", http.StatusConflict)
+		return
+	}
+
+	cloud, err := newProvider(authOpts, dbCluster)
+	if err != nil {
+		http.Error(w, "Error creating client for openstack service", 500)
+		return
+	}
+
+	credentials, err := sealCredentials(authOpts)
+	if err != nil {
+		log.Error("Error sealing credentials: ", err)
+		http.Error(w, "Error sealing credentials", 500)
+		return
+	}
+
+	op, err := newOperation(models.OperationUpdate, dbCluster, username)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error creating operation in the db", 500)
+		return
+	}
+	removal := models.NewNodeRemoval(credentials, node.UUID, replace)
+	removal.OperationId = op.ID
+	dbCluster, err = updateIfMatch(r, projectid, dbCluster.UUID, func(c *models.Cluster) error {
+		if c.Status != models.StatusReady && c.Status != models.StatusDegraded {
+			return errBusy
+		}
+		c.Provisioning = removal
+		c.Status = models.StatusRepairing
+		c.StatusReason = "Removing node " + node.Name
+		if replace {
+			c.StatusReason = "Replacing node " + node.Name
+			return nil
+		}
+		// the node is not coming back, so the next scaling or replacement
+		// does not recreate it
+		if role == "master" {
+			c.Master--
+		} else {
+			c.Worker--
+		}
+		return nil
+	})
+	if err != nil {
+		finishOperation(op.ProjectId, op.ID, err)
+		if err == errPrecondition {
+			http.Error(w, "Cluster was modified, If-Match does not match", http.StatusPreconditionFailed)
+			return
+		}
+		if err == errBusy {
+			http.Error(w, "Cluster is busy, nodes can only be removed from Ready or Degraded clusters", http.StatusConflict)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Error updating cluster in the db", 500)
+		return
+	}
+
+	c := &ApiCluster{Cluster: *dbCluster, cloud: cloud}
+	upgradeLegacyLB(&c.Cluster)
+	go c.goRunClusterSetup()
+
+	writeAccepted(w, op)
+}
+
+// removeEtcdMember removes the stacked etcd member of master node from the
+// etcd cluster, through the etcd pod of master via.
+func (c *ApiCluster) removeEtcdMember(via *models.Node, node *models.Node) error {
+	etcdctl := func(args ...string) (string, error) {
+		return c.kubectlOn(via, append([]string{"-n", "kube-system", "exec", "etcd-" + nodeName(via), "--",
+			"etcdctl", "--endpoints=https://127.0.0.1:2379", "--cacert=/etc/kubernetes/pki/etcd/ca.crt",
+			"--cert=/etc/kubernetes/pki/etcd/server.crt", "--key=/etc/kubernetes/pki/etcd/server.key"}, args...)...)
+	}
+	out, err := etcdctl("member", "list")
+	if err != nil {
+		return err
+	}
+
+	// lines are: id, status, name, peer urls, client urls, is learner
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, ", ")
+		if len(fields) < 3 || fields[2] != nodeName(node) {
+			continue
+		}
+		_, err := etcdctl("member", "remove", fields[0])
+		return err
+	}
+	return nil
+}
+
+// RemoveNode takes the node of the removal out of the cluster: it is
+// drained and deleted from kubernetes, a master also leaves etcd and the lb,
+// then its VM and its record are deleted.
+func (c *ApiCluster) RemoveNode(authOpts models.AuthOpts) error {
+	node, role := findNode(&c.Cluster, c.Cluster.Provisioning.Node)
+	if node == nil {
+		// removed by a previous attempt
+		return nil
+	}
+
+	var via *models.Node
+	for _, m := range c.Cluster.MasterNodes {
+		if m != node {
+			via = m
+			break
+		}
+	}
+
+	if via == nil {
+		return errors.New("no master left to remove " + node.Name + " through")
+	}
+
+	log.Info("Removing node ", node.Name, " of cluster ", c.Cluster.UUID)
+	if err := c.drainNode(via, node); err != nil {
+		return err
+	}
+
+	if role == "master" {
+		if !c.Cluster.ExternalEtcd {
+			if err := c.removeEtcdMember(via, node); err != nil {
+				return err
+			}
+		}
+		if c.Cluster.LoadBalancer != nil {
+			if err := c.cloud.DetachNodes(c.Cluster.LoadBalancer.ID, []string{node.IP}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return c.deleteNodeVM(node)
+}
+
+// JoinNodes joins the node created by a replacement, a master joins the
+// control plane and is attached to the lb.
+func (c *ApiCluster) JoinNodes(authOpts models.AuthOpts) error {
+	m := c.firstMaster()
+	if m == nil {
+		return errors.New("first master not found")
+	}
+	if c.Cluster.LoadBalancer == nil || c.Cluster.LoadBalancer.VIP == "" {
+		return errors.New("LB has no virtual ip")
+	}
+	vip := c.Cluster.LoadBalancer.VIP
+
+	if err := c.newJoinToken(m); err != nil {
+		return err
+	}
+	if err := c.uploadCerts(m, vip); err != nil {
+		return err
+	}
+	if err := c.joinMasters(vip); err != nil {
+		return err
+	}
+
+	ips := []string{}
+	for _, n := range c.Cluster.MasterNodes {
+		ips = append(ips, n.IP)
+	}
+	if err := c.attachToLB(ips, authOpts); err != nil {
+		return err
+	}
+	return c.joinWorkers(vip)
+}
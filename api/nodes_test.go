@@ -0,0 +1,29 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	fakeexec "github.com/sulochan/kaas/executor/fake"
+	"github.com/sulochan/kaas/models"
+)
+
+func TestRemoveEtcdMember(t *testing.T) {
+	nodes := fakeexec.New(nil)
+	nodes.Handle("'member' 'list'", func(n *models.Node, cmd string) (string, int, error) {
+		return "8e9e05c52164694d, started, k8s-test-master-1, https://10.0.0.4:2380, https://10.0.0.4:2379, false\n" +
+			"91bc3c398fb3c146, started, k8s-test-master-2, https://10.0.0.5:2380, https://10.0.0.5:2379, false\n", 0, nil
+	})
+	via := &models.Node{Name: "k8s-test-master-1"}
+	c := &ApiCluster{exec: nodes}
+
+	if err := c.removeEtcdMember(via, &models.Node{Name: "k8s-test-master-2"}); err != nil {
+		t.Fatal(err)
+	}
+	etcdctl := kubectlCmd + "'-n' 'kube-system' 'exec' 'etcd-k8s-test-master-1' '--' 'etcdctl' '--endpoints=https://127.0.0.1:2379'" +
+		" '--cacert=/etc/kubernetes/pki/etcd/ca.crt' '--cert=/etc/kubernetes/pki/etcd/server.crt' '--key=/etc/kubernetes/pki/etcd/server.key' "
+	want := []string{etcdctl + "'member' 'list'", etcdctl + "'member' 'remove' '91bc3c398fb3c146'"}
+	if got := commands(nodes.Runs()); !reflect.DeepEqual(got, want) {
+		t.Errorf("ran\n%q\nwant\n%q", got, want)
+	}
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/pborman/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/models"
+)
+
+// newOperation stores a new pending operation of opType on cluster.
+func newOperation(opType string, cluster *models.Cluster, username string) (*models.Operation, error) {
+	now := time.Now()
+	op := &models.Operation{
+		ID:          uuid.New(),
+		Type:        opType,
+		ClusterUUID: cluster.UUID,
+		State:       models.OperationPending,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		ProjectId:   cluster.ProjectId,
+		CreatedBy:   username,
+	}
+	err := store.CreateOperation(op)
+	return op, err
+}
+
+// updateOperation applies mutate to the stored operation id and saves it.
+// Operations have a single writer, the worker running them, so no
+// compare-and-swap is needed. Errors are only logged: losing track of
+// progress must not fail the operation itself.
+func updateOperation(projectid string, id string, mutate func(op *models.Operation)) {
+	if id == "" {
+		return
+	}
+	op, err := store.GetOperation(projectid, id)
+	if err != nil {
+		log.Error("Error getting operation ", id, ": ", err)
+		return
+	}
+	mutate(op)
+	op.UpdatedAt = time.Now()
+	if err := store.UpdateOperation(op); err != nil {
+		log.Error("Error saving operation ", id, ": ", err)
+	}
+}
+
+// setOperationProgress marks the operation id running at progress percent.
+func setOperationProgress(projectid string, id string, progress int, message string) {
+	updateOperation(projectid, id, func(op *models.Operation) {
+		op.State = models.OperationRunning
+		op.Progress = progress
+		op.Message = message
+	})
+}
+
+// finishOperation marks the operation id succeeded, or failed with err.
+func finishOperation(projectid string, id string, err error) {
+	updateOperation(projectid, id, func(op *models.Operation) {
+		op.FinishedAt = time.Now()
+		if err != nil {
+			op.State = models.OperationFailed
+			op.Error = err.Error()
+			return
+		}
+		op.State = models.OperationSucceeded
+		op.Progress = 100
+	})
+}
+
+// writeAccepted answers with 202 Accepted and op, which the caller polls.
+func writeAccepted(w http.ResponseWriter, op *models.Operation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/operations/"+op.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(op)
+}
+
+// GetOperation is the handler for GET /api/operations/{id}
+func GetOperation(w http.ResponseWriter, r *http.Request) {
+	projectid := context.Get(r, "projectid").(string)
+	vars := mux.Vars(r)
+
+	op, err := store.GetOperation(projectid, vars["id"])
+	if err == db.NotFound {
+		http.Error(w, "Operation not found", 404)
+		return
+	}
+	if err != nil {
+		log.Error("Error getting operation from db: ", err)
+		http.Error(w, "Error getting operation from the db", 500)
+		return
+	}
+	json.NewEncoder(w).Encode(op)
+}
+
+// GetClusterOperations is the handler for GET /api/clusters/{cluster}/operations
+func GetClusterOperations(w http.ResponseWriter, r *http.Request) {
+	projectid := context.Get(r, "projectid").(string)
+	vars := mux.Vars(r)
+
+	ops, err := store.GetClusterOperations(projectid, vars["cluster"])
+	if err != nil {
+		log.Error("Error getting operations from db: ", err)
+		http.Error(w, "Error getting operations from the db", 500)
+		return
+	}
+	json.NewEncoder(w).Encode(ops)
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/sulochan/kaas/models"
+)
+
+// TestSealFailureLeavesNoOperation checks that a request whose credentials
+// cannot be sealed does not leave a pending operation behind.
+func TestSealFailureLeavesNoOperation(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+	}{
+		{name: "scale", method: "POST", path: "/api/clusters/c1", body: map[string]int{"worker": 2}},
+		{name: "remove node", method: "DELETE", path: "/api/clusters/c1/nodes/worker-1"},
+		{name: "upgrade", method: "POST", path: "/api/clusters/c1/upgrade", body: map[string]string{"kubernetes_version": "v1.21.2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, s, _ := testServer(t)
+			SetSecretBox(nil)
+			cluster := &models.Cluster{ProjectId: testProject, UUID: "c1", Name: "test", Status: models.StatusReady,
+				KubernetesVersion: "v1.20.8", Worker: 1,
+				MasterNodes: []*models.Node{{UUID: "master-1", Name: "k8s-test-master-1"}},
+				WorkerNodes: []*models.Node{{UUID: "worker-1", Name: "k8s-test-worker-1"}}}
+			if err := s.CreateNewCluster(cluster); err != nil {
+				t.Fatal(err)
+			}
+
+			w := do(router, tt.method, tt.path, tt.body)
+			if w.Code != http.StatusInternalServerError {
+				t.Fatalf("got %d %s, want 500", w.Code, w.Body.String())
+			}
+			ops, err := s.GetClusterOperations(testProject, "c1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ops) != 0 {
+				t.Errorf("left %d operations, the first %s", len(ops), ops[0].State)
+			}
+		})
+	}
+}
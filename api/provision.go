@@ -0,0 +1,294 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/models"
+)
+
+// maxStepAttempts is how many times a failing provisioning step is tried
+// before the whole build is given up.
+const maxStepAttempts = 3
+
+// Pauses of the provisioning worker. They are variables so that runs against
+// the fake provider do not have to sit through them.
+var (
+	// stepRetryDelay is the pause between two attempts of a failing step.
+	stepRetryDelay = time.Minute
+	// pollInterval is the pause between two status checks of a building
+	// VM or lb.
+	pollInterval = 20 * time.Second
+	// settleDelay is how long a VM is left alone once it is ACTIVE.
+	settleDelay = 30 * time.Second
+	// deployDelay is how long RunDeploy waits before the first ssh.
+	deployDelay = 60 * time.Second
+)
+
+// SetDelays overrides the pauses of the provisioning worker, e.g. to run it
+// against the fake provider.
+func SetDelays(retry, poll, settle, deploy time.Duration) {
+	stepRetryDelay = retry
+	pollInterval = poll
+	settleDelay = settle
+	deployDelay = deploy
+}
+
+// provisionSteps maps every models.Step name to the code that runs it. Each
+// step must be safe to run again after a crash: it has to detect the work a
+// previous attempt already did (persisted nodes, LB, kubeadm state) and only
+// do what is missing.
+var provisionSteps = map[string]func(c *ApiCluster, authOpts models.AuthOpts) error{
+	models.StepCreateLB:          (*ApiCluster).CreateLB,
+	models.StepCreateVMs:         (*ApiCluster).CreateVMs,
+	models.StepTrackVMBuild:      (*ApiCluster).TrackVMBuild,
+	models.StepAttachFirstMaster: (*ApiCluster).AttachFirstMaster,
+	models.StepDeployEtcd:        (*ApiCluster).DeployEtcd,
+	models.StepRunDeploy: func(c *ApiCluster, authOpts models.AuthOpts) error {
+		_, err := c.RunDeploy(authOpts)
+		return err
+	},
+	models.StepAttachMastersToLB:  (*ApiCluster).AttachMastersToLB,
+	models.StepRemoveWorkers:      (*ApiCluster).RemoveWorkers,
+	models.StepJoinWorkers:        (*ApiCluster).JoinWorkers,
+	models.StepRemoveNode:         (*ApiCluster).RemoveNode,
+	models.StepJoinNodes:          (*ApiCluster).JoinNodes,
+	models.StepUpgradePreflight:   (*ApiCluster).UpgradePreflight,
+	models.StepUpgradeFirstMaster: (*ApiCluster).UpgradeFirstMaster,
+	models.StepUpgradeMasters:     (*ApiCluster).UpgradeMasters,
+	models.StepUpgradeWorkers:     (*ApiCluster).UpgradeWorkers,
+}
+
+// stepStatus is the cluster status while a step of a build runs. A cluster
+// is Scaling, Repairing or Upgrading during every step of a scaling, a node
+// removal or an upgrade.
+var stepStatus = map[string]string{
+	models.StepCreateLB:          models.StatusProvisioningInfra,
+	models.StepCreateVMs:         models.StatusProvisioningInfra,
+	models.StepTrackVMBuild:      models.StatusProvisioningInfra,
+	models.StepAttachFirstMaster: models.StatusProvisioningInfra,
+	models.StepDeployEtcd:        models.StatusBootstrapping,
+	models.StepRunDeploy:         models.StatusBootstrapping,
+	models.StepAttachMastersToLB: models.StatusJoining,
+}
+
+// runningStatus returns the cluster status while the step named name runs.
+func (c *ApiCluster) runningStatus(name string) string {
+	if c.Cluster.Provisioning.Type == models.OperationUpgrade {
+		return models.StatusUpgrading
+	}
+	if c.Cluster.Provisioning.Type == models.OperationUpdate {
+		if c.Cluster.Provisioning.Node != "" {
+			return models.StatusRepairing
+		}
+		return models.StatusScaling
+	}
+	return stepStatus[name]
+}
+
+// stepDone reports whether the step named name is done.
+func (c *ApiCluster) stepDone(name string) bool {
+	for _, step := range c.Cluster.Provisioning.Steps {
+		if step.Name == name {
+			return step.Status == models.StepDone
+		}
+	}
+	return false
+}
+
+// saveStep persists the state of step i of the in memory cluster, along with
+// whether provisioning is still active. The credentials of a provisioning
+// that is no longer active are dropped. It returns errDeleting once
+// DeleteCluster took over the cluster, which stops the worker.
+func (c *ApiCluster) saveStep(i int) error {
+	step := c.Cluster.Provisioning.Steps[i]
+	active := c.Cluster.Provisioning.Active
+	_, err := db.UpdateClusterWithRetry(store, c.Cluster.ProjectId, c.Cluster.UUID, func(cluster *models.Cluster) error {
+		if cluster.Status == models.StatusDeleting || cluster.Status == models.StatusDeleted {
+			return errDeleting
+		}
+		if i >= len(cluster.Provisioning.Steps) {
+			return errors.New("provisioning steps of stored cluster do not match")
+		}
+		cluster.Provisioning.Steps[i] = step
+		cluster.Provisioning.Active = active
+		if !active {
+			cluster.Provisioning.Credentials = ""
+		}
+		return nil
+	})
+	if err == nil && !active {
+		c.Cluster.Provisioning.Credentials = ""
+	}
+	return err
+}
+
+// failedStatus returns the cluster status once its provisioning was given
+// up. Once kubeadm deployed the control plane the cluster is usable, just not
+// as it was asked for.
+func (c *ApiCluster) failedStatus() string {
+	p := c.Cluster.Provisioning
+	if c.stepDone(models.StepRunDeploy) || p.Type == models.OperationUpdate || p.Type == models.OperationUpgrade {
+		return models.StatusDegraded
+	}
+	return models.StatusFailed
+}
+
+// abandon gives up a provisioning that cannot start at all: it is marked
+// inactive, its credentials are dropped and the cluster gets the failed
+// status with reason.
+func (c *ApiCluster) abandon(reason string) {
+	_, err := db.UpdateClusterWithRetry(store, c.Cluster.ProjectId, c.Cluster.UUID, func(cluster *models.Cluster) error {
+		if cluster.Status == models.StatusDeleting || cluster.Status == models.StatusDeleted {
+			return errDeleting
+		}
+		cluster.Provisioning.Active = false
+		cluster.Provisioning.Credentials = ""
+		return nil
+	})
+	if err != nil {
+		log.Error("Error abandoning provisioning of cluster ", c.Cluster.UUID, ": ", err)
+		return
+	}
+	c.Cluster.Provisioning.Active = false
+	c.Cluster.Provisioning.Credentials = ""
+	c.setStatus(c.failedStatus(), reason)
+}
+
+// goRunClusterSetup runs every provisioning step that is not done yet, in
+// order, persisting the progress of each one. It returns when all steps are
+// done, when a step failed maxStepAttempts times, or when the cluster can no
+// longer be saved (e.g. it was deleted meanwhile).
+func (c *ApiCluster) goRunClusterSetup() {
+	p := &c.Cluster.Provisioning
+	projectid := c.Cluster.ProjectId
+
+	stop := func(err error) {
+		log.Error("Stopping provisioning of cluster ", c.Cluster.UUID, ": ", err)
+		finishOperation(projectid, p.OperationId, err)
+	}
+	// the connections to the nodes are reused by every step of the run
+	defer c.closeExecutor()
+
+	authOpts, err := openCredentials(p.Credentials)
+	if err != nil {
+		c.abandon("Cannot open the provisioning credentials: " + err.Error())
+		stop(err)
+		return
+	}
+
+	if err := c.ensureSSHKey(); err != nil {
+		c.abandon("Cannot create the ssh key of the cluster: " + err.Error())
+		stop(err)
+		return
+	}
+
+	for i := range p.Steps {
+		step := &p.Steps[i]
+		if step.Status == models.StepDone {
+			continue
+		}
+		run, ok := provisionSteps[step.Name]
+		if !ok {
+			stop(fmt.Errorf("unknown provisioning step %s", step.Name))
+			return
+		}
+
+		if err := c.setStatus(c.runningStatus(step.Name), "Running step "+step.Name); err != nil {
+			stop(err)
+			return
+		}
+		setOperationProgress(projectid, p.OperationId, 100*i/len(p.Steps), "Running step "+step.Name)
+
+		for {
+			step.Status = models.StepRunning
+			step.Attempts++
+			step.Error = ""
+			step.StartedAt = time.Now()
+			if err := c.saveStep(i); err != nil {
+				stop(err)
+				return
+			}
+
+			log.Info("Running step ", step.Name, " of cluster ", c.Cluster.UUID, ", attempt ", step.Attempts)
+			err := run(c, authOpts)
+			step.FinishedAt = time.Now()
+			if err == nil {
+				step.Status = models.StepDone
+				break
+			}
+
+			log.Error("Step ", step.Name, " of cluster ", c.Cluster.UUID, " failed: ", err)
+			step.Status = models.StepFailed
+			step.Error = err.Error()
+			// an upgrade halts on the first failure, leaving the node as it
+			// failed for the user to look at
+			if step.Attempts >= maxStepAttempts || p.Type == models.OperationUpgrade {
+				p.Active = false
+				if err := c.saveStep(i); err == errDeleting {
+					stop(err)
+					return
+				}
+				c.setStatus(c.failedStatus(), fmt.Sprintf("Step %s failed after %d attempts: %s", step.Name, step.Attempts, err))
+				finishOperation(projectid, p.OperationId, fmt.Errorf("step %s failed: %s", step.Name, err))
+				return
+			}
+			if err := c.saveStep(i); err != nil {
+				stop(err)
+				return
+			}
+			if err := c.setStatus(c.Cluster.Status, fmt.Sprintf("Step %s failed, retrying: %s", step.Name, err)); err != nil {
+				stop(err)
+				return
+			}
+			time.Sleep(stepRetryDelay)
+		}
+
+		if i == len(p.Steps)-1 {
+			if err := c.setStatus(models.StatusReady, "All provisioning steps done"); err != nil {
+				stop(err)
+				return
+			}
+			p.Active = false
+		}
+		if err := c.saveStep(i); err != nil {
+			stop(err)
+			return
+		}
+	}
+
+	finishOperation(projectid, p.OperationId, nil)
+}
+
+// ResumeProvisioning restarts the provisioning worker of every cluster whose
+// build was interrupted, e.g. by a restart of kaas. It must be called once at
+// startup, after SetStore.
+func ResumeProvisioning() error {
+	clusters, err := store.GetProvisioningClusters()
+	if err != nil {
+		return err
+	}
+
+	for i := range clusters {
+		c := &ApiCluster{Cluster: clusters[i]}
+		upgradeLegacyLB(&c.Cluster)
+		authOpts, err := openCredentials(c.Cluster.Provisioning.Credentials)
+		if err != nil {
+			log.Error("Cannot resume provisioning of cluster ", c.Cluster.UUID, ": ", err)
+			continue
+		}
+		cloud, err := newProvider(authOpts, &c.Cluster)
+		if err != nil {
+			log.Error("Cannot resume provisioning of cluster ", c.Cluster.UUID, ": ", err)
+			continue
+		}
+		c.cloud = cloud
+
+		log.Info("Resuming provisioning of cluster ", c.Cluster.UUID)
+		go c.goRunClusterSetup()
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/sulochan/kaas/cloudinit"
+	"github.com/sulochan/kaas/config"
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/db/memory"
+	"github.com/sulochan/kaas/executor"
+	fakeexec "github.com/sulochan/kaas/executor/fake"
+	"github.com/sulochan/kaas/models"
+	"github.com/sulochan/kaas/provider"
+	"github.com/sulochan/kaas/provider/fake"
+	"github.com/sulochan/kaas/secret"
+)
+
+const testProject = "project-1"
+
+// testServer wires the api to a memory store, a fake cloud and fake nodes
+// playing a kubeadm cluster, and returns its router.
+func testServer(t *testing.T) (*mux.Router, *memory.Store, *fake.Provider) {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Provider = "fake"
+	cfg.CNI.ManifestDir = t.TempDir()
+	SetConfig(cfg)
+	SetDelays(0, time.Millisecond, 0, 0)
+
+	b, err := secret.NewBox(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetSecretBox(b)
+	templates, err := cloudinit.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetCloudInit(templates)
+
+	s := memory.New()
+	SetStore(s)
+	cloud := fake.New()
+	SetProvider(func(models.AuthOpts, *models.Cluster) (provider.Provider, error) {
+		return cloud, nil
+	})
+	nodes := fakeexec.New(nil)
+	nodes.Kubernetes(cloud)
+	SetExecutor(func(executor.Dialer, executor.Sink) executor.Executor {
+		return nodes
+	})
+
+	router := mux.NewRouter()
+	handle := func(path string, f http.HandlerFunc, method string) {
+		router.Handle(path, SetContext(f)).Methods(method)
+	}
+	handle("/api/clusters", CreateCluster, "POST")
+	handle("/api/clusters/{cluster}", GetCluster, "GET")
+	handle("/api/clusters/{cluster}", UpdateCluster, "POST")
+	handle("/api/clusters/{cluster}", DeleteCluster, "DELETE")
+	handle("/api/clusters/{cluster}/upgrade", UpgradeCluster, "POST")
+	handle("/api/clusters/{cluster}/kubeconfig", GetKubeconfig, "GET")
+	handle("/api/clusters/{cluster}/nodes/{node}", DeleteClusterNode, "DELETE")
+	handle("/api/operations/{id}", GetOperation, "GET")
+	return router, s, cloud
+}
+
+// do sends a request with body as json to router and returns the recorded
+// response.
+func do(router http.Handler, method, path string, body interface{}) *httptest.ResponseRecorder {
+	content, _ := json.Marshal(body)
+	r := httptest.NewRequest(method, path, bytes.NewReader(content))
+	r.Header.Set("X-Auth-Type", "Token")
+	r.Header.Set("X-Auth-Token", "token")
+	r.Header.Set("X-Auth-Username", "user")
+	r.Header.Set("X-Auth-ProjectId", testProject)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+// stubSteps makes the steps in results run instead of the real ones, the
+// attempt-th run of step name returning results[name][attempt-1], nil past
+// the end. It returns the number of runs of each step.
+func stubSteps(t *testing.T, results map[string][]error) map[string]int {
+	t.Helper()
+	runs := map[string]int{}
+	for name, errs := range results {
+		name, errs := name, errs
+		real := provisionSteps[name]
+		t.Cleanup(func() { provisionSteps[name] = real })
+		provisionSteps[name] = func(c *ApiCluster, authOpts models.AuthOpts) error {
+			runs[name]++
+			if runs[name] <= len(errs) {
+				return errs[runs[name]-1]
+			}
+			return nil
+		}
+	}
+	return runs
+}
+
+func TestGoRunClusterSetup(t *testing.T) {
+	errStep := errors.New("step failed")
+	always := []error{errStep, errStep, errStep}
+	steps := []string{models.StepCreateLB, models.StepRunDeploy, models.StepAttachMastersToLB}
+
+	tests := []struct {
+		name string
+		// upgrade runs the steps as an upgrade, a create otherwise
+		upgrade bool
+		// done are the steps a previous attempt already did
+		done       []string
+		results    map[string][]error
+		wantStatus string
+		wantSteps  []string
+		wantRuns   map[string]int
+		wantOp     string
+	}{
+		{
+			name:       "all steps succeed",
+			wantStatus: models.StatusReady,
+			wantSteps:  []string{models.StepDone, models.StepDone, models.StepDone},
+			wantRuns:   map[string]int{models.StepCreateLB: 1, models.StepRunDeploy: 1, models.StepAttachMastersToLB: 1},
+			wantOp:     models.OperationSucceeded,
+		},
+		{
+			name:       "failed attempts are retried",
+			results:    map[string][]error{models.StepRunDeploy: {errStep, errStep}},
+			wantStatus: models.StatusReady,
+			wantSteps:  []string{models.StepDone, models.StepDone, models.StepDone},
+			wantRuns:   map[string]int{models.StepCreateLB: 1, models.StepRunDeploy: 3, models.StepAttachMastersToLB: 1},
+			wantOp:     models.OperationSucceeded,
+		},
+		{
+			name:       "done steps are skipped",
+			done:       []string{models.StepCreateLB},
+			wantStatus: models.StatusReady,
+			wantSteps:  []string{models.StepDone, models.StepDone, models.StepDone},
+			wantRuns:   map[string]int{models.StepRunDeploy: 1, models.StepAttachMastersToLB: 1},
+			wantOp:     models.OperationSucceeded,
+		},
+		{
+			name:       "failure before the deploy",
+			results:    map[string][]error{models.StepCreateLB: always},
+			wantStatus: models.StatusFailed,
+			wantSteps:  []string{models.StepFailed, models.StepPending, models.StepPending},
+			wantRuns:   map[string]int{models.StepCreateLB: maxStepAttempts},
+			wantOp:     models.OperationFailed,
+		},
+		{
+			name:       "failure after the deploy",
+			results:    map[string][]error{models.StepAttachMastersToLB: always},
+			wantStatus: models.StatusDegraded,
+			wantSteps:  []string{models.StepDone, models.StepDone, models.StepFailed},
+			wantRuns:   map[string]int{models.StepCreateLB: 1, models.StepRunDeploy: 1, models.StepAttachMastersToLB: maxStepAttempts},
+			wantOp:     models.OperationFailed,
+		},
+		{
+			name:       "upgrades halt on the first failure",
+			upgrade:    true,
+			results:    map[string][]error{models.StepRunDeploy: {errStep}},
+			wantStatus: models.StatusDegraded,
+			wantSteps:  []string{models.StepDone, models.StepFailed, models.StepPending},
+			wantRuns:   map[string]int{models.StepCreateLB: 1, models.StepRunDeploy: 1},
+			wantOp:     models.OperationFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, s, cloud := testServer(t)
+			results := map[string][]error{}
+			for _, name := range steps {
+				results[name] = tt.results[name]
+			}
+			runs := stubSteps(t, results)
+
+			credentials, err := sealCredentials(models.AuthOpts{Type: "Token", Token: "token", ProjectId: testProject})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &ApiCluster{Cluster: models.Cluster{ProjectId: testProject, UUID: "c1", Name: "test"}, cloud: cloud}
+			c.Cluster.Provisioning = models.NewProvisioning(credentials)
+			c.Cluster.Provisioning.Steps = nil
+			for _, name := range steps {
+				status := models.StepPending
+				for _, done := range tt.done {
+					if done == name {
+						status = models.StepDone
+					}
+				}
+				c.Cluster.Provisioning.Steps = append(c.Cluster.Provisioning.Steps, models.Step{Name: name, Status: status})
+			}
+			if tt.upgrade {
+				c.Cluster.Provisioning.Type = models.OperationUpgrade
+			}
+			op, err := newOperation(c.Cluster.Provisioning.Type, &c.Cluster, "user")
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Cluster.Provisioning.OperationId = op.ID
+			if err := s.CreateNewCluster(&c.Cluster); err != nil {
+				t.Fatal(err)
+			}
+
+			c.goRunClusterSetup()
+
+			stored, err := s.GetCluster(testProject, "c1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Status != tt.wantStatus {
+				t.Errorf("status %s, want %s", stored.Status, tt.wantStatus)
+			}
+			for i, step := range stored.Provisioning.Steps {
+				if step.Status != tt.wantSteps[i] {
+					t.Errorf("step %s is %s, want %s", step.Name, step.Status, tt.wantSteps[i])
+				}
+			}
+			if !reflect.DeepEqual(runs, tt.wantRuns) {
+				t.Errorf("ran steps %v, want %v", runs, tt.wantRuns)
+			}
+			if stored.Provisioning.Active || stored.Provisioning.Credentials != "" {
+				t.Errorf("finished provisioning is active %v, with credentials %v", stored.Provisioning.Active, stored.Provisioning.Credentials != "")
+			}
+			got, err := s.GetOperation(testProject, op.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.State != tt.wantOp {
+				t.Errorf("operation %s, want %s", got.State, tt.wantOp)
+			}
+		})
+	}
+}
+
+// TestGoRunClusterSetupDeleted checks that the worker stops at the next step
+// once DeleteCluster took the cluster over.
+func TestGoRunClusterSetupDeleted(t *testing.T) {
+	_, s, cloud := testServer(t)
+	runs := stubSteps(t, map[string][]error{models.StepCreateLB: nil, models.StepCreateVMs: nil})
+
+	credentials, err := sealCredentials(models.AuthOpts{Type: "Token", Token: "token", ProjectId: testProject})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &ApiCluster{Cluster: models.Cluster{ProjectId: testProject, UUID: "c1", Name: "test"}, cloud: cloud}
+	c.Cluster.Provisioning = models.NewProvisioning(credentials)
+	if err := s.CreateNewCluster(&c.Cluster); err != nil {
+		t.Fatal(err)
+	}
+	provisionSteps[models.StepCreateLB] = func(c *ApiCluster, authOpts models.AuthOpts) error {
+		runs[models.StepCreateLB]++
+		_, err := db.UpdateClusterWithRetry(s, testProject, "c1", func(cluster *models.Cluster) error {
+			cluster.Status = models.StatusDeleting
+			return nil
+		})
+		return err
+	}
+
+	c.goRunClusterSetup()
+
+	stored, err := s.GetCluster(testProject, "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != models.StatusDeleting {
+		t.Errorf("status %s, want %s", stored.Status, models.StatusDeleting)
+	}
+	if runs[models.StepCreateVMs] != 0 {
+		t.Error("kept provisioning a deleted cluster")
+	}
+}
+
+// TestGoRunClusterSetupNoCredentials checks that a provisioning which cannot
+// open its credentials is given up rather than left active.
+func TestGoRunClusterSetupNoCredentials(t *testing.T) {
+	_, s, cloud := testServer(t)
+	runs := stubSteps(t, map[string][]error{models.StepCreateLB: nil})
+
+	c := &ApiCluster{Cluster: models.Cluster{ProjectId: testProject, UUID: "c1", Name: "test"}, cloud: cloud}
+	c.Cluster.Provisioning = models.NewProvisioning("not sealed")
+	op, err := newOperation(c.Cluster.Provisioning.Type, &c.Cluster, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Cluster.Provisioning.OperationId = op.ID
+	if err := s.CreateNewCluster(&c.Cluster); err != nil {
+		t.Fatal(err)
+	}
+
+	c.goRunClusterSetup()
+
+	stored, err := s.GetCluster(testProject, "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != models.StatusFailed || !strings.HasPrefix(stored.StatusReason, "Cannot open the provisioning credentials") {
+		t.Errorf("status %s: %s, want %s", stored.Status, stored.StatusReason, models.StatusFailed)
+	}
+	if stored.Provisioning.Active || stored.Provisioning.Credentials != "" {
+		t.Errorf("abandoned provisioning is active %v, with credentials %v", stored.Provisioning.Active, stored.Provisioning.Credentials != "")
+	}
+	if runs[models.StepCreateLB] != 0 {
+		t.Error("ran a step without credentials")
+	}
+	got, err := s.GetOperation(testProject, op.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != models.OperationFailed {
+		t.Errorf("operation %s, want %s", got.State, models.OperationFailed)
+	}
+}
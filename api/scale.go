@@ -0,0 +1,271 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/executor"
+	"github.com/sulochan/kaas/models"
+	"github.com/sulochan/kaas/provider"
+)
+
+// updateRequest is the body of POST /api/clusters/{cluster}.
+type updateRequest struct {
+	// Worker is the desired worker count.
+	Worker *int `json:"worker"`
+}
+
+// errBusy refuses a scaling of a cluster that is not Ready or Degraded.
+var errBusy = errors.New("cluster is busy")
+
+// UpdateCluster - scale the workers of a cluster to the requested count. The
+// scaling runs as provisioning steps, see models.NewScaling.
+func UpdateCluster(w http.ResponseWriter, r *http.Request) {
+	authOpts := context.Get(r, "authOpts").(models.AuthOpts)
+	projectid := context.Get(r, "projectid").(string)
+	username := context.Get(r, "username").(string)
+	vars := mux.Vars(r)
+
+	req := updateRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Error("Error decoding json for cluster update: ", err)
+		http.Error(w, "Error decoding the json data in request", 400)
+		return
+	}
+	if req.Worker == nil || *req.Worker < 0 {
+		http.Error(w, "worker must be set to a count of 0 or more", 400)
+		return
+	}
+
+	dbCluster, err := store.GetCluster(projectid, vars["cluster"])
+	if err == db.NotFound {
+		http.Error(w, "Cluster not found", 404)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error getting cluster from the db", 500)
+		return
+	}
+
+	if !ifMatch(r, dbCluster) {
+		http.Error(w, "Cluster was modified, If-Match does not match", http.StatusPreconditionFailed)
+		return
+	}
+	if *req.Worker == dbCluster.Worker && dbCluster.Status == models.StatusReady {
+		w.Header().Set("ETag", etag(dbCluster))
+		json.NewEncoder(w).Encode(newClusterResponse(dbCluster))
+		return
+	}
+	if dbCluster.Status != models.StatusReady && dbCluster.Status != models.StatusDegraded {
+		http.Error(w, "Cluster is "+dbCluster.Status+", only Ready or Degraded clusters can be scaled", http.StatusConflict)
+		return
+	}
+
+	cloud, err := newProvider(authOpts, dbCluster)
+	if err != nil {
+		http.Error(w, "Error creating client for openstack service", 500)
+		return
+	}
+
+	credentials, err := sealCredentials(authOpts)
+	if err != nil {
+		log.Error("Error sealing credentials: ", err)
+		http.Error(w, "Error sealing credentials", 500)
+		return
+	}
+
+	op, err := newOperation(models.OperationUpdate, dbCluster, username)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error creating operation in the db", 500)
+		return
+	}
+	scaling := models.NewScaling(credentials)
+	scaling.OperationId = op.ID
+	dbCluster, err = updateIfMatch(r, projectid, dbCluster.UUID, func(c *models.Cluster) error {
+		if c.Status != models.StatusReady && c.Status != models.StatusDegraded {
+			return errBusy
+		}
+		c.Worker = *req.Worker
+		c.Provisioning = scaling
+		c.Status = models.StatusScaling
+		c.StatusReason = fmt.Sprintf("Scaling to %d workers", *req.Worker)
+		return nil
+	})
+	if err != nil {
+		finishOperation(op.ProjectId, op.ID, err)
+		if err == errPrecondition {
+			http.Error(w, "Cluster was modified, If-Match does not match", http.StatusPreconditionFailed)
+			return
+		}
+		if err == errBusy {
+			http.Error(w, "Cluster is busy, only Ready or Degraded clusters can be scaled", http.StatusConflict)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Error updating cluster in the db", 500)
+		return
+	}
+
+	c := &ApiCluster{Cluster: *dbCluster, cloud: cloud}
+	upgradeLegacyLB(&c.Cluster)
+	go c.goRunClusterSetup()
+
+	writeAccepted(w, op)
+}
+
+// workerIndex returns the number in the name of worker node, 0 if it has
+// none.
+func (c *ApiCluster) workerIndex(node *models.Node) int {
+	n, err := strconv.Atoi(strings.TrimPrefix(node.Name, fmt.Sprintf("k8s-%s-worker-", c.Cluster.Name)))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// kubectl runs kubectl args with the admin credentials of the first master.
+func (c *ApiCluster) kubectl(args ...string) (string, error) {
+	m := c.firstMaster()
+	if m == nil {
+		return "", errors.New("first master not found")
+	}
+	return c.kubectlOn(m, args...)
+}
+
+// kubectlOn runs kubectl args with the admin credentials of master m. Each
+// arg is quoted for the shell of the node.
+func (c *ApiCluster) kubectlOn(m *models.Node, args ...string) (string, error) {
+	cmd := "/usr/bin/kubectl --kubeconfig=/etc/kubernetes/admin.conf"
+	for _, arg := range args {
+		cmd += " " + executor.Quote(arg)
+	}
+	return c.run(m, executor.Command{
+		Cmd:     cmd,
+		Timeout: kubectlTimeout,
+	})
+}
+
+// nodeName is the kubernetes name of node, its hostname.
+func nodeName(node *models.Node) string {
+	return strings.ToLower(node.Name)
+}
+
+// drainNode cordons node, evicts its pods and deletes it from kubernetes,
+// running kubectl on master via. A node kubernetes does not know, e.g.
+// because a previous attempt already deleted it, is left alone. Pods stuck
+// terminating on a dead node do not hold up the drain.
+func (c *ApiCluster) drainNode(via *models.Node, node *models.Node) error {
+	name := nodeName(node)
+	out, err := c.kubectlOn(via, "get", "node", name, "--ignore-not-found", "-o", "name")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(out) == "" {
+		return nil
+	}
+
+	if err := c.evictNode(via, node); err != nil {
+		return err
+	}
+	_, err = c.kubectlOn(via, "delete", "node", name, "--ignore-not-found")
+	return err
+}
+
+// evictNode cordons node and evicts its pods, running kubectl on master via.
+func (c *ApiCluster) evictNode(via *models.Node, node *models.Node) error {
+	name := nodeName(node)
+	if _, err := c.kubectlOn(via, "cordon", name); err != nil {
+		return err
+	}
+	_, err := c.kubectlOn(via, "drain", name, "--ignore-daemonsets", "--delete-emptydir-data", "--force",
+		"--timeout=10m", "--skip-wait-for-delete-timeout=60")
+	return err
+}
+
+// RemoveWorkers drains and deletes workers, highest numbered first, until
+// the cluster has no more than its worker count.
+func (c *ApiCluster) RemoveWorkers(authOpts models.AuthOpts) error {
+	for len(c.Cluster.WorkerNodes) > c.Cluster.Worker {
+		last := c.Cluster.WorkerNodes[0]
+		for _, node := range c.Cluster.WorkerNodes {
+			if c.workerIndex(node) > c.workerIndex(last) {
+				last = node
+			}
+		}
+
+		log.Info("Removing worker ", last.Name, " of cluster ", c.Cluster.UUID)
+		m := c.firstMaster()
+		if m == nil {
+			return errors.New("first master not found")
+		}
+		if err := c.drainNode(m, last); err != nil {
+			return err
+		}
+		if err := c.deleteNodeVM(last); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteNodeVM deletes the VM of node, then node from the cluster record.
+// A node without a server id is looked up by name among the VMs of the
+// cluster.
+func (c *ApiCluster) deleteNodeVM(node *models.Node) error {
+	ids := []string{node.UUID}
+	if node.UUID == "" {
+		var err error
+		ids, err = findClusterVMs(c.cloud, c.Cluster.UUID, node.Name)
+		if err != nil {
+			return err
+		}
+	}
+	for _, id := range ids {
+		// the VM may already be gone if a previous attempt died before
+		// saving the nodes
+		if err := DeleteVM(c.cloud, id); err != nil && err != provider.ErrNotFound {
+			return err
+		}
+	}
+
+	without := func(nodes []*models.Node) []*models.Node {
+		left := []*models.Node{}
+		for _, n := range nodes {
+			if n != node {
+				left = append(left, n)
+			}
+		}
+		return left
+	}
+	c.Cluster.MasterNodes = without(c.Cluster.MasterNodes)
+	c.Cluster.WorkerNodes = without(c.Cluster.WorkerNodes)
+	c.Cluster.EtcdNodes = without(c.Cluster.EtcdNodes)
+	return c.saveNodes()
+}
+
+// JoinWorkers joins the workers added by a scaling with a fresh bootstrap
+// token created on the first master.
+func (c *ApiCluster) JoinWorkers(authOpts models.AuthOpts) error {
+	m := c.firstMaster()
+	if m == nil {
+		return errors.New("first master not found")
+	}
+	if c.Cluster.LoadBalancer == nil || c.Cluster.LoadBalancer.VIP == "" {
+		return errors.New("LB has no virtual ip")
+	}
+
+	if err := c.newJoinToken(m); err != nil {
+		return err
+	}
+	return c.joinWorkers(c.Cluster.LoadBalancer.VIP)
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	fakeexec "github.com/sulochan/kaas/executor/fake"
+	"github.com/sulochan/kaas/models"
+)
+
+const kubectlCmd = "/usr/bin/kubectl --kubeconfig=/etc/kubernetes/admin.conf "
+
+func commands(runs []fakeexec.Run) []string {
+	cmds := []string{}
+	for _, r := range runs {
+		cmds = append(cmds, r.Cmd)
+	}
+	return cmds
+}
+
+func TestDrainNodeQuotes(t *testing.T) {
+	nodes := fakeexec.New(nil)
+	nodes.Handle("'get' 'node'", func(n *models.Node, cmd string) (string, int, error) {
+		return "node/x", 0, nil
+	})
+	via := &models.Node{Name: "k8s-test-master-1"}
+	// names of clusters created before they were checked
+	node := &models.Node{Name: "k8s-it's;reboot-worker-1"}
+	c := &ApiCluster{exec: nodes}
+
+	if err := c.drainNode(via, node); err != nil {
+		t.Fatal(err)
+	}
+	name := `'k8s-it'\''s;reboot-worker-1'`
+	want := []string{
+		kubectlCmd + "'get' 'node' " + name + " '--ignore-not-found' '-o' 'name'",
+		kubectlCmd + "'cordon' " + name,
+		kubectlCmd + "'drain' " + name + " '--ignore-daemonsets' '--delete-emptydir-data' '--force' '--timeout=10m' '--skip-wait-for-delete-timeout=60'",
+		kubectlCmd + "'delete' 'node' " + name + " '--ignore-not-found'",
+	}
+	if got := commands(nodes.Runs()); !reflect.DeepEqual(got, want) {
+		t.Errorf("ran\n%q\nwant\n%q", got, want)
+	}
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"errors"
+
+	"github.com/sulochan/kaas/models"
+)
+
+// sealSecret returns secret sealed with the server key, as the secrets of
+// the clusters are stored.
+func sealSecret(secret []byte) (string, error) {
+	if box == nil {
+		return "", errors.New("no secret box to seal with")
+	}
+	return box.Seal(secret)
+}
+
+// openSecret returns the secret sealed by sealSecret.
+func openSecret(sealed string) ([]byte, error) {
+	if box == nil {
+		return nil, errors.New("no secret box to open with")
+	}
+	return box.Open(sealed)
+}
+
+// sealKeyPair returns kp with its private key sealed.
+func sealKeyPair(kp *models.KeyPair) (*models.SealedKeyPair, error) {
+	key, err := sealSecret(kp.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &models.SealedKeyPair{Cert: kp.Cert, Key: key}, nil
+}
+
+// openKeyPair returns the key pair sealed by sealKeyPair, to sign with. A
+// pair stored without its private key cannot be opened.
+func openKeyPair(sealed *models.SealedKeyPair) (*models.KeyPair, error) {
+	if sealed == nil || sealed.Key == "" {
+		return nil, errors.New("private key of the CA is not known to kaas")
+	}
+	key, err := openSecret(sealed.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &models.KeyPair{Cert: sealed.Cert, Key: key}, nil
+}
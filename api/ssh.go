@@ -1,27 +1,289 @@
 package api
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
+
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/executor"
+	"github.com/sulochan/kaas/models"
 )
 
-func connectToHost(user, password, host string) (*ssh.Client, *ssh.Session, error) {
+// sshDialTimeout bounds connecting to a node, so that handlers asking an
+// unreachable node do not hang.
+const sshDialTimeout = 15 * time.Second
+
+// newSSHKey returns a new ed25519 key as an authorized_keys line and its
+// PKCS#8 PEM private key sealed with the server key.
+func newSSHKey() (string, string, error) {
+	if box == nil {
+		return "", "", errors.New("no secret box to seal the ssh key with")
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return "", "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", "", err
+	}
+	sealed, err := box.Seal(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))), sealed, nil
+}
+
+// clusterNodes returns the masters, workers and etcd nodes of cluster.
+func clusterNodes(cluster *models.Cluster) []*models.Node {
+	nodes := append([]*models.Node{}, cluster.MasterNodes...)
+	nodes = append(nodes, cluster.WorkerNodes...)
+	return append(nodes, cluster.EtcdNodes...)
+}
+
+// ensureSSHKey creates the ssh key of the cluster, unless a previous attempt
+// already did. The root password of nodes created before clusters had a key
+// is used once to authorize the key, then forgotten. A node that cannot be
+// reached keeps its password until the next attempt.
+func (c *ApiCluster) ensureSSHKey() error {
+	if c.Cluster.SSHPrivateKey == "" {
+		public, private, err := newSSHKey()
+		if err != nil {
+			return err
+		}
+		cluster, err := db.UpdateClusterWithRetry(store, c.Cluster.ProjectId, c.Cluster.UUID, func(cluster *models.Cluster) error {
+			if cluster.SSHPrivateKey == "" {
+				cluster.SSHPublicKey = public
+				cluster.SSHPrivateKey = private
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		c.Cluster.SSHPublicKey = cluster.SSHPublicKey
+		c.Cluster.SSHPrivateKey = cluster.SSHPrivateKey
+	}
 
+	authorized := []string{}
+	for _, n := range clusterNodes(&c.Cluster) {
+		if n.Password == "" || n.IP == "" {
+			continue
+		}
+		cmd := fmt.Sprintf("umask 077 && mkdir -p /root/.ssh && (grep -qxF '%[1]s' /root/.ssh/authorized_keys || echo '%[1]s' >> /root/.ssh/authorized_keys)", c.Cluster.SSHPublicKey)
+		if _, err := c.runCommand(cmd, n); err != nil {
+			log.Error("Cannot authorize the ssh key of cluster ", c.Cluster.UUID, " on ", n.Name, ": ", err)
+			continue
+		}
+		n.Password = ""
+		authorized = append(authorized, n.UUID)
+	}
+	if len(authorized) == 0 {
+		return nil
+	}
+	_, err := db.UpdateClusterWithRetry(store, c.Cluster.ProjectId, c.Cluster.UUID, func(cluster *models.Cluster) error {
+		for _, n := range clusterNodes(cluster) {
+			for _, uuid := range authorized {
+				if n.UUID == uuid {
+					n.Password = ""
+				}
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// sshAuth returns how to log in to node n: the key of the cluster, and the
+// root password of a node created before clusters had a key.
+func (c *ApiCluster) sshAuth(n *models.Node) ([]ssh.AuthMethod, error) {
+	auth := []ssh.AuthMethod{}
+	if c.Cluster.SSHPrivateKey != "" {
+		if c.signer == nil {
+			content, err := box.Open(c.Cluster.SSHPrivateKey)
+			if err != nil {
+				return nil, fmt.Errorf("opening the ssh key: %v", err)
+			}
+			signer, err := ssh.ParsePrivateKey(content)
+			if err != nil {
+				return nil, fmt.Errorf("parsing the ssh key: %v", err)
+			}
+			c.signer = signer
+		}
+		auth = append(auth, ssh.PublicKeys(c.signer))
+	}
+	if n.Password != "" {
+		auth = append(auth, ssh.Password(n.Password))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("no ssh credentials for " + n.Name)
+	}
+	return auth, nil
+}
+
+// connect opens an ssh connection to node n as root, see dial.
+func (c *ApiCluster) connect(n *models.Node) (*ssh.Client, error) {
+	auth, err := c.sshAuth(n)
+	if err != nil {
+		return nil, err
+	}
 	sshConfig := &ssh.ClientConfig{
-		User: user,
-		Auth: []ssh.AuthMethod{ssh.Password(password)},
+		User:            "root",
+		Auth:            auth,
+		Timeout:         sshDialTimeout,
+		HostKeyCallback: c.checkHostKey(n),
 	}
-	sshConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
 
-	client, err := ssh.Dial("tcp", host, sshConfig)
+	return c.dial(n, sshConfig)
+}
+
+// Timeouts of the commands run on the nodes.
+const (
+	// probeTimeout bounds checks like fileExists.
+	probeTimeout = time.Minute
+	// kubectlTimeout bounds kubectl, a drain waits up to 10 minutes.
+	kubectlTimeout = 15 * time.Minute
+)
+
+// outputLines is how many of the last lines printed on the nodes the
+// operation of a provisioning run shows.
+const outputLines = 50
+
+// commandOutput is the last lines printed by the commands of a cluster.
+type commandOutput struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+// newExecutor returns the executor of a cluster, connecting with dial and
+// streaming the output of the commands to sink.
+var newExecutor = func(dial executor.Dialer, sink executor.Sink) executor.Executor {
+	return executor.NewSSH(dial, sink)
+}
+
+// SetExecutor sets the function the handlers and the provisioning worker get
+// the executor running commands on the nodes from. It must be called before
+// the router starts serving requests.
+func SetExecutor(f func(dial executor.Dialer, sink executor.Sink) executor.Executor) {
+	newExecutor = f
+}
+
+// executor returns the executor of c, which keeps one connection per node
+// until closeExecutor.
+func (c *ApiCluster) executor() executor.Executor {
+	if c.exec == nil {
+		c.output = &commandOutput{}
+		c.exec = newExecutor(c.connect, c.logOutput)
+	}
+	return c.exec
+}
+
+// closeExecutor closes the connections of the executor of c.
+func (c *ApiCluster) closeExecutor() {
+	if c.exec != nil {
+		c.exec.Close()
+		c.exec = nil
+	}
+}
+
+// context returns the context the commands of c run in.
+func (c *ApiCluster) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// logOutput logs a line printed on node n and keeps it for the operation.
+func (c *ApiCluster) logOutput(n *models.Node, stream, line string) {
+	log.WithFields(log.Fields{"cluster": c.Cluster.UUID, "node": n.Name, "stream": stream}).Info(line)
+
+	c.output.mu.Lock()
+	defer c.output.mu.Unlock()
+	c.output.lines = append(c.output.lines, n.Name+": "+line)
+	if len(c.output.lines) > outputLines {
+		c.output.lines = c.output.lines[len(c.output.lines)-outputLines:]
+	}
+}
+
+// saveOutput shows the last lines printed on the nodes on the operation of
+// the provisioning run, if any.
+func (c *ApiCluster) saveOutput() {
+	p := c.Cluster.Provisioning
+	if !p.Active || p.OperationId == "" || c.output == nil {
+		return
+	}
+	c.output.mu.Lock()
+	lines := append([]string{}, c.output.lines...)
+	c.output.mu.Unlock()
+	updateOperation(c.Cluster.ProjectId, p.OperationId, func(op *models.Operation) {
+		op.Output = lines
+	})
+}
+
+// run runs cmd on node n with the executor of c.
+func (c *ApiCluster) run(n *models.Node, cmd executor.Command) (string, error) {
+	out, err := c.executor().Run(c.context(), n, cmd)
+	c.saveOutput()
+	if err != nil {
+		log.Error("Command on ", n.Name, " failed: ", err)
+	}
+	return out, err
+}
+
+// runCommand runs cmd as root on node n and returns its combined output.
+func (c *ApiCluster) runCommand(cmd string, n *models.Node) (string, error) {
+	return c.run(n, executor.Command{Cmd: cmd})
+}
+
+// uploadFile writes content to path on node n with the mode and owner of
+// opts, creating its directory. The file is replaced atomically once its
+// checksum is verified.
+func (c *ApiCluster) uploadFile(path string, content []byte, n *models.Node, opts executor.FileOpts) error {
+	err := c.executor().Upload(c.context(), n, path, content, opts)
+	c.saveOutput()
 	if err != nil {
-		return nil, nil, err
+		log.Error("Upload to ", n.Name, " failed: ", err)
+		return fmt.Errorf("writing %s: %v", path, err)
 	}
+	return nil
+}
+
+// writeFile writes content to path on node n, creating its directory. The
+// file is only readable by root.
+func (c *ApiCluster) writeFile(path string, content []byte, n *models.Node) error {
+	return c.uploadFile(path, content, n, executor.FileOpts{Mode: executor.DefaultMode, Owner: "root:root"})
+}
 
-	session, err := client.NewSession()
+// readFile returns the content of path on node n, verified against its
+// checksum on n.
+func (c *ApiCluster) readFile(path string, n *models.Node) ([]byte, error) {
+	content, err := c.executor().Download(c.context(), n, path)
+	c.saveOutput()
 	if err != nil {
-		client.Close()
-		return nil, nil, err
+		log.Error("Download from ", n.Name, " failed: ", err)
+		return nil, fmt.Errorf("reading %s: %v", path, err)
 	}
+	return content, nil
+}
 
-	return client, session, nil
+// fileExists reports whether path exists on node n.
+func (c *ApiCluster) fileExists(path string, n *models.Node) bool {
+	_, err := c.run(n, executor.Command{Cmd: "test -f " + path, Timeout: probeTimeout})
+	return err == nil
 }
@@ -0,0 +1,24 @@
+package api
+
+import (
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/secret"
+)
+
+// store is the persistence backend used by every handler.
+var store db.Store
+
+// SetStore sets the persistence backend used by the API handlers. It must be
+// called before the router starts serving requests.
+func SetStore(s db.Store) {
+	store = s
+}
+
+// box seals the secrets stored with the clusters.
+var box *secret.Box
+
+// SetSecretBox sets the box the secrets stored with the clusters are sealed
+// with. It must be called before the router starts serving requests.
+func SetSecretBox(b *secret.Box) {
+	box = b
+}
@@ -0,0 +1,467 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/models"
+)
+
+// upgradeRequest is the body of POST /api/clusters/{cluster}/upgrade.
+type upgradeRequest struct {
+	KubernetesVersion string `json:"kubernetes_version"`
+}
+
+// maxKubeletSkew is how many minor versions a kubelet may be behind the api
+// server.
+const maxKubeletSkew = 2
+
+// kubeletWaitAttempts bounds the wait for an upgraded kubelet to report its
+// new version, pollInterval apart.
+const kubeletWaitAttempts = 15
+
+// parseVersion returns the numbers of kubernetes version v1.21.2.
+func parseVersion(version string) ([3]int, error) {
+	numbers := [3]int{}
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	if len(parts) != 3 {
+		return numbers, fmt.Errorf("invalid kubernetes version %q", version)
+	}
+	for i, part := range parts {
+		// drop suffixes like -rc.0 or +k3s1
+		if j := strings.IndexAny(part, "-+"); j >= 0 {
+			part = part[:j]
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return numbers, fmt.Errorf("invalid kubernetes version %q", version)
+		}
+		numbers[i] = n
+	}
+	return numbers, nil
+}
+
+// compareVersions returns -1, 0 or 1 when version a is older than, the same
+// as or newer than b.
+func compareVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] < b[i] {
+			return -1
+		}
+		if a[i] > b[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// checkUpgrade returns why a control plane at version current cannot be
+// upgraded to target, nothing if it can. kubeadm upgrades one minor version
+// at a time.
+func checkUpgrade(current, target string) (string, error) {
+	from, err := parseVersion(current)
+	if err != nil {
+		return "", err
+	}
+	to, err := parseVersion(target)
+	if err != nil {
+		return "", err
+	}
+	if compareVersions(to, from) < 0 {
+		return fmt.Sprintf("cannot downgrade from %s to %s", current, target), nil
+	}
+	if to[0] != from[0] || to[1] > from[1]+1 {
+		return fmt.Sprintf("cannot upgrade from %s to %s, upgrade one minor version at a time", current, target), nil
+	}
+	return "", nil
+}
+
+// UpgradeCluster - upgrade the kubernetes version of a cluster, one minor
+// version at a time. The upgrade runs as provisioning steps, see
+// models.NewUpgrade, and halts on the first node that fails.
+func UpgradeCluster(w http.ResponseWriter, r *http.Request) {
+	authOpts := context.Get(r, "authOpts").(models.AuthOpts)
+	projectid := context.Get(r, "projectid").(string)
+	username := context.Get(r, "username").(string)
+	vars := mux.Vars(r)
+
+	req := upgradeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Error("Error decoding json for cluster upgrade: ", err)
+		http.Error(w, "Error decoding the json data in request", 400)
+		return
+	}
+	if !conf.Kubernetes.Supports(req.KubernetesVersion) {
+		http.Error(w, "Unsupported kubernetes_version, use one of "+strings.Join(conf.Kubernetes.Versions, ", "), 400)
+		return
+	}
+
+	dbCluster, err := store.GetCluster(projectid, vars["cluster"])
+	if err == db.NotFound {
+		http.Error(w, "Cluster not found", 404)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error getting cluster from the db", 500)
+		return
+	}
+
+	if !ifMatch(r, dbCluster) {
+		http.Error(w, "Cluster was modified, If-Match does not match", http.StatusPreconditionFailed)
+		return
+	}
+	if req.KubernetesVersion == dbCluster.KubernetesVersion && dbCluster.Status == models.StatusReady {
+		w.Header().Set("ETag", etag(dbCluster))
+		json.NewEncoder(w).Encode(newClusterResponse(dbCluster))
+		return
+	}
+	if dbCluster.Status != models.StatusReady && dbCluster.Status != models.StatusDegraded {
+		http.Error(w, "Cluster is "+dbCluster.Status+", only Ready or Degraded clusters can be upgraded", http.StatusConflict)
+		return
+	}
+	// clusters created before versions were recorded are checked against
+	// their api server by the preflight step
+	if dbCluster.KubernetesVersion != "" {
+		problem, err := checkUpgrade(dbCluster.KubernetesVersion, req.KubernetesVersion)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Error checking kubernetes versions", 500)
+			return
+		}
+		if problem != "" {
+			http.Error(w, "Invalid upgrade: "+problem, 400)
+			return
+		}
+	}
+
+	cloud, err := newProvider(authOpts, dbCluster)
+	if err != nil {
+		http.Error(w, "Error creating client for openstack service", 500)
+		return
+	}
+
+	credentials, err := sealCredentials(authOpts)
+	if err != nil {
+		log.Error("Error sealing credentials: ", err)
+		http.Error(w, "Error sealing credentials", 500)
+		return
+	}
+
+	op, err := newOperation(models.OperationUpgrade, dbCluster, username)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error creating operation in the db", 500)
+		return
+	}
+	c := &ApiCluster{Cluster: *dbCluster, cloud: cloud}
+	op.Nodes = c.upgradeOrder()
+	updateOperation(op.ProjectId, op.ID, func(o *models.Operation) {
+		o.Nodes = op.Nodes
+	})
+
+	upgrade := models.NewUpgrade(credentials, req.KubernetesVersion)
+	upgrade.OperationId = op.ID
+	dbCluster, err = updateIfMatch(r, projectid, dbCluster.UUID, func(c *models.Cluster) error {
+		if c.Status != models.StatusReady && c.Status != models.StatusDegraded {
+			return errBusy
+		}
+		c.Provisioning = upgrade
+		c.Status = models.StatusUpgrading
+		c.StatusReason = "Upgrading to " + req.KubernetesVersion
+		return nil
+	})
+	if err != nil {
+		finishOperation(op.ProjectId, op.ID, err)
+		if err == errPrecondition {
+			http.Error(w, "Cluster was modified, If-Match does not match", http.StatusPreconditionFailed)
+			return
+		}
+		if err == errBusy {
+			http.Error(w, "Cluster is busy, only Ready or Degraded clusters can be upgraded", http.StatusConflict)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Error updating cluster in the db", 500)
+		return
+	}
+
+	c.Cluster = *dbCluster
+	upgradeLegacyLB(&c.Cluster)
+	go c.goRunClusterSetup()
+
+	writeAccepted(w, op)
+}
+
+// upgradeOrder returns the nodes of the cluster in the order an upgrade
+// goes through them, all pending: the first master, the other masters, then
+// the workers.
+func (c *ApiCluster) upgradeOrder() []models.NodeProgress {
+	nodes := []models.NodeProgress{}
+	for _, n := range c.Cluster.MasterNodes {
+		if c.isFirstMaster(n) {
+			nodes = append([]models.NodeProgress{{Name: n.Name, State: models.OperationPending}}, nodes...)
+			continue
+		}
+		nodes = append(nodes, models.NodeProgress{Name: n.Name, State: models.OperationPending})
+	}
+	for _, n := range c.Cluster.WorkerNodes {
+		nodes = append(nodes, models.NodeProgress{Name: n.Name, State: models.OperationPending})
+	}
+	return nodes
+}
+
+// setNodeProgress records the state of node name on the operation of the
+// upgrade.
+func (c *ApiCluster) setNodeProgress(name, state string, err error) {
+	updateOperation(c.Cluster.ProjectId, c.Cluster.Provisioning.OperationId, func(op *models.Operation) {
+		for i := range op.Nodes {
+			if op.Nodes[i].Name != name {
+				continue
+			}
+			op.Nodes[i].State = state
+			op.Nodes[i].Error = ""
+			if err != nil {
+				op.Nodes[i].Error = err.Error()
+			}
+		}
+		if state == models.OperationRunning {
+			op.Message = "Upgrading node " + name
+		}
+	})
+}
+
+// k8sNodeOf returns the kubernetes node of n.
+func (c *ApiCluster) k8sNodeOf(n *models.Node) (k8sNode, error) {
+	node := k8sNode{}
+	out, err := c.kubectl("get", "node", nodeName(n), "-o", "json")
+	if err != nil {
+		return node, err
+	}
+	err = json.Unmarshal([]byte(out), &node)
+	return node, err
+}
+
+// UpgradePreflight checks that the control plane can move to the target
+// version and that every node is ready, with a kubelet the target api
+// server still supports.
+func (c *ApiCluster) UpgradePreflight(authOpts models.AuthOpts) error {
+	target := c.Cluster.Provisioning.Version
+	to, err := parseVersion(target)
+	if err != nil {
+		return err
+	}
+
+	out, err := c.kubectl("version", "-o", "json")
+	if err != nil {
+		return err
+	}
+	version := struct {
+		ServerVersion struct {
+			GitVersion string `json:"gitVersion"`
+		} `json:"serverVersion"`
+	}{}
+	if err := json.Unmarshal([]byte(out), &version); err != nil {
+		return err
+	}
+	problem, err := checkUpgrade(version.ServerVersion.GitVersion, target)
+	if err != nil {
+		return err
+	}
+	if problem != "" {
+		return errors.New(problem)
+	}
+
+	k8s, err := c.k8sNodes()
+	if err != nil {
+		return err
+	}
+	nodes := append(append([]*models.Node{}, c.Cluster.MasterNodes...), c.Cluster.WorkerNodes...)
+	for _, n := range nodes {
+		k, ok := k8s[nodeName(n)]
+		if !ok {
+			return fmt.Errorf("node %s is not part of the cluster", n.Name)
+		}
+		if k.ready() != nodeReady {
+			return fmt.Errorf("node %s is not ready", n.Name)
+		}
+		kubelet, err := parseVersion(k.Status.NodeInfo.KubeletVersion)
+		if err != nil {
+			return err
+		}
+		if compareVersions(kubelet, to) > 0 {
+			return fmt.Errorf("kubelet of node %s is %s, newer than %s", n.Name, k.Status.NodeInfo.KubeletVersion, target)
+		}
+		if kubelet[1] < to[1]-maxKubeletSkew {
+			return fmt.Errorf("kubelet of node %s is %s, too old for %s, upgrade it first", n.Name, k.Status.NodeInfo.KubeletVersion, target)
+		}
+	}
+	return nil
+}
+
+// installPackages installs the target version of the kubernetes packages on
+// node n and holds them there.
+func (c *ApiCluster) installPackages(n *models.Node, packages ...string) error {
+	pkg := conf.Kubernetes.PackageVersion(c.Cluster.Provisioning.Version)
+	pinned := []string{}
+	for _, p := range packages {
+		pinned = append(pinned, p+"="+pkg)
+	}
+	cmd := "apt-get update && DEBIAN_FRONTEND=noninteractive apt-get install -y --allow-change-held-packages " +
+		strings.Join(pinned, " ") + " && apt-mark hold " + strings.Join(packages, " ")
+	_, err := c.runCommand(cmd, n)
+	return err
+}
+
+// upgradeKubelet installs the target kubelet and kubectl on node n and
+// restarts the kubelet.
+func (c *ApiCluster) upgradeKubelet(n *models.Node) error {
+	if err := c.installPackages(n, "kubelet", "kubectl"); err != nil {
+		return err
+	}
+	_, err := c.runCommand("systemctl daemon-reload && systemctl restart kubelet", n)
+	return err
+}
+
+// upgradeNode runs upgrade on node n, unless its kubelet already runs the
+// target version, then waits for the kubelet to come back ready on it. The
+// progress of the node is recorded on the operation.
+func (c *ApiCluster) upgradeNode(n *models.Node, upgrade func() error) error {
+	target := c.Cluster.Provisioning.Version
+	k, err := c.k8sNodeOf(n)
+	if err != nil {
+		c.setNodeProgress(n.Name, models.OperationFailed, err)
+		return err
+	}
+	if k.Status.NodeInfo.KubeletVersion == target && k.ready() == nodeReady {
+		c.setNodeProgress(n.Name, models.OperationSucceeded, nil)
+		return nil
+	}
+
+	log.Info("Upgrading node ", n.Name, " of cluster ", c.Cluster.UUID, " to ", target)
+	c.setNodeProgress(n.Name, models.OperationRunning, nil)
+	err = upgrade()
+	if err == nil {
+		err = c.waitKubelet(n)
+	}
+	if err != nil {
+		c.setNodeProgress(n.Name, models.OperationFailed, err)
+		return err
+	}
+	c.setNodeProgress(n.Name, models.OperationSucceeded, nil)
+	return nil
+}
+
+// waitKubelet waits for the kubelet of node n to come back ready at the
+// target version.
+func (c *ApiCluster) waitKubelet(n *models.Node) error {
+	target := c.Cluster.Provisioning.Version
+	for i := 0; i < kubeletWaitAttempts; i++ {
+		k, err := c.k8sNodeOf(n)
+		if err == nil && k.Status.NodeInfo.KubeletVersion == target && k.ready() == nodeReady {
+			return nil
+		}
+		time.Sleep(pollInterval)
+	}
+	return fmt.Errorf("kubelet of node %s did not come back ready at %s", n.Name, target)
+}
+
+// UpgradeFirstMaster upgrades the control plane with kubeadm upgrade apply
+// on the first master, then its kubelet.
+func (c *ApiCluster) UpgradeFirstMaster(authOpts models.AuthOpts) error {
+	m := c.firstMaster()
+	if m == nil {
+		return errors.New("first master not found")
+	}
+	target := c.Cluster.Provisioning.Version
+
+	return c.upgradeNode(m, func() error {
+		if err := c.installPackages(m, "kubeadm"); err != nil {
+			return err
+		}
+		if _, err := c.runCommand("kubeadm upgrade plan "+target, m); err != nil {
+			return err
+		}
+		if _, err := c.runCommand("kubeadm upgrade apply -y "+target, m); err != nil {
+			return err
+		}
+		return c.upgradeKubelet(m)
+	})
+}
+
+// UpgradeMasters upgrades the other masters one by one with kubeadm upgrade
+// node.
+func (c *ApiCluster) UpgradeMasters(authOpts models.AuthOpts) error {
+	for _, m := range c.Cluster.MasterNodes {
+		if c.isFirstMaster(m) {
+			continue
+		}
+		m := m
+		err := c.upgradeNode(m, func() error {
+			if err := c.installPackages(m, "kubeadm"); err != nil {
+				return err
+			}
+			if _, err := c.runCommand("kubeadm upgrade node", m); err != nil {
+				return err
+			}
+			return c.upgradeKubelet(m)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpgradeWorkers drains, upgrades and uncordons the workers one by one, then
+// records the new version of the cluster.
+func (c *ApiCluster) UpgradeWorkers(authOpts models.AuthOpts) error {
+	via := c.firstMaster()
+	if via == nil {
+		return errors.New("first master not found")
+	}
+
+	for _, n := range c.Cluster.WorkerNodes {
+		n := n
+		err := c.upgradeNode(n, func() error {
+			if err := c.evictNode(via, n); err != nil {
+				return err
+			}
+			if err := c.installPackages(n, "kubeadm"); err != nil {
+				return err
+			}
+			if _, err := c.runCommand("kubeadm upgrade node", n); err != nil {
+				return err
+			}
+			return c.upgradeKubelet(n)
+		})
+		if err != nil {
+			return err
+		}
+		// also done for a node upgraded by a previous attempt, which may
+		// have died before it
+		if _, err := c.kubectlOn(via, "uncordon", nodeName(n)); err != nil {
+			return err
+		}
+	}
+
+	target := c.Cluster.Provisioning.Version
+	_, err := db.UpdateClusterWithRetry(store, c.Cluster.ProjectId, c.Cluster.UUID, func(cluster *models.Cluster) error {
+		cluster.KubernetesVersion = target
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.Cluster.KubernetesVersion = target
+	return nil
+}
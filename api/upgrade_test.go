@@ -0,0 +1,55 @@
+package api
+
+import "testing"
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    [3]int
+		wantErr bool
+	}{
+		{version: "v1.21.2", want: [3]int{1, 21, 2}},
+		{version: "1.21.2", want: [3]int{1, 21, 2}},
+		{version: "v1.22.0-rc.0", want: [3]int{1, 22, 0}},
+		{version: "v1.21.2+k3s1", want: [3]int{1, 21, 2}},
+		{version: "v1.21", wantErr: true},
+		{version: "v1.x.2", wantErr: true},
+		{version: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseVersion(tt.version)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: got error %v, want error %v", tt.version, err, tt.wantErr)
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestCheckUpgrade(t *testing.T) {
+	tests := []struct {
+		current, target string
+		wantProblem     bool
+		wantErr         bool
+	}{
+		{current: "v1.20.8", target: "v1.21.2"},
+		{current: "v1.21.2", target: "v1.21.3"},
+		{current: "v1.21.2", target: "v1.21.2"},
+		{current: "v1.19.12", target: "v1.21.2", wantProblem: true},
+		{current: "v1.21.2", target: "v1.20.8", wantProblem: true},
+		{current: "v1.21.2", target: "v1.21.1", wantProblem: true},
+		{current: "v1.21.2", target: "v2.0.0", wantProblem: true},
+		{current: "v1.21", target: "v1.21.2", wantErr: true},
+		{current: "v1.21.2", target: "latest", wantErr: true},
+	}
+	for _, tt := range tests {
+		problem, err := checkUpgrade(tt.current, tt.target)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s to %s: got error %v, want error %v", tt.current, tt.target, err, tt.wantErr)
+		}
+		if (problem != "") != tt.wantProblem {
+			t.Errorf("%s to %s: got problem %q, want problem %v", tt.current, tt.target, problem, tt.wantProblem)
+		}
+	}
+}
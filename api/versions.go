@@ -0,0 +1,21 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// versionsResponse is the kubernetes version catalog of the server.
+type versionsResponse struct {
+	DefaultVersion string   `json:"default_version"`
+	Versions       []string `json:"versions"`
+}
+
+// GetKubernetesVersions - get the kubernetes versions clusters can be created
+// with
+func GetKubernetesVersions(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(versionsResponse{
+		DefaultVersion: conf.Kubernetes.DefaultVersion,
+		Versions:       conf.Kubernetes.Versions,
+	})
+}
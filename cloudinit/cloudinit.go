@@ -0,0 +1,147 @@
+// Package cloudinit renders the cloud-init user-data of the cluster VMs from
+// a template per role. The templates are built in; a directory can override
+// any of them with a <name>.yaml file. Every template is rendered once when
+// loaded, so a broken one stops kaas at startup instead of at the first VM.
+package cloudinit
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Roles are the roles with a template.
+var Roles = []string{"master", "worker", "etcd"}
+
+// Data is what a template is rendered with.
+type Data struct {
+	Role        string
+	ClusterName string
+	ClusterUUID string
+	// SSHAuthorizedKeys are the keys root can log in with, the password
+	// login is disabled.
+	SSHAuthorizedKeys []string
+	// KubernetesVersion is v1.21.2, PackageVersion 1.21.2-00 and Packages the
+	// kubelet, kubeadm and kubectl packages pinned to it. The versions are
+	// empty on clusters created before they were recorded.
+	KubernetesVersion string
+	PackageVersion    string
+	Packages          string
+	// ContainerRuntime is containerd or docker.
+	ContainerRuntime string
+	HTTPProxy        string
+	HTTPSProxy       string
+	NoProxy          string
+	// ProxyEnv sets the proxies of a shell command it prefixes.
+	ProxyEnv        string
+	RegistryMirrors []string
+	ExtraPackages   []string
+	Sysctls         map[string]string
+}
+
+// Templates are the loaded templates, one per role.
+type Templates struct {
+	roles map[string]*template.Template
+}
+
+var funcs = template.FuncMap{
+	// quote returns s as a double quoted YAML, JSON and TOML string.
+	"quote": strconv.Quote,
+}
+
+// Load returns the built in templates, overridden by the files of dir if it
+// is not empty, after checking that each role renders to valid cloud-config.
+func Load(dir string) (*Templates, error) {
+	sources := map[string]string{}
+	for name, source := range builtin {
+		sources[name] = source
+	}
+	if dir != "" {
+		for name := range builtin {
+			content, err := ioutil.ReadFile(filepath.Join(dir, name+".yaml"))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			sources[name] = string(content)
+		}
+	}
+
+	common, err := template.New("common").Funcs(funcs).Option("missingkey=error").Parse(sources["common"])
+	if err != nil {
+		return nil, fmt.Errorf("cloud-init template common: %v", err)
+	}
+	t := &Templates{roles: map[string]*template.Template{}}
+	for _, role := range Roles {
+		clone, err := common.Clone()
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := clone.New(role).Parse(sources[role])
+		if err != nil {
+			return nil, fmt.Errorf("cloud-init template %s: %v", role, err)
+		}
+		t.roles[role] = tmpl
+	}
+
+	for _, role := range Roles {
+		for _, runtime := range []string{"containerd", "docker"} {
+			if _, err := t.Render(role, sample(role, runtime)); err != nil {
+				return nil, fmt.Errorf("cloud-init template %s with %s: %v", role, runtime, err)
+			}
+		}
+	}
+	return t, nil
+}
+
+// sample returns data using every field, to check the templates with.
+func sample(role, runtime string) Data {
+	return Data{
+		Role:              role,
+		ClusterName:       "sample",
+		ClusterUUID:       "00000000-0000-0000-0000-000000000000",
+		SSHAuthorizedKeys: []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIA9ah/+bBGbT13+NlqeLsEHoiBNrzsLCSuNxQGzHgU2F"},
+		KubernetesVersion: "v1.21.2",
+		PackageVersion:    "1.21.2-00",
+		Packages:          "kubelet=1.21.2-00 kubeadm=1.21.2-00 kubectl=1.21.2-00",
+		ContainerRuntime:  runtime,
+		HTTPProxy:         "http://proxy:3128",
+		HTTPSProxy:        "http://proxy:3128",
+		NoProxy:           "localhost,127.0.0.1",
+		ProxyEnv:          "http_proxy=http://proxy:3128 https_proxy=http://proxy:3128 no_proxy=localhost,127.0.0.1 ",
+		RegistryMirrors:   []string{"https://mirror.example.com"},
+		ExtraPackages:     []string{"jq"},
+		Sysctls:           map[string]string{"vm.max_map_count": "262144"},
+	}
+}
+
+// Render returns the user-data of a VM of role, checked to be a YAML
+// cloud-config document.
+func (t *Templates) Render(role string, data Data) ([]byte, error) {
+	tmpl, ok := t.roles[role]
+	if !ok {
+		return nil, fmt.Errorf("no cloud-init template for role %q", role)
+	}
+	out := bytes.Buffer{}
+	if err := tmpl.Execute(&out, data); err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(out.String(), "#cloud-config\n") {
+		return nil, fmt.Errorf("%s user-data does not start with #cloud-config", role)
+	}
+	doc := map[string]interface{}{}
+	if err := yaml.Unmarshal(out.Bytes(), &doc); err != nil {
+		return nil, fmt.Errorf("%s user-data is not valid YAML: %v", role, err)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,135 @@
+package cloudinit
+
+// Built in templates. common holds the named templates the roles are built
+// from; a role template renders the whole user-data of a VM of that role.
+var builtin = map[string]string{
+	"common": `{{ define "header" -}}
+#cloud-config
+# {{ .Role }} of cluster {{ .ClusterName }}, rendered by kaas
+disable_root: false
+ssh_pwauth: false
+# kaas pins the host keys printed on the console
+ssh:
+  emit_keys_to_console: true
+{{- if .SSHAuthorizedKeys }}
+ssh_authorized_keys:
+{{- range .SSHAuthorizedKeys }}
+  - {{ quote . }}
+{{- end }}
+{{- end }}
+{{- if or .HTTPProxy .HTTPSProxy }}
+apt:
+{{- if .HTTPProxy }}
+  http_proxy: {{ quote .HTTPProxy }}
+{{- end }}
+{{- if .HTTPSProxy }}
+  https_proxy: {{ quote .HTTPSProxy }}
+{{- end }}
+{{- end }}
+{{- end }}
+
+{{ define "extra_packages" -}}
+{{- range .ExtraPackages }}
+  - {{ quote . }}
+{{- end }}
+{{- end }}
+
+{{ define "sysctls" }}
+  - path: /etc/sysctl.d/99-kaas.conf
+    content: |
+      # set by kaas
+{{- range $key, $value := .Sysctls }}
+      {{ $key }} = {{ $value }}
+{{- end }}
+{{- end }}
+
+{{ define "runtime_files" -}}
+{{- if eq .ContainerRuntime "docker" }}
+  - path: /etc/docker/daemon.json
+    content: |
+      {"registry-mirrors": [{{ range $i, $m := .RegistryMirrors }}{{ if $i }}, {{ end }}{{ quote $m }}{{ end }}]}
+{{- else if .RegistryMirrors }}
+  - path: /etc/containerd/config.toml
+    content: |
+      version = 2
+      [plugins."io.containerd.grpc.v1.cri".registry.mirrors."docker.io"]
+        endpoint = [{{ range $i, $m := .RegistryMirrors }}{{ if $i }}, {{ end }}{{ quote $m }}{{ end }}]
+{{- end }}
+{{- if or .HTTPProxy .HTTPSProxy }}
+  - path: /etc/systemd/system/{{ .ContainerRuntime }}.service.d/http-proxy.conf
+    content: |
+      [Service]
+{{- if .HTTPProxy }}
+      Environment={{ quote (print "HTTP_PROXY=" .HTTPProxy) }}
+{{- end }}
+{{- if .HTTPSProxy }}
+      Environment={{ quote (print "HTTPS_PROXY=" .HTTPSProxy) }}
+{{- end }}
+{{- if .NoProxy }}
+      Environment={{ quote (print "NO_PROXY=" .NoProxy) }}
+{{- end }}
+{{- end }}
+{{- end }}
+
+{{ define "kubernetes" -}}
+{{ template "header" . }}
+
+packages:
+  - apt-transport-https
+  - ca-certificates
+  - curl
+  - gnupg
+{{- template "extra_packages" . }}
+
+write_files:
+  - path: /etc/modules-load.d/kubernetes.conf
+    content: |
+      overlay
+      br_netfilter
+  - path: /etc/sysctl.d/90-kubernetes.conf
+    content: |
+      net.bridge.bridge-nf-call-iptables = 1
+      net.bridge.bridge-nf-call-ip6tables = 1
+      net.ipv4.ip_forward = 1
+{{- template "sysctls" . }}
+{{- template "runtime_files" . }}
+
+runcmd:
+  - swapoff -a
+  - sed -i '/ swap / s/^/#/' /etc/fstab
+  - modprobe overlay
+  - modprobe br_netfilter
+  - sysctl --system
+  - {{ .ProxyEnv }}curl -fsSLo /usr/share/keyrings/kubernetes-archive-keyring.gpg https://packages.cloud.google.com/apt/doc/apt-key.gpg
+  - echo "deb [signed-by=/usr/share/keyrings/kubernetes-archive-keyring.gpg] https://apt.kubernetes.io/ kubernetes-xenial main" > /etc/apt/sources.list.d/kubernetes.list
+  - apt-get update
+  - DEBIAN_FRONTEND=noninteractive apt-get install -y {{ if eq .ContainerRuntime "docker" }}docker.io{{ else }}containerd{{ end }}
+  - systemctl daemon-reload
+  - systemctl restart {{ .ContainerRuntime }}
+  - DEBIAN_FRONTEND=noninteractive apt-get install -y {{ .Packages }}
+  - apt-mark hold kubelet kubeadm kubectl
+{{- end }}
+`,
+
+	"master": `{{ template "kubernetes" . }}
+`,
+
+	"worker": `{{ template "kubernetes" . }}
+`,
+
+	// etcd is installed over ssh by kaas, the nodes only need curl and tar
+	"etcd": `{{ template "header" . }}
+
+packages:
+  - ca-certificates
+  - curl
+  - tar
+{{- template "extra_packages" . }}
+
+write_files:
+{{- template "sysctls" . }}
+
+runcmd:
+  - sysctl --system
+`,
+}
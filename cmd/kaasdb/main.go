@@ -0,0 +1,99 @@
+// kaasdb exports and imports every kaas record, so an install can move
+// between the mongodb and bolt backends. It talks to the backends directly
+// and must be run while the kaas server is stopped. The export is a BSON
+// document, like the records in the backends, so it keeps the fields the
+// api never shows such as the root passwords of legacy nodes; it is only
+// readable by its owner.
+//
+//	kaasdb -db mongodb -mongo-url localhost export kaas.bson
+//	kaasdb -db bolt -bolt-path kaas.db import kaas.bson
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/db/backend"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags] export|import FILE\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func export(store db.Dumper, path string) error {
+	snapshot, err := store.Dump()
+	if err != nil {
+		return err
+	}
+	content, err := bson.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		return err
+	}
+	log.Infof("exported %d clusters, %d nodes, %d jobs, %d operations to %s",
+		len(snapshot.Clusters), len(snapshot.Nodes), len(snapshot.Jobs), len(snapshot.Operations), path)
+	return nil
+}
+
+func restore(store db.Dumper, path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	snapshot := &db.Snapshot{}
+	if err := bson.Unmarshal(content, snapshot); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if err := store.Restore(snapshot); err != nil {
+		return err
+	}
+	log.Infof("imported %d clusters, %d nodes, %d jobs, %d operations from %s",
+		len(snapshot.Clusters), len(snapshot.Nodes), len(snapshot.Jobs), len(snapshot.Operations), path)
+	return nil
+}
+
+func main() {
+	dbOpts := backend.Options{}
+	flag.StringVar(&dbOpts.Backend, "db", "mongodb", "storage backend: mongodb or bolt")
+	flag.StringVar(&dbOpts.MongoURL, "mongo-url", "localhost", "mongodb server to dial")
+	flag.StringVar(&dbOpts.BoltPath, "bolt-path", "kaas.db", "database file of the bolt backend")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 2 {
+		usage()
+	}
+
+	store, err := backend.Open(dbOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	dumper, ok := store.(db.Dumper)
+	if !ok {
+		log.Fatalf("backend %s does not support export/import", dbOpts.Backend)
+	}
+
+	switch flag.Arg(0) {
+	case "export":
+		err = export(dumper, flag.Arg(1))
+	case "import":
+		err = restore(dumper, flag.Arg(1))
+	default:
+		usage()
+	}
+	if err != nil {
+		store.Close()
+		log.Fatal(err)
+	}
+}
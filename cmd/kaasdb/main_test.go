@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sulochan/kaas/db/memory"
+	"github.com/sulochan/kaas/models"
+)
+
+func TestExportImport(t *testing.T) {
+	from := memory.New()
+	cluster := &models.Cluster{ProjectId: "p1", UUID: "c1", Name: "legacy",
+		MasterNodes: []*models.Node{{UUID: "server-1", Name: "k8s-legacy-master-1", Password: "root password"}}}
+	if err := from.CreateNewCluster(cluster); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "kaas.bson")
+	if err := export(from, path); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("export mode %v, want 0600", mode)
+	}
+
+	to := memory.New()
+	if err := restore(to, path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := to.GetCluster("p1", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// legacy nodes are logged in to with it until the ssh key is authorized
+	if len(got.MasterNodes) != 1 || got.MasterNodes[0].Password != "root password" {
+		t.Errorf("imported masters %+v, want the password kept", got.MasterNodes)
+	}
+}
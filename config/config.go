@@ -0,0 +1,411 @@
+// Package config holds the server side configuration of kaas. It is read, in
+// increasing order of precedence, from the defaults, a YAML or JSON file,
+// KAAS_* environment variables and command line flags, then validated once
+// at startup.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/sulochan/kaas/models"
+	"github.com/sulochan/kaas/secret"
+)
+
+type DB struct {
+	// Backend is mongodb, bolt or memory.
+	Backend  string `yaml:"backend" json:"backend"`
+	MongoURL string `yaml:"mongo_url" json:"mongo_url"`
+	BoltPath string `yaml:"bolt_path" json:"bolt_path"`
+}
+
+type OpenStack struct {
+	// IdentityURL is the keystone endpoint users authenticate against.
+	IdentityURL string `yaml:"identity_url" json:"identity_url"`
+	Region      string `yaml:"region" json:"region"`
+}
+
+type LoadBalancer struct {
+	// Provider is the lb service of clusters created without one, one of
+	// the models.LBProvider constants.
+	Provider string `yaml:"provider" json:"provider"`
+	// OctaviaSubnet is the subnet of the octavia vips and members.
+	OctaviaSubnet string `yaml:"octavia_subnet" json:"octavia_subnet"`
+}
+
+type Machine struct {
+	Flavor string `yaml:"flavor" json:"flavor"`
+	Image  string `yaml:"image" json:"image"`
+	// UserDataDir overrides the built in cloud-init templates with its
+	// <name>.yaml files, see package cloudinit.
+	UserDataDir string `yaml:"user_data_dir" json:"user_data_dir"`
+}
+
+type Etcd struct {
+	// Version is the etcd release installed on the nodes of external etcd
+	// clusters.
+	Version string `yaml:"version" json:"version"`
+	// SHA256 pins the checksums of the etcd-<version>-linux-<arch>.tar.gz
+	// release archives of Version, by arch (amd64, arm64). The archives of
+	// an arch without one are checked against the SHA256SUMS published with
+	// the release.
+	SHA256 map[string]string `yaml:"sha256" json:"sha256"`
+}
+
+type CNI struct {
+	// Plugin is the CNI of clusters created without one, one of
+	// models.CNIPlugins.
+	Plugin string `yaml:"plugin" json:"plugin"`
+	// ManifestDir holds the CNI manifest templates, <plugin>/<version>.yaml.
+	// Missing ones are downloaded once from upstream and cached there.
+	ManifestDir string `yaml:"manifest_dir" json:"manifest_dir"`
+	// SHA256 are the checksums of the upstream manifests, by plugin and
+	// version. Only these and the default version of each plugin, trusted
+	// on its first download, are downloaded; other versions with neither a
+	// template nor a checksum cannot be deployed.
+	SHA256 map[string]map[string]string `yaml:"sha256" json:"sha256"`
+}
+
+type Kubernetes struct {
+	// Versions is the catalog of versions clusters can be created with.
+	Versions []string `yaml:"versions" json:"versions"`
+	// DefaultVersion is the version of clusters created without one.
+	DefaultVersion string `yaml:"default_version" json:"default_version"`
+	// PackageRevision is the revision of the kubelet, kubeadm and kubectl
+	// packages, 1.21.2-00 for v1.21.2.
+	PackageRevision string `yaml:"package_revision" json:"package_revision"`
+}
+
+// PackageVersion returns the package version of kubernetes version.
+func (k Kubernetes) PackageVersion(version string) string {
+	return strings.TrimPrefix(version, "v") + "-" + k.PackageRevision
+}
+
+// Supports reports whether version is in the catalog.
+func (k Kubernetes) Supports(version string) bool {
+	for _, v := range k.Versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+type SSH struct {
+	// BastionKeyFile is the private key kaas logs in to the bastions with,
+	// the clusters of a region with a bastion and the clusters bringing
+	// their own need it.
+	BastionKeyFile string `yaml:"bastion_key_file" json:"bastion_key_file"`
+	// Bastions are the jump hosts of the clusters of each region.
+	Bastions map[string]models.Bastion `yaml:"bastions" json:"bastions"`
+}
+
+// CheckBastion returns what is wrong with bastion b, nothing if it can be
+// used.
+func (s SSH) CheckBastion(b models.Bastion) string {
+	if b.FirstMaster {
+		if b.Address != "" || b.User != "" || b.HostKey != "" {
+			return "a first_master bastion takes no address, user or host_key"
+		}
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(b.Address); err != nil {
+		return fmt.Sprintf("invalid address %q, use host:port", b.Address)
+	}
+	if b.User == "" {
+		return "user is empty"
+	}
+	if !strings.HasPrefix(b.HostKey, "SHA256:") {
+		return fmt.Sprintf("host_key %q must be a SHA256: fingerprint", b.HostKey)
+	}
+	if s.BastionKeyFile == "" {
+		return "the server has no bastion key"
+	}
+	return ""
+}
+
+type Config struct {
+	// Listen is the address the api is served on.
+	Listen string `yaml:"listen" json:"listen"`
+	// Provider is the cloud clusters are built on, openstack or fake.
+	Provider     string       `yaml:"provider" json:"provider"`
+	DB           DB           `yaml:"db" json:"db"`
+	OpenStack    OpenStack    `yaml:"openstack" json:"openstack"`
+	LoadBalancer LoadBalancer `yaml:"loadbalancer" json:"loadbalancer"`
+	Machine      Machine      `yaml:"machine" json:"machine"`
+	Etcd         Etcd         `yaml:"etcd" json:"etcd"`
+	CNI          CNI          `yaml:"cni" json:"cni"`
+	Kubernetes   Kubernetes   `yaml:"kubernetes" json:"kubernetes"`
+	SSH          SSH          `yaml:"ssh" json:"ssh"`
+	// EncryptionKey is the base64 encoded 32 byte key the secrets kaas
+	// stores, like kubeconfigs, are encrypted with.
+	EncryptionKey string `yaml:"encryption_key" json:"encryption_key"`
+}
+
+var (
+	reVersion = regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+$`)
+	reSHA256  = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// EtcdArches are the archs etcd releases are published for.
+var EtcdArches = []string{"amd64", "arm64", "ppc64le", "s390x"}
+
+// Default returns the configuration kaas runs with when nothing is set.
+func Default() *Config {
+	return &Config{
+		Listen:   ":9191",
+		Provider: "openstack",
+		DB: DB{
+			Backend:  "mongodb",
+			MongoURL: "localhost",
+			BoltPath: "kaas.db",
+		},
+		OpenStack: OpenStack{
+			IdentityURL: "https://lon.identity.api.rackspacecloud.com/v2.0/",
+			Region:      "LON",
+		},
+		LoadBalancer: LoadBalancer{
+			Provider: models.LBProviderCloudLB,
+		},
+		Machine: Machine{
+			Flavor: "5",
+			Image:  "e83e244d-af6a-4b68-a4cc-a425897021af",
+		},
+		Etcd: Etcd{
+			Version: "v3.4.16",
+		},
+		CNI: CNI{
+			Plugin:      models.CNICalico,
+			ManifestDir: "manifests",
+		},
+		Kubernetes: Kubernetes{
+			Versions:        []string{"v1.19.12", "v1.20.8", "v1.21.2"},
+			DefaultVersion:  "v1.21.2",
+			PackageRevision: "00",
+		},
+	}
+}
+
+// option is a setting that can be overridden from the environment and the
+// command line.
+type option struct {
+	flag  string
+	env   string
+	usage string
+	value *string
+}
+
+func (c *Config) options() []option {
+	return []option{
+		{"listen", "KAAS_LISTEN", "address the api listens on", &c.Listen},
+		{"provider", "KAAS_PROVIDER", "cloud provider: openstack or fake", &c.Provider},
+		{"db", "KAAS_DB", "storage backend: mongodb, bolt or memory", &c.DB.Backend},
+		{"mongo-url", "KAAS_MONGO_URL", "mongodb server to dial", &c.DB.MongoURL},
+		{"bolt-path", "KAAS_BOLT_PATH", "database file of the bolt backend", &c.DB.BoltPath},
+		{"identity-url", "KAAS_IDENTITY_URL", "openstack identity endpoint", &c.OpenStack.IdentityURL},
+		{"region", "KAAS_REGION", "openstack region clusters are built in", &c.OpenStack.Region},
+		{"lb-provider", "KAAS_LB_PROVIDER", "default lb service of new clusters: cloudlb or octavia", &c.LoadBalancer.Provider},
+		{"octavia-subnet", "KAAS_OCTAVIA_SUBNET", "subnet of the octavia vips and members", &c.LoadBalancer.OctaviaSubnet},
+		{"flavor", "KAAS_FLAVOR", "flavor of the cluster VMs", &c.Machine.Flavor},
+		{"image", "KAAS_IMAGE", "image of the cluster VMs", &c.Machine.Image},
+		{"user-data-dir", "KAAS_USER_DATA_DIR", "directory of cloud-init templates overriding the built in ones", &c.Machine.UserDataDir},
+		{"etcd-version", "KAAS_ETCD_VERSION", "etcd release of external etcd clusters", &c.Etcd.Version},
+		{"cni", "KAAS_CNI", "default CNI of new clusters: calico, flannel, cilium or none", &c.CNI.Plugin},
+		{"cni-manifest-dir", "KAAS_CNI_MANIFEST_DIR", "directory of the CNI manifest templates", &c.CNI.ManifestDir},
+		{"kubernetes-version", "KAAS_KUBERNETES_VERSION", "kubernetes version of new clusters", &c.Kubernetes.DefaultVersion},
+		{"bastion-key-file", "KAAS_BASTION_KEY_FILE", "private key kaas logs in to the bastions with", &c.SSH.BastionKeyFile},
+		{"encryption-key", "KAAS_ENCRYPTION_KEY", "base64 key the stored secrets are encrypted with", &c.EncryptionKey},
+	}
+}
+
+// Load builds the configuration from the command line args, the file named
+// by -config and the environment, and validates it.
+func Load(name string, args []string) (*Config, error) {
+	c := Default()
+
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	path := fs.String("config", os.Getenv("KAAS_CONFIG"), "YAML or JSON configuration file")
+	for _, o := range c.options() {
+		fs.StringVar(o.value, o.flag, *o.value, fmt.Sprintf("%s (%s)", o.usage, o.env))
+	}
+	fs.Parse(args)
+
+	// the file and the environment are read after the flags, which are
+	// applied again on top of them
+	set := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+
+	if *path != "" {
+		if err := c.readFile(*path); err != nil {
+			return nil, err
+		}
+	}
+	for _, o := range c.options() {
+		if v, ok := os.LookupEnv(o.env); ok {
+			*o.value = v
+		}
+	}
+	for name, v := range set {
+		fs.Set(name, v)
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readFile reads path over c. JSON being valid YAML, both are parsed with the
+// YAML decoder; unknown keys are rejected to catch typos.
+func (c *Config) readFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(content, c); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate reports the first invalid setting of c.
+func (c *Config) Validate() error {
+	if c.Listen == "" {
+		return errors.New("listen address is empty")
+	}
+
+	switch c.DB.Backend {
+	case "mongodb":
+		if c.DB.MongoURL == "" {
+			return errors.New("mongodb backend needs a mongo url")
+		}
+	case "bolt":
+		if c.DB.BoltPath == "" {
+			return errors.New("bolt backend needs a bolt path")
+		}
+	case "memory":
+	default:
+		return fmt.Errorf("unknown db backend %q", c.DB.Backend)
+	}
+
+	switch c.Provider {
+	case "openstack":
+		u, err := url.Parse(c.OpenStack.IdentityURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid identity url %q", c.OpenStack.IdentityURL)
+		}
+		if c.OpenStack.Region == "" {
+			return errors.New("openstack region is empty")
+		}
+	case "fake":
+	default:
+		return fmt.Errorf("unknown provider %q", c.Provider)
+	}
+
+	switch c.LoadBalancer.Provider {
+	case models.LBProviderCloudLB:
+	case models.LBProviderOctavia:
+		if c.LoadBalancer.OctaviaSubnet == "" {
+			return errors.New("octavia lb provider needs an octavia subnet")
+		}
+	default:
+		return fmt.Errorf("unknown lb provider %q", c.LoadBalancer.Provider)
+	}
+
+	if c.Machine.Flavor == "" || c.Machine.Image == "" {
+		return errors.New("machine flavor and image must be set")
+	}
+	if c.Machine.UserDataDir != "" {
+		info, err := os.Stat(c.Machine.UserDataDir)
+		if err != nil {
+			return fmt.Errorf("user data dir: %v", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("user data dir %s is not a directory", c.Machine.UserDataDir)
+		}
+	}
+
+	if !strings.HasPrefix(c.Etcd.Version, "v") {
+		return fmt.Errorf("etcd version %q must look like v3.4.16", c.Etcd.Version)
+	}
+	for arch, sum := range c.Etcd.SHA256 {
+		known := false
+		for _, a := range EtcdArches {
+			known = known || a == arch
+		}
+		if !known {
+			return fmt.Errorf("etcd sha256 of unknown arch %q, use one of %s", arch, strings.Join(EtcdArches, ", "))
+		}
+		if !reSHA256.MatchString(sum) {
+			return fmt.Errorf("etcd sha256 of %s must be 64 lowercase hex digits", arch)
+		}
+	}
+
+	known := false
+	for _, plugin := range models.CNIPlugins {
+		known = known || plugin == c.CNI.Plugin
+	}
+	if !known {
+		return fmt.Errorf("unknown cni %q", c.CNI.Plugin)
+	}
+	if c.CNI.ManifestDir == "" {
+		return errors.New("cni manifest dir is empty")
+	}
+	for plugin, sums := range c.CNI.SHA256 {
+		known := false
+		for _, p := range models.CNIPlugins {
+			known = known || (p == plugin && p != models.CNINone)
+		}
+		if !known {
+			return fmt.Errorf("cni sha256 of unknown plugin %q", plugin)
+		}
+		for v, sum := range sums {
+			if !reVersion.MatchString(v) {
+				return fmt.Errorf("cni sha256 of %s version %q must look like v1.2.3", plugin, v)
+			}
+			if !reSHA256.MatchString(sum) {
+				return fmt.Errorf("cni sha256 of %s %s must be 64 lowercase hex digits", plugin, v)
+			}
+		}
+	}
+
+	if len(c.Kubernetes.Versions) == 0 {
+		return errors.New("kubernetes version catalog is empty")
+	}
+	for _, v := range c.Kubernetes.Versions {
+		if !reVersion.MatchString(v) {
+			return fmt.Errorf("kubernetes version %q must look like v1.21.2", v)
+		}
+	}
+	if !c.Kubernetes.Supports(c.Kubernetes.DefaultVersion) {
+		return fmt.Errorf("default kubernetes version %q is not in the catalog", c.Kubernetes.DefaultVersion)
+	}
+	if c.Kubernetes.PackageRevision == "" {
+		return errors.New("kubernetes package revision is empty")
+	}
+
+	for region, b := range c.SSH.Bastions {
+		if problem := c.SSH.CheckBastion(b); problem != "" {
+			return fmt.Errorf("bastion of region %s: %s", region, problem)
+		}
+	}
+
+	if c.EncryptionKey == "" {
+		return errors.New("encryption key is not set, generate one with: head -c 32 /dev/urandom | base64")
+	}
+	if _, err := secret.ParseKey(c.EncryptionKey); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sulochan/kaas/models"
+)
+
+var testKey = base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kaas.yaml")
+	content := `
+listen: ":8000"
+db:
+  backend: memory
+openstack:
+  region: IAD
+machine:
+  flavor: "7"
+kubernetes:
+  default_version: v1.20.8
+encryption_key: ` + testKey + `
+`
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KAAS_CONFIG", "")
+	// the environment wins over the file, the flags over both
+	t.Setenv("KAAS_REGION", "DFW")
+	t.Setenv("KAAS_FLAVOR", "8")
+
+	c, err := Load("kaas", []string{"-config", path, "-flavor", "9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		setting string
+		got     string
+		want    string
+	}{
+		{setting: "default", got: c.Provider, want: "openstack"},
+		{setting: "file", got: c.Listen, want: ":8000"},
+		{setting: "file", got: c.DB.Backend, want: "memory"},
+		{setting: "file", got: c.Kubernetes.DefaultVersion, want: "v1.20.8"},
+		{setting: "environment over file", got: c.OpenStack.Region, want: "DFW"},
+		{setting: "flag over environment", got: c.Machine.Flavor, want: "9"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.setting, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "unknown key", content: "encryption_key: " + testKey + "\nlisen: \":8000\"\n", wantErr: "field lisen not found"},
+		{name: "invalid setting", content: "encryption_key: " + testKey + "\ndb:\n  backend: postgres\n", wantErr: `unknown db backend "postgres"`},
+		{name: "json", content: `{"encryption_key": "` + testKey + `", "cni": {"plugin": "weave"}}`, wantErr: `unknown cni "weave"`},
+	}
+	t.Setenv("KAAS_CONFIG", "")
+	for _, tt := range tests {
+		path := filepath.Join(dir, strings.Replace(tt.name, " ", "-", -1)+".yaml")
+		if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := Load("kaas", []string{"-config", path})
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want %s", tt.name, err, tt.wantErr)
+		}
+	}
+	if _, err := Load("kaas", []string{"-config", filepath.Join(dir, "missing.yaml")}); err == nil {
+		t.Error("loaded a missing config file")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr string
+	}{
+		{name: "defaults", modify: func(c *Config) {}},
+		{name: "no listen address", modify: func(c *Config) { c.Listen = "" }, wantErr: "listen address is empty"},
+		{name: "bolt without a path", modify: func(c *Config) { c.DB = DB{Backend: "bolt"} }, wantErr: "bolt backend needs a bolt path"},
+		{name: "relative identity url", modify: func(c *Config) { c.OpenStack.IdentityURL = "identity/v2.0" }, wantErr: "invalid identity url"},
+		{name: "fake provider without openstack", modify: func(c *Config) { c.Provider = "fake"; c.OpenStack = OpenStack{} }},
+		{name: "unknown provider", modify: func(c *Config) { c.Provider = "aws" }, wantErr: `unknown provider "aws"`},
+		{name: "octavia without a subnet", modify: func(c *Config) { c.LoadBalancer.Provider = models.LBProviderOctavia }, wantErr: "needs an octavia subnet"},
+		{name: "no image", modify: func(c *Config) { c.Machine.Image = "" }, wantErr: "machine flavor and image must be set"},
+		{name: "missing user data dir", modify: func(c *Config) { c.Machine.UserDataDir = "/nonexistent" }, wantErr: "user data dir"},
+		{name: "etcd version without v", modify: func(c *Config) { c.Etcd.Version = "3.4.16" }, wantErr: "must look like v3.4.16"},
+		{name: "etcd sha256 of unknown arch", modify: func(c *Config) { c.Etcd.SHA256 = map[string]string{"386": sum} }, wantErr: `unknown arch "386"`},
+		{name: "invalid etcd sha256", modify: func(c *Config) { c.Etcd.SHA256 = map[string]string{"amd64": "AB"} }, wantErr: "64 lowercase hex digits"},
+		{name: "no cni manifest dir", modify: func(c *Config) { c.CNI.ManifestDir = "" }, wantErr: "cni manifest dir is empty"},
+		{name: "cni sha256 of none", modify: func(c *Config) { c.CNI.SHA256 = map[string]map[string]string{models.CNINone: {"v1.0.0": sum}} }, wantErr: "unknown plugin"},
+		{name: "cni sha256 of an invalid version", modify: func(c *Config) { c.CNI.SHA256 = map[string]map[string]string{models.CNICalico: {"3.24": sum}} }, wantErr: "must look like v1.2.3"},
+		{name: "empty version catalog", modify: func(c *Config) { c.Kubernetes.Versions = nil }, wantErr: "catalog is empty"},
+		{name: "default version outside the catalog", modify: func(c *Config) { c.Kubernetes.DefaultVersion = "v1.22.0" }, wantErr: "not in the catalog"},
+		{name: "invalid bastion", modify: func(c *Config) { c.SSH.Bastions = map[string]models.Bastion{"LON": {Address: "bastion"}} }, wantErr: "bastion of region LON: invalid address"},
+		{name: "no encryption key", modify: func(c *Config) { c.EncryptionKey = "" }, wantErr: "encryption key is not set"},
+		{name: "short encryption key", modify: func(c *Config) { c.EncryptionKey = base64.StdEncoding.EncodeToString(make([]byte, 16)) }, wantErr: "32"},
+	}
+	for _, tt := range tests {
+		c := Default()
+		c.EncryptionKey = testKey
+		tt.modify(c)
+		err := c.Validate()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want %s", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckBastion(t *testing.T) {
+	tests := []struct {
+		name        string
+		keyFile     string
+		bastion     models.Bastion
+		wantProblem string
+	}{
+		{name: "jump host", keyFile: "bastion.key", bastion: models.Bastion{Address: "bastion:22", User: "kaas", HostKey: "SHA256:abc"}},
+		{name: "first master", bastion: models.Bastion{FirstMaster: true}},
+		{name: "first master with an address", bastion: models.Bastion{FirstMaster: true, Address: "bastion:22"}, wantProblem: "takes no address"},
+		{name: "no port", keyFile: "bastion.key", bastion: models.Bastion{Address: "bastion", User: "kaas", HostKey: "SHA256:abc"}, wantProblem: "use host:port"},
+		{name: "no user", keyFile: "bastion.key", bastion: models.Bastion{Address: "bastion:22", HostKey: "SHA256:abc"}, wantProblem: "user is empty"},
+		{name: "md5 host key", keyFile: "bastion.key", bastion: models.Bastion{Address: "bastion:22", User: "kaas", HostKey: "ab:cd"}, wantProblem: "SHA256: fingerprint"},
+		{name: "no bastion key", bastion: models.Bastion{Address: "bastion:22", User: "kaas", HostKey: "SHA256:abc"}, wantProblem: "no bastion key"},
+	}
+	for _, tt := range tests {
+		s := SSH{BastionKeyFile: tt.keyFile}
+		problem := s.CheckBastion(tt.bastion)
+		if tt.wantProblem == "" && problem != "" || !strings.Contains(problem, tt.wantProblem) {
+			t.Errorf("%s: got problem %q, want %q", tt.name, problem, tt.wantProblem)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+// Package backend opens the db.Store selected by configuration.
+package backend
+
+import (
+	"fmt"
+
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/db/boltdb"
+	"github.com/sulochan/kaas/db/memory"
+	"github.com/sulochan/kaas/db/mongodb"
+)
+
+// Options selects and configures a storage backend.
+type Options struct {
+	// Backend is one of mongodb, bolt or memory.
+	Backend string
+	// MongoURL is the server dialed by the mongodb backend.
+	MongoURL string
+	// BoltPath is the database file used by the bolt backend.
+	BoltPath string
+}
+
+// Open returns the store described by opts.
+func Open(opts Options) (db.Store, error) {
+	switch opts.Backend {
+	case "mongodb":
+		return mongodb.New(opts.MongoURL)
+	case "bolt":
+		return boltdb.New(opts.BoltPath)
+	case "memory":
+		return memory.New(), nil
+	}
+	return nil, fmt.Errorf("unknown db backend %q", opts.Backend)
+}
@@ -0,0 +1,341 @@
+// Package boltdb is an embedded, single file implementation of db.Store built
+// on bbolt. It is meant for small installs that do not want to run MongoDB.
+// Records are stored bson encoded so they have the same shape as the
+// documents in the mongodb backend.
+package boltdb
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/models"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	clustersBucket   = []byte("clusters")
+	nodesBucket      = []byte("nodes")
+	jobsBucket       = []byte("jobs")
+	operationsBucket = []byte("operations")
+)
+
+// Store is the bbolt implementation of db.Store.
+type Store struct {
+	db *bolt.DB
+}
+
+// New opens (creating if needed) the database file at path.
+func New(path string) (*Store, error) {
+	bdb, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{clustersBucket, nodesBucket, jobsBucket, operationsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		bdb.Close()
+		return nil, err
+	}
+	return &Store{db: bdb}, nil
+}
+
+// Close closes the database file.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// sequenceKey returns the next auto increment key of bucket b.
+func sequenceKey(b *bolt.Bucket) ([]byte, error) {
+	id, err := b.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key, nil
+}
+
+func put(b *bolt.Bucket, key []byte, v interface{}) error {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+func (s *Store) CreateNewCluster(cluster *models.Cluster) error {
+	cluster.Revision = 1
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket(clustersBucket), []byte(cluster.UUID), cluster)
+	})
+}
+
+// filterClusters returns every cluster for which keep returns true.
+func (s *Store) filterClusters(keep func(cluster *models.Cluster) bool) ([]models.Cluster, error) {
+	clusters := []models.Cluster{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(clustersBucket).ForEach(func(k, v []byte) error {
+			cluster := models.Cluster{}
+			if err := bson.Unmarshal(v, &cluster); err != nil {
+				return err
+			}
+			if keep(&cluster) {
+				clusters = append(clusters, cluster)
+			}
+			return nil
+		})
+	})
+	return clusters, err
+}
+
+func (s *Store) GetAllClusters(projectid string) ([]models.Cluster, error) {
+	return s.filterClusters(func(cluster *models.Cluster) bool {
+		return cluster.ProjectId == projectid && cluster.Deleted == 0
+	})
+}
+
+func (s *Store) GetProvisioningClusters() ([]models.Cluster, error) {
+	return s.filterClusters(func(cluster *models.Cluster) bool {
+		return cluster.Provisioning.Active && cluster.Deleted == 0
+	})
+}
+
+// getCluster decodes the live cluster uuid of projectid from b.
+func getCluster(b *bolt.Bucket, projectid string, uuid string, cluster *models.Cluster) error {
+	v := b.Get([]byte(uuid))
+	if v == nil {
+		return db.NotFound
+	}
+	if err := bson.Unmarshal(v, cluster); err != nil {
+		return err
+	}
+	if cluster.ProjectId != projectid || cluster.Deleted != 0 {
+		return db.NotFound
+	}
+	return nil
+}
+
+func (s *Store) GetCluster(projectid string, uuid string) (*models.Cluster, error) {
+	cluster := models.Cluster{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return getCluster(tx.Bucket(clustersBucket), projectid, uuid, &cluster)
+	})
+	return &cluster, err
+}
+
+func (s *Store) UpdateCluster(cluster *models.Cluster) error {
+	revision := cluster.Revision
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(clustersBucket)
+		current := models.Cluster{}
+		if err := getCluster(b, cluster.ProjectId, cluster.UUID, &current); err != nil {
+			return err
+		}
+		if current.Revision != revision {
+			return db.Conflict
+		}
+		cluster.Revision = revision + 1
+		return put(b, []byte(cluster.UUID), cluster)
+	})
+	if err != nil {
+		cluster.Revision = revision
+	}
+	return err
+}
+
+// RegisterNode registers a new node in the database
+func (s *Store) RegisterNode(node *models.Node) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(nodesBucket)
+		key, err := sequenceKey(b)
+		if err != nil {
+			return err
+		}
+		return put(b, key, node)
+	})
+}
+
+// GetNextCommand returns the next command to be executed on the node
+func (s *Store) GetNextCommand(projectid string, uuid string) (*models.Job, error) {
+	job := models.Job{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(jobsBucket).Get([]byte(uuid))
+		if v == nil {
+			return db.NotFound
+		}
+		if err := bson.Unmarshal(v, &job); err != nil {
+			return err
+		}
+		if job.ProjectId != projectid || job.Deleted != 0 {
+			return db.NotFound
+		}
+		return nil
+	})
+	return &job, err
+}
+
+// UpdateJob updates the job in the database
+func (s *Store) UpdateJob(job *models.Job) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		if b.Get([]byte(job.UUID)) == nil {
+			return db.NotFound
+		}
+		return put(b, []byte(job.UUID), job)
+	})
+}
+
+func (s *Store) CreateOperation(op *models.Operation) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket(operationsBucket), []byte(op.ID), op)
+	})
+}
+
+func (s *Store) GetOperation(projectid string, id string) (*models.Operation, error) {
+	op := models.Operation{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(operationsBucket).Get([]byte(id))
+		if v == nil {
+			return db.NotFound
+		}
+		if err := bson.Unmarshal(v, &op); err != nil {
+			return err
+		}
+		if op.ProjectId != projectid {
+			return db.NotFound
+		}
+		return nil
+	})
+	return &op, err
+}
+
+func (s *Store) GetClusterOperations(projectid string, clusterUUID string) ([]models.Operation, error) {
+	ops := []models.Operation{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(operationsBucket).ForEach(func(k, v []byte) error {
+			op := models.Operation{}
+			if err := bson.Unmarshal(v, &op); err != nil {
+				return err
+			}
+			if op.ProjectId == projectid && op.ClusterUUID == clusterUUID {
+				ops = append(ops, op)
+			}
+			return nil
+		})
+	})
+	sort.Slice(ops, func(i, j int) bool { return ops[i].CreatedAt.Before(ops[j].CreatedAt) })
+	return ops, err
+}
+
+func (s *Store) UpdateOperation(op *models.Operation) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(operationsBucket)
+		v := b.Get([]byte(op.ID))
+		if v == nil {
+			return db.NotFound
+		}
+		current := models.Operation{}
+		if err := bson.Unmarshal(v, &current); err != nil {
+			return err
+		}
+		if current.ProjectId != op.ProjectId {
+			return db.NotFound
+		}
+		return put(b, []byte(op.ID), op)
+	})
+}
+
+// Dump returns every record in the database, deleted ones included.
+func (s *Store) Dump() (*db.Snapshot, error) {
+	snapshot := &db.Snapshot{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(clustersBucket).ForEach(func(k, v []byte) error {
+			cluster := models.Cluster{}
+			if err := bson.Unmarshal(v, &cluster); err != nil {
+				return err
+			}
+			snapshot.Clusters = append(snapshot.Clusters, cluster)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(nodesBucket).ForEach(func(k, v []byte) error {
+			node := models.Node{}
+			if err := bson.Unmarshal(v, &node); err != nil {
+				return err
+			}
+			snapshot.Nodes = append(snapshot.Nodes, node)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			job := models.Job{}
+			if err := bson.Unmarshal(v, &job); err != nil {
+				return err
+			}
+			snapshot.Jobs = append(snapshot.Jobs, job)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(operationsBucket).ForEach(func(k, v []byte) error {
+			op := models.Operation{}
+			if err := bson.Unmarshal(v, &op); err != nil {
+				return err
+			}
+			snapshot.Operations = append(snapshot.Operations, op)
+			return nil
+		})
+	})
+	return snapshot, err
+}
+
+// Restore writes every record of snapshot in a single transaction.
+func (s *Store) Restore(snapshot *db.Snapshot) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		clusters := tx.Bucket(clustersBucket)
+		for i := range snapshot.Clusters {
+			if err := put(clusters, []byte(snapshot.Clusters[i].UUID), &snapshot.Clusters[i]); err != nil {
+				return err
+			}
+		}
+		nodes := tx.Bucket(nodesBucket)
+		for i := range snapshot.Nodes {
+			key, err := sequenceKey(nodes)
+			if err != nil {
+				return err
+			}
+			if err := put(nodes, key, &snapshot.Nodes[i]); err != nil {
+				return err
+			}
+		}
+		jobs := tx.Bucket(jobsBucket)
+		for i := range snapshot.Jobs {
+			if err := put(jobs, []byte(snapshot.Jobs[i].UUID), &snapshot.Jobs[i]); err != nil {
+				return err
+			}
+		}
+		ops := tx.Bucket(operationsBucket)
+		for i := range snapshot.Operations {
+			if err := put(ops, []byte(snapshot.Operations[i].ID), &snapshot.Operations[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,19 @@
+package boltdb
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/db/dbtest"
+)
+
+func TestStore(t *testing.T) {
+	dbtest.TestStore(t, func(t *testing.T) db.Store {
+		s, err := New(filepath.Join(t.TempDir(), "kaas.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
@@ -0,0 +1,79 @@
+// Package db defines the persistence interfaces used by the API layer.
+// Concrete backends live in the sub packages (mongodb, boltdb, memory).
+package db
+
+import (
+	"errors"
+
+	"github.com/sulochan/kaas/models"
+)
+
+var (
+	// NotFound is returned by every backend when a lookup matches nothing.
+	NotFound = errors.New("Not Found")
+	// Conflict is returned by UpdateCluster when the stored revision no
+	// longer matches the revision of the cluster being written.
+	Conflict = errors.New("Conflict")
+)
+
+// ClusterStore persists k8s clusters. Clusters are scoped by project id and
+// soft deleted by setting Deleted to 1.
+//
+// UpdateCluster is a compare-and-swap on Revision: it only succeeds if the
+// stored cluster still has the revision of the one passed in, in which case
+// the revision is incremented on both. Otherwise it returns Conflict and the
+// caller should refetch, see UpdateClusterWithRetry.
+type ClusterStore interface {
+	CreateNewCluster(cluster *models.Cluster) error
+	GetAllClusters(projectid string) ([]models.Cluster, error)
+	GetCluster(projectid string, uuid string) (*models.Cluster, error)
+	UpdateCluster(cluster *models.Cluster) error
+	// GetProvisioningClusters returns the clusters of every project whose
+	// provisioning is still active.
+	GetProvisioningClusters() ([]models.Cluster, error)
+}
+
+// NodeStore persists registered nodes.
+type NodeStore interface {
+	RegisterNode(node *models.Node) error
+}
+
+// JobStore persists jobs executed on registered nodes.
+type JobStore interface {
+	GetNextCommand(projectid string, uuid string) (*models.Job, error)
+	UpdateJob(job *models.Job) error
+}
+
+// OperationStore persists the operations tracking long running cluster
+// changes. Operations are scoped by project id.
+type OperationStore interface {
+	CreateOperation(op *models.Operation) error
+	GetOperation(projectid string, id string) (*models.Operation, error)
+	GetClusterOperations(projectid string, clusterUUID string) ([]models.Operation, error)
+	UpdateOperation(op *models.Operation) error
+}
+
+// Store is the full set of operations a backend must implement.
+type Store interface {
+	ClusterStore
+	NodeStore
+	JobStore
+	OperationStore
+	Close() error
+}
+
+// Snapshot is a backend independent copy of every record in a store,
+// deleted ones included. It is used to move data between backends.
+type Snapshot struct {
+	Clusters   []models.Cluster   `json:"clusters"`
+	Nodes      []models.Node      `json:"nodes"`
+	Jobs       []models.Job       `json:"jobs"`
+	Operations []models.Operation `json:"operations"`
+}
+
+// Dumper is implemented by backends that can export and import all of their
+// records at once.
+type Dumper interface {
+	Dump() (*Snapshot, error)
+	Restore(snapshot *Snapshot) error
+}
@@ -0,0 +1,298 @@
+// Package dbtest is the conformance suite of the db.Store backends.
+package dbtest
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/models"
+)
+
+// TestStore runs the conformance suite against stores returned by newStore,
+// a new empty one for every test.
+func TestStore(t *testing.T, newStore func(t *testing.T) db.Store) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s db.Store)
+	}{
+		{"Clusters", testClusters},
+		{"UpdateClusterRevision", testUpdateClusterRevision},
+		{"ProvisioningClusters", testProvisioningClusters},
+		{"Operations", testOperations},
+		{"Jobs", testJobs},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStore(t)
+			defer s.Close()
+			tt.test(t, s)
+		})
+	}
+	t.Run("DumpRestore", func(t *testing.T) {
+		testDumpRestore(t, newStore)
+	})
+}
+
+func createCluster(t *testing.T, s db.Store, cluster *models.Cluster) {
+	t.Helper()
+	if err := s.CreateNewCluster(cluster); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func uuids(clusters []models.Cluster) []string {
+	list := []string{}
+	for _, c := range clusters {
+		list = append(list, c.UUID)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testClusters(t *testing.T, s db.Store) {
+	created := &models.Cluster{ProjectId: "p1", UUID: "c1", Name: "first", Worker: 2,
+		MasterNodes: []*models.Node{{UUID: "server-1", Name: "k8s-first-master-1", HostKeys: []string{"SHA256:x"}}}}
+	createCluster(t, s, created)
+	if created.Revision != 1 {
+		t.Errorf("created at revision %d, want 1", created.Revision)
+	}
+	createCluster(t, s, &models.Cluster{ProjectId: "p1", UUID: "c2", Name: "second"})
+	createCluster(t, s, &models.Cluster{ProjectId: "p2", UUID: "c3", Name: "other project"})
+
+	got, err := s.GetCluster("p1", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "first" || got.Worker != 2 || got.Revision != 1 || len(got.MasterNodes) != 1 ||
+		got.MasterNodes[0].Name != "k8s-first-master-1" || len(got.MasterNodes[0].HostKeys) != 1 {
+		t.Errorf("got %+v, want the created cluster", got)
+	}
+
+	lookups := []struct {
+		name      string
+		projectid string
+		uuid      string
+		wantErr   error
+	}{
+		{name: "own project", projectid: "p2", uuid: "c3"},
+		{name: "other project", projectid: "p2", uuid: "c1", wantErr: db.NotFound},
+		{name: "unknown", projectid: "p1", uuid: "c9", wantErr: db.NotFound},
+	}
+	for _, tt := range lookups {
+		if _, err := s.GetCluster(tt.projectid, tt.uuid); err != tt.wantErr {
+			t.Errorf("get %s: got error %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	lists := []struct {
+		projectid string
+		want      []string
+	}{
+		{projectid: "p1", want: []string{"c1", "c2"}},
+		{projectid: "p2", want: []string{"c3"}},
+		{projectid: "p3", want: []string{}},
+	}
+	for _, tt := range lists {
+		clusters, err := s.GetAllClusters(tt.projectid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := uuids(clusters); !equal(got, tt.want) {
+			t.Errorf("clusters of %s: got %v, want %v", tt.projectid, got, tt.want)
+		}
+	}
+
+	// clusters are deleted by marking them
+	got.Deleted = 1
+	got.Status = models.StatusDeleted
+	if err := s.UpdateCluster(got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetCluster("p1", "c1"); err != db.NotFound {
+		t.Errorf("get deleted cluster: got error %v, want NotFound", err)
+	}
+	clusters, err := s.GetAllClusters("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := uuids(clusters); !equal(got, []string{"c2"}) {
+		t.Errorf("clusters of p1 after a delete: got %v, want [c2]", got)
+	}
+	if err := s.UpdateCluster(got); err != db.NotFound {
+		t.Errorf("update deleted cluster: got error %v, want NotFound", err)
+	}
+}
+
+func testUpdateClusterRevision(t *testing.T, s db.Store) {
+	createCluster(t, s, &models.Cluster{ProjectId: "p", UUID: "c1", Name: "first"})
+
+	tests := []struct {
+		name         string
+		projectid    string
+		uuid         string
+		revision     int64
+		wantErr      error
+		wantRevision int64
+	}{
+		{name: "current revision", projectid: "p", uuid: "c1", revision: 1, wantRevision: 2},
+		{name: "stale revision", projectid: "p", uuid: "c1", revision: 1, wantErr: db.Conflict, wantRevision: 1},
+		{name: "next revision", projectid: "p", uuid: "c1", revision: 2, wantRevision: 3},
+		{name: "future revision", projectid: "p", uuid: "c1", revision: 5, wantErr: db.Conflict, wantRevision: 5},
+		{name: "unknown cluster", projectid: "p", uuid: "c2", revision: 1, wantErr: db.NotFound, wantRevision: 1},
+		{name: "other project", projectid: "q", uuid: "c1", revision: 3, wantErr: db.NotFound, wantRevision: 3},
+	}
+	for _, tt := range tests {
+		update := &models.Cluster{ProjectId: tt.projectid, UUID: tt.uuid, Name: tt.name, Revision: tt.revision}
+		if err := s.UpdateCluster(update); err != tt.wantErr {
+			t.Fatalf("%s: got error %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if update.Revision != tt.wantRevision {
+			t.Errorf("%s: revision %d after the update, want %d", tt.name, update.Revision, tt.wantRevision)
+		}
+	}
+
+	stored, err := s.GetCluster("p", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Revision != 3 || stored.Name != "next revision" {
+		t.Errorf("stored %q at revision %d, want next revision at 3", stored.Name, stored.Revision)
+	}
+}
+
+func testProvisioningClusters(t *testing.T, s db.Store) {
+	createCluster(t, s, &models.Cluster{ProjectId: "p1", UUID: "active", Provisioning: models.Provisioning{Active: true}})
+	createCluster(t, s, &models.Cluster{ProjectId: "p2", UUID: "other project", Provisioning: models.Provisioning{Active: true}})
+	createCluster(t, s, &models.Cluster{ProjectId: "p1", UUID: "done"})
+	createCluster(t, s, &models.Cluster{ProjectId: "p1", UUID: "deleted", Deleted: 1, Provisioning: models.Provisioning{Active: true}})
+
+	clusters, err := s.GetProvisioningClusters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := uuids(clusters), []string{"active", "other project"}; !equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func testOperations(t *testing.T, s db.Store) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	ops := []*models.Operation{
+		{ID: "o1", ProjectId: "p1", ClusterUUID: "c1", Type: models.OperationCreate, State: models.OperationPending, CreatedAt: now},
+		{ID: "o2", ProjectId: "p1", ClusterUUID: "c1", Type: models.OperationUpdate, State: models.OperationPending, CreatedAt: now},
+		{ID: "o3", ProjectId: "p1", ClusterUUID: "c2", Type: models.OperationCreate, State: models.OperationPending, CreatedAt: now},
+		{ID: "o4", ProjectId: "p2", ClusterUUID: "c1", Type: models.OperationCreate, State: models.OperationPending, CreatedAt: now},
+	}
+	for _, op := range ops {
+		if err := s.CreateOperation(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	op, err := s.GetOperation("p1", "o1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.Type != models.OperationCreate || !op.CreatedAt.Equal(now) {
+		t.Errorf("got %+v, want the created operation", op)
+	}
+	if _, err := s.GetOperation("p2", "o1"); err != db.NotFound {
+		t.Errorf("operation of another project: got error %v, want NotFound", err)
+	}
+
+	op.State = models.OperationSucceeded
+	op.Progress = 100
+	if err := s.UpdateOperation(op); err != nil {
+		t.Fatal(err)
+	}
+	if op, err := s.GetOperation("p1", "o1"); err != nil || op.State != models.OperationSucceeded || op.Progress != 100 {
+		t.Errorf("got %+v, %v after the update", op, err)
+	}
+	if err := s.UpdateOperation(&models.Operation{ID: "o1", ProjectId: "p2"}); err != db.NotFound {
+		t.Errorf("update operation of another project: got error %v, want NotFound", err)
+	}
+
+	list, err := s.GetClusterOperations("p1", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, op := range list {
+		ids = append(ids, op.ID)
+	}
+	sort.Strings(ids)
+	if !equal(ids, []string{"o1", "o2"}) {
+		t.Errorf("operations of c1: got %v, want [o1 o2]", ids)
+	}
+}
+
+func testJobs(t *testing.T, s db.Store) {
+	if err := s.RegisterNode(&models.Node{UUID: "n1", Name: "node-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetNextCommand("p1", "n1"); err != db.NotFound {
+		t.Errorf("next command without jobs: got error %v, want NotFound", err)
+	}
+}
+
+func testDumpRestore(t *testing.T, newStore func(t *testing.T) db.Store) {
+	from := newStore(t)
+	defer from.Close()
+	dumper, ok := from.(db.Dumper)
+	if !ok {
+		t.Skip("store cannot dump")
+	}
+	createCluster(t, from, &models.Cluster{ProjectId: "p1", UUID: "c1", Name: "live",
+		MasterNodes: []*models.Node{{UUID: "server-1", Name: "k8s-live-master-1"}}})
+	createCluster(t, from, &models.Cluster{ProjectId: "p1", UUID: "c2", Name: "deleted", Deleted: 1})
+	if err := from.CreateOperation(&models.Operation{ID: "o1", ProjectId: "p1", ClusterUUID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := dumper.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Clusters) != 2 || len(snapshot.Operations) != 1 {
+		t.Fatalf("dumped %d clusters and %d operations, want 2 and 1", len(snapshot.Clusters), len(snapshot.Operations))
+	}
+
+	to := newStore(t)
+	defer to.Close()
+	if err := to.(db.Dumper).Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	got, err := to.GetCluster("p1", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "live" || got.Revision != 1 || len(got.MasterNodes) != 1 {
+		t.Errorf("restored %+v, want the dumped cluster", got)
+	}
+	if _, err := to.GetCluster("p1", "c2"); err != db.NotFound {
+		t.Errorf("restored deleted cluster: got error %v, want NotFound", err)
+	}
+	if _, err := to.GetOperation("p1", "o1"); err != nil {
+		t.Errorf("restored operation: %v", err)
+	}
+	again, err := to.(db.Dumper).Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.Clusters) != 2 {
+		t.Errorf("dumped %d clusters after a restore, want 2", len(again.Clusters))
+	}
+}
@@ -0,0 +1,300 @@
+// Package memory is an in-memory implementation of db.Store. It keeps the
+// same projectid/deleted semantics as the mongodb backend and is meant for
+// tests and local demos; nothing survives a restart.
+package memory
+
+import (
+	"sync"
+
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/models"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Store is the in-memory implementation of db.Store.
+type Store struct {
+	mu       sync.RWMutex
+	clusters []*models.Cluster
+	nodes    []*models.Node
+	jobs     []*models.Job
+	ops      []*models.Operation
+}
+
+// New returns an empty Store.
+func New() *Store {
+	return &Store{}
+}
+
+// Close is a no-op, it only exists to satisfy db.Store.
+func (s *Store) Close() error {
+	return nil
+}
+
+// clone deep copies in into out by round tripping through bson, so callers
+// never share memory with the store, just like with a real database.
+func clone(in, out interface{}) error {
+	data, err := bson.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, out)
+}
+
+func (s *Store) findCluster(projectid string, uuid string) *models.Cluster {
+	for _, c := range s.clusters {
+		if c.ProjectId == projectid && c.UUID == uuid && c.Deleted == 0 {
+			return c
+		}
+	}
+	return nil
+}
+
+func (s *Store) CreateNewCluster(cluster *models.Cluster) error {
+	cluster.Revision = 1
+	c := &models.Cluster{}
+	if err := clone(cluster, c); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clusters = append(s.clusters, c)
+	return nil
+}
+
+func (s *Store) GetAllClusters(projectid string) ([]models.Cluster, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	clusters := []models.Cluster{}
+	for _, c := range s.clusters {
+		if c.ProjectId != projectid || c.Deleted != 0 {
+			continue
+		}
+		cluster := models.Cluster{}
+		if err := clone(c, &cluster); err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters, nil
+}
+
+func (s *Store) GetCluster(projectid string, uuid string) (*models.Cluster, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cluster := models.Cluster{}
+	c := s.findCluster(projectid, uuid)
+	if c == nil {
+		return &cluster, db.NotFound
+	}
+	err := clone(c, &cluster)
+	return &cluster, err
+}
+
+func (s *Store) GetProvisioningClusters() ([]models.Cluster, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	clusters := []models.Cluster{}
+	for _, c := range s.clusters {
+		if !c.Provisioning.Active || c.Deleted != 0 {
+			continue
+		}
+		cluster := models.Cluster{}
+		if err := clone(c, &cluster); err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters, nil
+}
+
+func (s *Store) UpdateCluster(cluster *models.Cluster) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.findCluster(cluster.ProjectId, cluster.UUID)
+	if c == nil {
+		return db.NotFound
+	}
+	if c.Revision != cluster.Revision {
+		return db.Conflict
+	}
+	updated := models.Cluster{}
+	if err := clone(cluster, &updated); err != nil {
+		return err
+	}
+	updated.Revision++
+	*c = updated
+	cluster.Revision = updated.Revision
+	return nil
+}
+
+// RegisterNode registers a new node in the store
+func (s *Store) RegisterNode(node *models.Node) error {
+	n := &models.Node{}
+	if err := clone(node, n); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nodes = append(s.nodes, n)
+	return nil
+}
+
+// GetNextCommand returns the next command to be executed on the node
+func (s *Store) GetNextCommand(projectid string, uuid string) (*models.Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	job := models.Job{}
+	for _, j := range s.jobs {
+		if j.ProjectId == projectid && j.UUID == uuid && j.Deleted == 0 {
+			err := clone(j, &job)
+			return &job, err
+		}
+	}
+	return &job, db.NotFound
+}
+
+// UpdateJob updates the job in the store
+func (s *Store) UpdateJob(job *models.Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.UUID == job.UUID {
+			updated := models.Job{}
+			if err := clone(job, &updated); err != nil {
+				return err
+			}
+			*j = updated
+			return nil
+		}
+	}
+	return db.NotFound
+}
+
+func (s *Store) CreateOperation(op *models.Operation) error {
+	o := &models.Operation{}
+	if err := clone(op, o); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops = append(s.ops, o)
+	return nil
+}
+
+func (s *Store) GetOperation(projectid string, id string) (*models.Operation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	op := models.Operation{}
+	for _, o := range s.ops {
+		if o.ProjectId == projectid && o.ID == id {
+			err := clone(o, &op)
+			return &op, err
+		}
+	}
+	return &op, db.NotFound
+}
+
+func (s *Store) GetClusterOperations(projectid string, clusterUUID string) ([]models.Operation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ops := []models.Operation{}
+	for _, o := range s.ops {
+		if o.ProjectId != projectid || o.ClusterUUID != clusterUUID {
+			continue
+		}
+		op := models.Operation{}
+		if err := clone(o, &op); err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+func (s *Store) UpdateOperation(op *models.Operation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range s.ops {
+		if o.ProjectId == op.ProjectId && o.ID == op.ID {
+			updated := models.Operation{}
+			if err := clone(op, &updated); err != nil {
+				return err
+			}
+			*o = updated
+			return nil
+		}
+	}
+	return db.NotFound
+}
+
+// Dump returns every record in the store, deleted ones included.
+func (s *Store) Dump() (*db.Snapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snapshot := &db.Snapshot{}
+	for _, c := range s.clusters {
+		cluster := models.Cluster{}
+		if err := clone(c, &cluster); err != nil {
+			return nil, err
+		}
+		snapshot.Clusters = append(snapshot.Clusters, cluster)
+	}
+	for _, n := range s.nodes {
+		node := models.Node{}
+		if err := clone(n, &node); err != nil {
+			return nil, err
+		}
+		snapshot.Nodes = append(snapshot.Nodes, node)
+	}
+	for _, j := range s.jobs {
+		job := models.Job{}
+		if err := clone(j, &job); err != nil {
+			return nil, err
+		}
+		snapshot.Jobs = append(snapshot.Jobs, job)
+	}
+	for _, o := range s.ops {
+		op := models.Operation{}
+		if err := clone(o, &op); err != nil {
+			return nil, err
+		}
+		snapshot.Operations = append(snapshot.Operations, op)
+	}
+	return snapshot, nil
+}
+
+// Restore adds every record of snapshot to the store.
+func (s *Store) Restore(snapshot *db.Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range snapshot.Clusters {
+		c := &models.Cluster{}
+		if err := clone(&snapshot.Clusters[i], c); err != nil {
+			return err
+		}
+		s.clusters = append(s.clusters, c)
+	}
+	for i := range snapshot.Nodes {
+		n := &models.Node{}
+		if err := clone(&snapshot.Nodes[i], n); err != nil {
+			return err
+		}
+		s.nodes = append(s.nodes, n)
+	}
+	for i := range snapshot.Jobs {
+		j := &models.Job{}
+		if err := clone(&snapshot.Jobs[i], j); err != nil {
+			return err
+		}
+		s.jobs = append(s.jobs, j)
+	}
+	for i := range snapshot.Operations {
+		o := &models.Operation{}
+		if err := clone(&snapshot.Operations[i], o); err != nil {
+			return err
+		}
+		s.ops = append(s.ops, o)
+	}
+	return nil
+}
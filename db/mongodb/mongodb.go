@@ -1,9 +1,9 @@
 package mongodb
 
 import (
-	"errors"
 	"fmt"
 
+	"github.com/sulochan/kaas/db"
 	"github.com/sulochan/kaas/models"
 
 	"gopkg.in/mgo.v2"
@@ -12,37 +12,51 @@ import (
 
 const dbname = "kaas"
 
-var mongoSession *mgo.Session
-
-var (
-	NotFound = errors.New("Not Found")
-)
+// Store is the MongoDB implementation of db.Store.
+type Store struct {
+	session *mgo.Session
+}
 
-func init() {
-	//conf := config.GetConfig()
-	Msession, err := mgo.Dial("localhost")
+// New dials the mongodb server at url and returns a ready to use Store.
+func New(url string) (*Store, error) {
+	session, err := mgo.Dial(url)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if err := session.Ping(); err != nil {
+		session.Close()
+		return nil, err
 	}
-	if err := Msession.Ping(); err != nil {
-		panic(err)
+	session.SetMode(mgo.Monotonic, true)
+	return &Store{session: session}, nil
+}
+
+// Close closes the underlying mongodb session.
+func (s *Store) Close() error {
+	s.session.Close()
+	return nil
+}
+
+func notFound(err error) error {
+	if err == mgo.ErrNotFound {
+		return db.NotFound
 	}
-	Msession.SetMode(mgo.Monotonic, true)
-	mongoSession = Msession
+	return err
 }
 
-func CreateNewCluster(cluster *models.Cluster) error {
+func (s *Store) CreateNewCluster(cluster *models.Cluster) error {
 	fmt.Println("Create new cluster got called.")
-	session := mongoSession.Copy()
+	session := s.session.Copy()
 	defer session.Close()
 	coll := session.DB(dbname).C("clusters")
+	cluster.Revision = 1
 	err := coll.Insert(cluster)
 	return err
 }
 
-func GetAllClusters(projectid string) ([]models.Cluster, error) {
+func (s *Store) GetAllClusters(projectid string) ([]models.Cluster, error) {
 	fmt.Println("Get all new cluster got called.")
-	session := mongoSession.Copy()
+	session := s.session.Copy()
 	defer session.Close()
 	clusters := []models.Cluster{}
 	coll := session.DB(dbname).C("clusters")
@@ -50,29 +64,69 @@ func GetAllClusters(projectid string) ([]models.Cluster, error) {
 	return clusters, err
 }
 
-func GetCluster(projectid string, uuid string) (*models.Cluster, error) {
-	session := mongoSession.Copy()
+func (s *Store) GetCluster(projectid string, uuid string) (*models.Cluster, error) {
+	session := s.session.Copy()
 	defer session.Close()
 	cluster := models.Cluster{}
 	coll := session.DB(dbname).C("clusters")
 	err := coll.Find(bson.M{"projectid": projectid, "uuid": uuid, "deleted": 0}).One(&cluster)
-	return &cluster, err
+	return &cluster, notFound(err)
 }
 
-func UpdateCluster(cluster *models.Cluster) error {
-	session := mongoSession.Copy()
+func (s *Store) GetProvisioningClusters() ([]models.Cluster, error) {
+	session := s.session.Copy()
 	defer session.Close()
+	clusters := []models.Cluster{}
 	coll := session.DB(dbname).C("clusters")
+	err := coll.Find(bson.M{"provisioning.active": true, "deleted": 0}).All(&clusters)
+	return clusters, err
+}
+
+// updateQuery matches the stored cluster only while it is at the revision
+// of cluster.
+func updateQuery(cluster *models.Cluster) bson.M {
 	query := bson.M{"projectid": cluster.ProjectId, "uuid": cluster.UUID, "deleted": 0}
+	if cluster.Revision == 0 {
+		// documents written before revisions existed have no such field
+		query["revision"] = bson.M{"$in": []interface{}{0, nil}}
+	} else {
+		query["revision"] = cluster.Revision
+	}
+	return query
+}
+
+func (s *Store) UpdateCluster(cluster *models.Cluster) error {
+	session := s.session.Copy()
+	defer session.Close()
+	coll := session.DB(dbname).C("clusters")
+	query := updateQuery(cluster)
+
+	revision := cluster.Revision
+	cluster.Revision = revision + 1
 	change := bson.M{"$set": cluster}
 
 	err := coll.Update(query, change)
-	return err
+	if err == nil {
+		return nil
+	}
+	cluster.Revision = revision
+	if err != mgo.ErrNotFound {
+		return err
+	}
+
+	n, err := coll.Find(bson.M{"projectid": cluster.ProjectId, "uuid": cluster.UUID, "deleted": 0}).Count()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return db.Conflict
+	}
+	return db.NotFound
 }
 
 // RegisterNode registers a new node in the database
-func RegisterNode(node *models.Node) error {
-	session := mongoSession.Copy()
+func (s *Store) RegisterNode(node *models.Node) error {
+	session := s.session.Copy()
 	defer session.Close()
 	coll := session.DB(dbname).C("nodes")
 	err := coll.Insert(node)
@@ -80,22 +134,105 @@ func RegisterNode(node *models.Node) error {
 }
 
 // GetNextCommand returns the next command to be executed on the node
-func GetNextCommand(projectid string, uuid string) (*models.Job, error) {
-	session := mongoSession.Copy()
+func (s *Store) GetNextCommand(projectid string, uuid string) (*models.Job, error) {
+	session := s.session.Copy()
 	defer session.Close()
 	job := models.Job{}
 	coll := session.DB(dbname).C("jobs")
 	err := coll.Find(bson.M{"projectid": projectid, "uuid": uuid, "deleted": 0}).One(&job)
-	return &job, err
+	return &job, notFound(err)
 }
 
 // UpdateJob updates the job in the database
-func UpdateJob(job *models.Job) error {
-	session := mongoSession.Copy()
+func (s *Store) UpdateJob(job *models.Job) error {
+	session := s.session.Copy()
 	defer session.Close()
 	coll := session.DB(dbname).C("jobs")
 	query := bson.M{"uuid": job.UUID}
 	change := bson.M{"$set": job}
 	err := coll.Update(query, change)
+	return notFound(err)
+}
+
+func (s *Store) CreateOperation(op *models.Operation) error {
+	session := s.session.Copy()
+	defer session.Close()
+	coll := session.DB(dbname).C("operations")
+	err := coll.Insert(op)
 	return err
 }
+
+func (s *Store) GetOperation(projectid string, id string) (*models.Operation, error) {
+	session := s.session.Copy()
+	defer session.Close()
+	op := models.Operation{}
+	coll := session.DB(dbname).C("operations")
+	err := coll.Find(bson.M{"projectid": projectid, "id": id}).One(&op)
+	return &op, notFound(err)
+}
+
+func (s *Store) GetClusterOperations(projectid string, clusterUUID string) ([]models.Operation, error) {
+	session := s.session.Copy()
+	defer session.Close()
+	ops := []models.Operation{}
+	coll := session.DB(dbname).C("operations")
+	err := coll.Find(bson.M{"projectid": projectid, "clusteruuid": clusterUUID}).Sort("createdat").All(&ops)
+	return ops, err
+}
+
+func (s *Store) UpdateOperation(op *models.Operation) error {
+	session := s.session.Copy()
+	defer session.Close()
+	coll := session.DB(dbname).C("operations")
+	query := bson.M{"projectid": op.ProjectId, "id": op.ID}
+	change := bson.M{"$set": op}
+	err := coll.Update(query, change)
+	return notFound(err)
+}
+
+// Dump returns every document in the database, deleted ones included.
+func (s *Store) Dump() (*db.Snapshot, error) {
+	session := s.session.Copy()
+	defer session.Close()
+	snapshot := &db.Snapshot{}
+	if err := session.DB(dbname).C("clusters").Find(nil).All(&snapshot.Clusters); err != nil {
+		return nil, err
+	}
+	if err := session.DB(dbname).C("nodes").Find(nil).All(&snapshot.Nodes); err != nil {
+		return nil, err
+	}
+	if err := session.DB(dbname).C("jobs").Find(nil).All(&snapshot.Jobs); err != nil {
+		return nil, err
+	}
+	if err := session.DB(dbname).C("operations").Find(nil).All(&snapshot.Operations); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Restore inserts every record of snapshot.
+func (s *Store) Restore(snapshot *db.Snapshot) error {
+	session := s.session.Copy()
+	defer session.Close()
+	for i := range snapshot.Clusters {
+		if err := session.DB(dbname).C("clusters").Insert(&snapshot.Clusters[i]); err != nil {
+			return err
+		}
+	}
+	for i := range snapshot.Nodes {
+		if err := session.DB(dbname).C("nodes").Insert(&snapshot.Nodes[i]); err != nil {
+			return err
+		}
+	}
+	for i := range snapshot.Jobs {
+		if err := session.DB(dbname).C("jobs").Insert(&snapshot.Jobs[i]); err != nil {
+			return err
+		}
+	}
+	for i := range snapshot.Operations {
+		if err := session.DB(dbname).C("operations").Insert(&snapshot.Operations[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package mongodb
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/db/dbtest"
+	"github.com/sulochan/kaas/models"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestUpdateQuery(t *testing.T) {
+	tests := []struct {
+		revision int64
+		want     interface{}
+	}{
+		{revision: 0, want: bson.M{"$in": []interface{}{0, nil}}},
+		{revision: 3, want: int64(3)},
+	}
+	for _, tt := range tests {
+		query := updateQuery(&models.Cluster{ProjectId: "p", UUID: "c", Revision: tt.revision})
+		want := bson.M{"projectid": "p", "uuid": "c", "deleted": 0, "revision": tt.want}
+		if !reflect.DeepEqual(query, want) {
+			t.Errorf("revision %d: got %v, want %v", tt.revision, query, want)
+		}
+	}
+}
+
+// TestStore drops the kaas database of the server at KAAS_TEST_MONGO_URL,
+// never point it at a server in use.
+func TestStore(t *testing.T) {
+	url := os.Getenv("KAAS_TEST_MONGO_URL")
+	if url == "" {
+		t.Skip("KAAS_TEST_MONGO_URL is not set")
+	}
+	dbtest.TestStore(t, func(t *testing.T) db.Store {
+		s, err := New(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.session.DB(dbname).DropDatabase(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
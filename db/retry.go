@@ -0,0 +1,33 @@
+package db
+
+import (
+	"github.com/sulochan/kaas/models"
+)
+
+// MaxUpdateRetries bounds how many times UpdateClusterWithRetry refetches a
+// cluster after losing a compare-and-swap.
+const MaxUpdateRetries = 10
+
+// UpdateClusterWithRetry fetches the cluster, applies mutate to it and writes
+// it back. When another writer updated the cluster in between, the cluster is
+// refetched and mutate applied again, so mutate must only touch the fields it
+// owns and be safe to call more than once. The stored cluster is returned.
+func UpdateClusterWithRetry(store ClusterStore, projectid string, uuid string, mutate func(cluster *models.Cluster) error) (*models.Cluster, error) {
+	for i := 0; i < MaxUpdateRetries; i++ {
+		cluster, err := store.GetCluster(projectid, uuid)
+		if err != nil {
+			return nil, err
+		}
+		if err := mutate(cluster); err != nil {
+			return nil, err
+		}
+		err = store.UpdateCluster(cluster)
+		if err == nil {
+			return cluster, nil
+		}
+		if err != Conflict {
+			return nil, err
+		}
+	}
+	return nil, Conflict
+}
@@ -0,0 +1,86 @@
+package db_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sulochan/kaas/db"
+	"github.com/sulochan/kaas/db/memory"
+	"github.com/sulochan/kaas/models"
+)
+
+// racingStore is a store another writer updates the cluster of right before
+// each of the first races updates.
+type racingStore struct {
+	*memory.Store
+	races int
+}
+
+func (s *racingStore) UpdateCluster(cluster *models.Cluster) error {
+	if s.races > 0 {
+		s.races--
+		other, err := s.Store.GetCluster(cluster.ProjectId, cluster.UUID)
+		if err != nil {
+			return err
+		}
+		other.Worker++
+		if err := s.Store.UpdateCluster(other); err != nil {
+			return err
+		}
+	}
+	return s.Store.UpdateCluster(cluster)
+}
+
+func TestUpdateClusterWithRetry(t *testing.T) {
+	errMutate := errors.New("mutate failed")
+	tests := []struct {
+		name      string
+		uuid      string
+		races     int
+		mutateErr error
+		wantErr   error
+		wantCalls int
+	}{
+		{name: "no race", uuid: "c1", wantCalls: 1},
+		{name: "lost races are retried", uuid: "c1", races: 3, wantCalls: 4},
+		{name: "gives up", uuid: "c1", races: db.MaxUpdateRetries, wantErr: db.Conflict, wantCalls: db.MaxUpdateRetries},
+		{name: "mutate error", uuid: "c1", mutateErr: errMutate, wantErr: errMutate, wantCalls: 1},
+		{name: "not found", uuid: "missing", wantErr: db.NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &racingStore{Store: memory.New(), races: tt.races}
+			if err := s.CreateNewCluster(&models.Cluster{ProjectId: "p", UUID: "c1"}); err != nil {
+				t.Fatal(err)
+			}
+
+			calls := 0
+			cluster, err := db.UpdateClusterWithRetry(s, "p", tt.uuid, func(cluster *models.Cluster) error {
+				calls++
+				cluster.Name = "renamed"
+				return tt.mutateErr
+			})
+			if err != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("mutate called %d times, want %d", calls, tt.wantCalls)
+			}
+			if err != nil {
+				return
+			}
+
+			stored, err := s.GetCluster("p", "c1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the update must not undo what the racing writer did
+			if stored.Name != "renamed" || stored.Worker != tt.races {
+				t.Errorf("stored name %q with %d workers, want renamed with %d", stored.Name, stored.Worker, tt.races)
+			}
+			if cluster.Revision != stored.Revision {
+				t.Errorf("returned revision %d, stored %d", cluster.Revision, stored.Revision)
+			}
+		})
+	}
+}
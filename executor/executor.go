@@ -0,0 +1,148 @@
+// Package executor runs shell commands on the cluster nodes. The api package
+// only talks to nodes through the Executor interface; SSH is the
+// implementation used against real nodes and the fake sub package an in
+// memory one for running the provisioning pipeline without them.
+package executor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sulochan/kaas/models"
+)
+
+// DefaultTimeout bounds a command that sets no Timeout.
+const DefaultTimeout = 30 * time.Minute
+
+// Output streams.
+const (
+	Stdout = "stdout"
+	Stderr = "stderr"
+)
+
+// Command is a shell command run as root on a node.
+type Command struct {
+	Cmd string
+	// Stdin is fed to the command if not nil.
+	Stdin io.Reader
+	// Timeout bounds the command on top of the context of Run, zero is
+	// DefaultTimeout.
+	Timeout time.Duration
+}
+
+// Sink receives the output of the commands line by line as they print it,
+// stream is Stdout or Stderr. It may be called from several goroutines.
+type Sink func(node *models.Node, stream, line string)
+
+// ExitError is returned by Run for a command that ran and exited with a non
+// zero status. Any other error of Run is a transport error: the command may
+// not have run at all.
+type ExitError struct {
+	Status int
+	// Output is the combined output of the command.
+	Output string
+}
+
+func (e *ExitError) Error() string {
+	last := strings.TrimSpace(e.Output)
+	if i := strings.LastIndex(last, "\n"); i >= 0 {
+		last = last[i+1:]
+	}
+	if last == "" {
+		return fmt.Sprintf("command exited with status %d", e.Status)
+	}
+	return fmt.Sprintf("command exited with status %d: %s", e.Status, last)
+}
+
+// Executor runs commands on nodes.
+type Executor interface {
+	// Run runs cmd on node n and returns its combined output, see ExitError.
+	// It gives up when ctx is done or the timeout of cmd expires.
+	Run(ctx context.Context, n *models.Node, cmd Command) (string, error)
+	// Upload writes content to path on node n, creating its directory. The
+	// file is replaced atomically, only once it has the mode and owner of
+	// opts and its checksum matches content.
+	Upload(ctx context.Context, n *models.Node, path string, content []byte, opts FileOpts) error
+	// Download returns the content of path on node n, checked against its
+	// checksum on n.
+	Download(ctx context.Context, n *models.Node, path string) ([]byte, error)
+	// Close closes the connections the executor keeps open.
+	Close() error
+}
+
+// output collects the combined output of a command and hands it to a sink
+// line by line.
+type output struct {
+	mu       sync.Mutex
+	node     *models.Node
+	sink     Sink
+	combined bytes.Buffer
+}
+
+// writer returns the writer of stream.
+func (o *output) writer(stream string) *lineWriter {
+	return &lineWriter{o: o, stream: stream}
+}
+
+// lineWriter is one stream of an output, it holds back the last line until
+// it is complete.
+type lineWriter struct {
+	o       *output
+	stream  string
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.o.mu.Lock()
+	defer w.o.mu.Unlock()
+	w.o.combined.Write(p)
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush hands the last line to the sink if it did not end with a newline.
+func (w *lineWriter) flush() {
+	w.o.mu.Lock()
+	defer w.o.mu.Unlock()
+	if len(w.partial) > 0 {
+		w.emit(string(w.partial))
+		w.partial = nil
+	}
+}
+
+// emit must be called with o.mu held.
+func (w *lineWriter) emit(line string) {
+	if w.o.sink != nil {
+		w.o.sink(w.o.node, w.stream, strings.TrimRight(line, "\r"))
+	}
+}
+
+// String returns the combined output so far.
+func (o *output) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.combined.String()
+}
+
+// Write feeds output, as printed by a command on stream, to sink line by
+// line and returns it. Executors that do not stream, like the fake one, use
+// it to behave like those that do.
+func Write(sink Sink, n *models.Node, stream, text string) string {
+	w := &lineWriter{o: &output{node: n, sink: sink}, stream: stream}
+	w.Write([]byte(text))
+	w.flush()
+	return text
+}
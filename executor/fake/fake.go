@@ -0,0 +1,214 @@
+// Package fake is a deterministic, in-memory executor.Executor for running
+// the provisioning pipeline without nodes. Commands succeed without output
+// unless a handler says otherwise; files written through stdin or uploaded are
+// kept, so that test -f, cat and downloads see them, and every command is
+// recorded, uploads as "upload <path>" and downloads as "download <path>".
+package fake
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/sulochan/kaas/executor"
+	"github.com/sulochan/kaas/models"
+)
+
+// Handler answers a command with its output and exit status, or fails it
+// with a transport error.
+type Handler func(n *models.Node, cmd string) (output string, status int, err error)
+
+// Run is a command the executor ran.
+type Run struct {
+	Node  string
+	Cmd   string
+	Stdin []byte
+}
+
+type handler struct {
+	match string
+	h     Handler
+}
+
+var (
+	reWrite = regexp.MustCompile(`cat > (\S+)$`)
+	reTest  = regexp.MustCompile(`^test -f (\S+)$`)
+	reCat   = regexp.MustCompile(`^(?:sudo )?cat (\S+)$`)
+)
+
+// Executor is the fake implementation of executor.Executor.
+type Executor struct {
+	sink executor.Sink
+
+	mu       sync.Mutex
+	handlers []handler
+	runs     []Run
+	// files are the files written on each node, by node key and path.
+	files map[string]map[string][]byte
+}
+
+// New returns an Executor streaming the output of the commands to sink,
+// which may be nil.
+func New(sink executor.Sink) *Executor {
+	return &Executor{sink: sink, files: map[string]map[string][]byte{}}
+}
+
+// Handle makes h answer the commands containing match. Handlers are tried
+// in the order they were added.
+func (e *Executor) Handle(match string, h Handler) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.handlers = append(e.handlers, handler{match: match, h: h})
+}
+
+// Runs returns the commands run so far, in order.
+func (e *Executor) Runs() []Run {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Run{}, e.runs...)
+}
+
+// nodeKey identifies node n: its server id, its name if it has none. Nodes
+// of clusters with the same name share names.
+func nodeKey(n *models.Node) string {
+	if n.UUID != "" {
+		return n.UUID
+	}
+	return n.Name
+}
+
+// File returns the content of the file at path on the node with key node,
+// its server id or its name if it has none, as written by a command.
+func (e *Executor) File(node, path string) ([]byte, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	content, ok := e.files[node][path]
+	return content, ok
+}
+
+func (e *Executor) Run(ctx context.Context, n *models.Node, cmd executor.Command) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	var stdin []byte
+	if cmd.Stdin != nil {
+		content, err := ioutil.ReadAll(cmd.Stdin)
+		if err != nil {
+			return "", err
+		}
+		stdin = content
+	}
+
+	out, status, err := e.run(n, cmd.Cmd, stdin)
+	if err != nil {
+		return "", err
+	}
+	out = executor.Write(e.sink, n, executor.Stdout, out)
+	if status != 0 {
+		return out, &executor.ExitError{Status: status, Output: out}
+	}
+	return out, nil
+}
+
+// run records and answers cmd.
+func (e *Executor) run(n *models.Node, cmd string, stdin []byte) (string, int, error) {
+	e.mu.Lock()
+	e.runs = append(e.runs, Run{Node: n.Name, Cmd: cmd, Stdin: stdin})
+	handlers := append([]handler{}, e.handlers...)
+	e.mu.Unlock()
+
+	for _, h := range handlers {
+		if strings.Contains(cmd, h.match) {
+			return h.h(n, cmd)
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	key := nodeKey(n)
+	if m := reWrite.FindStringSubmatch(cmd); m != nil {
+		if e.files[key] == nil {
+			e.files[key] = map[string][]byte{}
+		}
+		e.files[key][m[1]] = stdin
+		return "", 0, nil
+	}
+	if m := reTest.FindStringSubmatch(cmd); m != nil {
+		if _, ok := e.files[key][m[1]]; !ok {
+			return "", 1, nil
+		}
+		return "", 0, nil
+	}
+	if m := reCat.FindStringSubmatch(cmd); m != nil {
+		content, ok := e.files[key][m[1]]
+		if !ok {
+			return "cat: " + m[1] + ": No such file or directory\n", 1, nil
+		}
+		return string(content), 0, nil
+	}
+	return "", 0, nil
+}
+
+func (e *Executor) Upload(ctx context.Context, n *models.Node, path string, content []byte, opts executor.FileOpts) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	out, status, err := e.run(n, "upload "+path, content)
+	if err != nil {
+		return err
+	}
+	if status != 0 {
+		return &executor.ExitError{Status: status, Output: out}
+	}
+
+	e.setFile(nodeKey(n), path, append([]byte{}, content...))
+	return nil
+}
+
+func (e *Executor) Download(ctx context.Context, n *models.Node, path string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	out, status, err := e.run(n, "download "+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if status != 0 {
+		return nil, &executor.ExitError{Status: status, Output: out}
+	}
+	if out != "" {
+		return []byte(out), nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	content, ok := e.files[nodeKey(n)][path]
+	if !ok {
+		return nil, fmt.Errorf("download of %s from %s: no such file", path, n.Name)
+	}
+	return append([]byte{}, content...), nil
+}
+
+func (e *Executor) Close() error {
+	return nil
+}
+
+// setFile writes the file at path on the node with key node.
+func (e *Executor) setFile(node, path string, content []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.files[node] == nil {
+		e.files[node] = map[string][]byte{}
+	}
+	e.files[node][path] = content
+}
+
+// forget drops the files of the node with key node, like a deleted VM.
+func (e *Executor) forget(node string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.files, node)
+}
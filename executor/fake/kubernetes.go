@@ -0,0 +1,411 @@
+package fake
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/sulochan/kaas/models"
+	"github.com/sulochan/kaas/provider"
+)
+
+// Paths the kubeadm commands read and write on the nodes.
+const (
+	kubeadmConfigPath = "/etc/kubernetes/kubeadm-config.yaml"
+	adminConfPath     = "/etc/kubernetes/admin.conf"
+	kubeletConfPath   = "/etc/kubernetes/kubelet.conf"
+	caCertPath        = "/etc/kubernetes/pki/ca.crt"
+)
+
+var (
+	reUpgradeApply   = regexp.MustCompile(`kubeadm upgrade apply -y (v[0-9.]+)`)
+	reKubeletPackage = regexp.MustCompile(`kubelet=([0-9]+\.[0-9]+\.[0-9]+)-`)
+	reKubectl        = regexp.MustCompile(`kubectl --kubeconfig=\S+ (.*)$`)
+)
+
+// Servers lists the servers of the cloud, see provider.Servers. The nodes
+// of servers that are gone leave their cluster.
+type Servers interface {
+	ListServers(name string) ([]provider.Server, error)
+}
+
+// kubeadmConfig is what the simulation reads of a kubeadm configuration.
+type kubeadmConfig struct {
+	KubernetesVersion    string `yaml:"kubernetesVersion"`
+	ControlPlaneEndpoint string `yaml:"controlPlaneEndpoint"`
+	NodeRegistration     struct {
+		Name string `yaml:"name"`
+	} `yaml:"nodeRegistration"`
+	Discovery struct {
+		BootstrapToken struct {
+			APIServerEndpoint string `yaml:"apiServerEndpoint"`
+		} `yaml:"bootstrapToken"`
+	} `yaml:"discovery"`
+}
+
+// parseKubeadmConfig merges the documents of the kubeadm configuration
+// stream content.
+func parseKubeadmConfig(content []byte) (*kubeadmConfig, error) {
+	config := &kubeadmConfig{}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		doc := kubeadmConfig{}
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			return config, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if doc.KubernetesVersion != "" {
+			config.KubernetesVersion = doc.KubernetesVersion
+		}
+		if doc.ControlPlaneEndpoint != "" {
+			config.ControlPlaneEndpoint = doc.ControlPlaneEndpoint
+		}
+		if doc.NodeRegistration.Name != "" {
+			config.NodeRegistration = doc.NodeRegistration
+		}
+		if doc.Discovery.BootstrapToken.APIServerEndpoint != "" {
+			config.Discovery = doc.Discovery
+		}
+	}
+}
+
+// cluster is a kubernetes cluster played by Kubernetes.
+type cluster struct {
+	// version is the version of the control plane.
+	version string
+	// kubelets are the kubelet versions of the nodes, by node name.
+	kubelets map[string]string
+}
+
+// member is a node that joined a cluster.
+type member struct {
+	cluster *cluster
+	// name is the kubernetes name of the node.
+	name string
+}
+
+// simulation is the state of the clusters played by an Executor.
+type simulation struct {
+	e     *Executor
+	cloud Servers
+
+	mu sync.Mutex
+	// clusters are the clusters by control plane endpoint.
+	clusters map[string]*cluster
+	// members are the nodes of the clusters by node key.
+	members map[string]*member
+}
+
+// Kubernetes makes e play kubeadm clusters, one per control plane endpoint:
+// kubeadm init and join write the kubeconfigs they write on real nodes and
+// register the node in the cluster of the endpoint in its configuration,
+// kubectl on a node reports the nodes of its cluster ready at the version
+// of their kubelet, and kubeadm upgrade apply and the kubelet packages move
+// those versions. Nodes whose server is no longer listed by cloud, which
+// may be nil, leave their cluster with their files. uname -m is answered
+// like on an amd64 node.
+func (e *Executor) Kubernetes(cloud Servers) {
+	k := &simulation{e: e, cloud: cloud, clusters: map[string]*cluster{}, members: map[string]*member{}}
+
+	e.Handle("uname -m", func(n *models.Node, cmd string) (string, int, error) {
+		return "x86_64\n", 0, nil
+	})
+	e.Handle("kubeadm init --config", k.init)
+	e.Handle("kubeadm join --config", k.join)
+	e.Handle("kubeadm upgrade apply", func(n *models.Node, cmd string) (string, int, error) {
+		m := reUpgradeApply.FindStringSubmatch(cmd)
+		if m == nil {
+			return "missing version\n", 1, nil
+		}
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		joined, ok := k.members[nodeKey(n)]
+		if !ok {
+			return "couldn't create a Kubernetes client: admin.conf: no such file or directory\n", 1, nil
+		}
+		joined.cluster.version = m[1]
+		return "[upgrade/successful] SUCCESS! Your cluster was upgraded to \"" + m[1] + "\".\n", 0, nil
+	})
+	e.Handle("apt-get install", func(n *models.Node, cmd string) (string, int, error) {
+		m := reKubeletPackage.FindStringSubmatch(cmd)
+		if m == nil {
+			return "", 0, nil
+		}
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if joined, ok := k.members[nodeKey(n)]; ok {
+			joined.cluster.kubelets[joined.name] = "v" + m[1]
+		}
+		return "", 0, nil
+	})
+	e.Handle("kubectl --kubeconfig=", func(n *models.Node, cmd string) (string, int, error) {
+		m := reKubectl.FindStringSubmatch(cmd)
+		if m == nil {
+			return "", 0, nil
+		}
+		if err := k.prune(); err != nil {
+			return "", 0, err
+		}
+		return k.kubectl(n, shellWords(m[1]))
+	})
+}
+
+// shellWords splits cmd into words like a shell does, honoring the single
+// quotes and backslashes of executor.Quote.
+func shellWords(cmd string) []string {
+	words := []string{}
+	word, inWord, quoted, escaped := "", false, false, false
+	for _, r := range cmd {
+		switch {
+		case escaped:
+			word += string(r)
+			escaped = false
+		case quoted:
+			if r == '\'' {
+				quoted = false
+			} else {
+				word += string(r)
+			}
+		case r == '\'':
+			quoted, inWord = true, true
+		case r == '\\':
+			escaped, inWord = true, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word)
+			}
+			word, inWord = "", false
+		default:
+			word += string(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word)
+	}
+	return words
+}
+
+// config returns the kubeadm configuration written on node n.
+func (k *simulation) config(n *models.Node) (*kubeadmConfig, error) {
+	content, ok := k.e.File(nodeKey(n), kubeadmConfigPath)
+	if !ok {
+		return nil, fmt.Errorf("%s not found", kubeadmConfigPath)
+	}
+	return parseKubeadmConfig(content)
+}
+
+// init answers kubeadm init, creating the cluster of the control plane
+// endpoint of the configuration with n as its first node.
+func (k *simulation) init(n *models.Node, cmd string) (string, int, error) {
+	config, err := k.config(n)
+	if err != nil {
+		return err.Error() + "\n", 1, nil
+	}
+	if config.KubernetesVersion == "" || config.ControlPlaneEndpoint == "" || config.NodeRegistration.Name == "" {
+		return "incomplete kubeadm configuration\n", 1, nil
+	}
+	ca, ok := k.e.File(nodeKey(n), caCertPath)
+	if !ok {
+		return caCertPath + " not found\n", 1, nil
+	}
+	if err := k.prune(); err != nil {
+		return "", 0, err
+	}
+
+	k.mu.Lock()
+	if _, ok := k.clusters[config.ControlPlaneEndpoint]; ok {
+		k.mu.Unlock()
+		return "control plane " + config.ControlPlaneEndpoint + " is already initialized\n", 1, nil
+	}
+	c := &cluster{version: config.KubernetesVersion, kubelets: map[string]string{}}
+	c.kubelets[config.NodeRegistration.Name] = c.version
+	k.clusters[config.ControlPlaneEndpoint] = c
+	k.members[nodeKey(n)] = &member{cluster: c, name: config.NodeRegistration.Name}
+	k.mu.Unlock()
+
+	k.e.setFile(nodeKey(n), adminConfPath, adminConf(config.ControlPlaneEndpoint, ca))
+	k.e.setFile(nodeKey(n), kubeletConfPath, []byte("apiVersion: v1\nkind: Config\n"))
+	return "Your Kubernetes control-plane has initialized successfully!\n", 0, nil
+}
+
+// join answers kubeadm join, adding n to the cluster of the api server
+// endpoint of the configuration.
+func (k *simulation) join(n *models.Node, cmd string) (string, int, error) {
+	config, err := k.config(n)
+	if err != nil {
+		return err.Error() + "\n", 1, nil
+	}
+	endpoint := config.Discovery.BootstrapToken.APIServerEndpoint
+	if err := k.prune(); err != nil {
+		return "", 0, err
+	}
+
+	k.mu.Lock()
+	c, ok := k.clusters[endpoint]
+	if !ok || config.NodeRegistration.Name == "" {
+		k.mu.Unlock()
+		return "couldn't validate the identity of the API Server " + endpoint + ": connection refused\n", 1, nil
+	}
+	c.kubelets[config.NodeRegistration.Name] = c.version
+	k.members[nodeKey(n)] = &member{cluster: c, name: config.NodeRegistration.Name}
+	k.mu.Unlock()
+
+	k.e.setFile(nodeKey(n), kubeletConfPath, []byte("apiVersion: v1\nkind: Config\n"))
+	return "This node has joined the cluster\n", 0, nil
+}
+
+// prune removes the nodes whose server is gone from their cluster, and the
+// clusters left without nodes.
+func (k *simulation) prune() error {
+	if k.cloud == nil {
+		return nil
+	}
+	servers, err := k.cloud.ListServers("")
+	if err != nil {
+		return err
+	}
+	exists := map[string]bool{}
+	for _, s := range servers {
+		exists[s.ID] = true
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for key, joined := range k.members {
+		if exists[key] {
+			continue
+		}
+		delete(joined.cluster.kubelets, joined.name)
+		delete(k.members, key)
+		k.e.forget(key)
+	}
+	for endpoint, c := range k.clusters {
+		if len(c.kubelets) == 0 {
+			delete(k.clusters, endpoint)
+		}
+	}
+	return nil
+}
+
+// kubectl answers kubectl args run on node n.
+func (k *simulation) kubectl(n *models.Node, args []string) (string, int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	joined, ok := k.members[nodeKey(n)]
+	if !ok {
+		return "The connection to the server localhost:8080 was refused\n", 1, nil
+	}
+	c := joined.cluster
+
+	switch {
+	case len(args) >= 2 && args[0] == "version":
+		out, _ := json.Marshal(map[string]interface{}{
+			"clientVersion": map[string]string{"gitVersion": c.kubelets[joined.name]},
+			"serverVersion": map[string]string{"gitVersion": c.version},
+		})
+		return string(out) + "\n", 0, nil
+	case len(args) >= 2 && args[0] == "get" && args[1] == "nodes":
+		names := []string{}
+		for name := range c.kubelets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		items := []interface{}{}
+		for _, name := range names {
+			items = append(items, k8sNode(name, c.kubelets[name]))
+		}
+		out, _ := json.Marshal(map[string]interface{}{"apiVersion": "v1", "kind": "List", "items": items})
+		return string(out) + "\n", 0, nil
+	case len(args) >= 3 && args[0] == "get" && args[1] == "node":
+		version, ok := c.kubelets[args[2]]
+		if contains(args, "name") {
+			if !ok {
+				return "", 0, nil
+			}
+			return "node/" + args[2] + "\n", 0, nil
+		}
+		if !ok {
+			return fmt.Sprintf("Error from server (NotFound): nodes %q not found\n", args[2]), 1, nil
+		}
+		out, _ := json.Marshal(k8sNode(args[2], version))
+		return string(out) + "\n", 0, nil
+	case len(args) >= 3 && args[0] == "delete" && args[1] == "node":
+		if _, ok := c.kubelets[args[2]]; !ok {
+			if contains(args, "--ignore-not-found") {
+				return "", 0, nil
+			}
+			return fmt.Sprintf("Error from server (NotFound): nodes %q not found\n", args[2]), 1, nil
+		}
+		delete(c.kubelets, args[2])
+		for key, m := range k.members {
+			if m.cluster == c && m.name == args[2] {
+				// the node is removed with its VM, one created with its
+				// name starts afresh
+				delete(k.members, key)
+				k.e.forget(key)
+			}
+		}
+		return "node \"" + args[2] + "\" deleted\n", 0, nil
+	}
+	return "", 0, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// k8sNode returns a ready kubernetes Node named name.
+func k8sNode(name, kubelet string) map[string]interface{} {
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Node",
+		"metadata":   map[string]string{"name": name},
+		"spec":       map[string]interface{}{},
+		"status": map[string]interface{}{
+			"conditions": []map[string]string{{"type": "Ready", "status": "True"}},
+			"nodeInfo":   map[string]string{"kubeletVersion": kubelet},
+		},
+	}
+}
+
+// adminConf returns the admin.conf of kubeadm init for the control plane
+// at endpoint, trusting ca, with a placeholder client certificate.
+func adminConf(endpoint string, ca []byte) []byte {
+	return []byte(fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- cluster:
+    certificate-authority-data: %s
+    server: https://%s
+  name: kubernetes
+contexts:
+- context:
+    cluster: kubernetes
+    user: kubernetes-admin
+  name: kubernetes-admin@kubernetes
+current-context: kubernetes-admin@kubernetes
+users:
+- name: kubernetes-admin
+  user:
+    client-certificate-data: %s
+    client-key-data: %s
+`, base64.StdEncoding.EncodeToString(ca), endpoint,
+		base64.StdEncoding.EncodeToString([]byte("fake client certificate")),
+		base64.StdEncoding.EncodeToString([]byte("fake client key"))))
+}
@@ -0,0 +1,232 @@
+package fake
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sulochan/kaas/executor"
+	"github.com/sulochan/kaas/models"
+	"github.com/sulochan/kaas/provider"
+	"github.com/sulochan/kaas/provider/fake"
+)
+
+const (
+	initConfig = `apiVersion: kubeadm.k8s.io/v1beta2
+kind: InitConfiguration
+nodeRegistration:
+  name: %s
+---
+apiVersion: kubeadm.k8s.io/v1beta2
+kind: ClusterConfiguration
+kubernetesVersion: %s
+controlPlaneEndpoint: %s
+`
+	joinConfig = `apiVersion: kubeadm.k8s.io/v1beta2
+kind: JoinConfiguration
+nodeRegistration:
+  name: %s
+discovery:
+  bootstrapToken:
+    apiServerEndpoint: %s
+`
+)
+
+type testCluster struct {
+	e     *Executor
+	nodes []*models.Node
+}
+
+// run runs cmd on node n and fails the test unless it succeeds.
+func (c *testCluster) run(t *testing.T, n *models.Node, cmd string) string {
+	t.Helper()
+	out, err := c.e.Run(context.Background(), n, executor.Command{Cmd: cmd})
+	if err != nil {
+		t.Fatalf("%s on %s: %v", cmd, n.Name, err)
+	}
+	return out
+}
+
+func (c *testCluster) upload(t *testing.T, n *models.Node, path, content string) {
+	t.Helper()
+	if err := c.e.Upload(context.Background(), n, path, []byte(content), executor.FileOpts{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newCluster creates servers for nodes named names in cloud, all named like
+// the nodes of a kaas cluster named name, and runs kubeadm init and join on
+// them for the control plane at endpoint.
+func newCluster(t *testing.T, e *Executor, cloud *fake.Provider, endpoint, version string, names ...string) *testCluster {
+	t.Helper()
+	c := &testCluster{e: e}
+	for i, name := range names {
+		s, err := cloud.CreateServer(provider.CreateServerOpts{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := &models.Node{UUID: s.ID, Name: name}
+		c.nodes = append(c.nodes, n)
+		if i == 0 {
+			c.upload(t, n, caCertPath, "ca")
+			c.upload(t, n, kubeadmConfigPath, fmt.Sprintf(initConfig, name, version, endpoint))
+			c.run(t, n, "kubeadm init --config "+kubeadmConfigPath+" --upload-certs")
+			continue
+		}
+		c.upload(t, n, kubeadmConfigPath, fmt.Sprintf(joinConfig, name, endpoint))
+		c.run(t, n, "kubeadm join --config "+kubeadmConfigPath)
+	}
+	return c
+}
+
+// k8sNodes returns the kubelet versions of the nodes kubectl on the first
+// node of c reports, by name.
+func (c *testCluster) k8sNodes(t *testing.T) map[string]string {
+	t.Helper()
+	out := c.run(t, c.nodes[0], "/usr/bin/kubectl --kubeconfig=/etc/kubernetes/admin.conf get nodes -o json")
+	list := struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Status struct {
+				NodeInfo struct {
+					KubeletVersion string `json:"kubeletVersion"`
+				} `json:"nodeInfo"`
+			} `json:"status"`
+		} `json:"items"`
+	}{}
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		t.Fatal(err)
+	}
+	nodes := map[string]string{}
+	for _, item := range list.Items {
+		nodes[item.Metadata.Name] = item.Status.NodeInfo.KubeletVersion
+	}
+	return nodes
+}
+
+func (c *testCluster) serverVersion(t *testing.T) string {
+	t.Helper()
+	out := c.run(t, c.nodes[0], "/usr/bin/kubectl --kubeconfig=/etc/kubernetes/admin.conf version -o json")
+	version := struct {
+		ServerVersion struct {
+			GitVersion string `json:"gitVersion"`
+		} `json:"serverVersion"`
+	}{}
+	if err := json.Unmarshal([]byte(out), &version); err != nil {
+		t.Fatal(err)
+	}
+	return version.ServerVersion.GitVersion
+}
+
+func TestKubernetes(t *testing.T) {
+	cloud := fake.New()
+	e := New(nil)
+	e.Kubernetes(cloud)
+
+	// both kaas clusters are named test, only their endpoints differ
+	a := newCluster(t, e, cloud, "192.0.2.1:6443", "v1.20.8", "master-1", "worker-1")
+	b := newCluster(t, e, cloud, "192.0.2.2:6443", "v1.21.2", "master-1", "worker-1", "worker-2")
+
+	if got := a.k8sNodes(t); len(got) != 2 || got["worker-1"] != "v1.20.8" {
+		t.Errorf("nodes of cluster a: %v", got)
+	}
+	if got := b.k8sNodes(t); len(got) != 3 || got["worker-2"] != "v1.21.2" {
+		t.Errorf("nodes of cluster b: %v", got)
+	}
+	admin, _ := e.File(a.nodes[0].UUID, adminConfPath)
+	if !strings.Contains(string(admin), "server: https://192.0.2.1:6443") {
+		t.Errorf("admin.conf of cluster a:\n%s", admin)
+	}
+	if _, ok := e.File(a.nodes[1].UUID, kubeletConfPath); !ok {
+		t.Error("no kubelet.conf on a joined node")
+	}
+
+	// upgrading a leaves b alone
+	a.run(t, a.nodes[0], "kubeadm upgrade apply -y v1.21.2")
+	a.run(t, a.nodes[1], "apt-get update && apt-get install -y kubelet=1.21.2-00 kubectl=1.21.2-00")
+	if got := a.serverVersion(t); got != "v1.21.2" {
+		t.Errorf("cluster a at %s after the upgrade", got)
+	}
+	if got := a.k8sNodes(t); got["worker-1"] != "v1.21.2" || got["master-1"] != "v1.20.8" {
+		t.Errorf("kubelets of cluster a after the upgrade: %v", got)
+	}
+	b.run(t, b.nodes[0], "kubeadm upgrade apply -y v1.22.0")
+	if got := a.serverVersion(t); got != "v1.21.2" {
+		t.Errorf("cluster a at %s after the upgrade of b", got)
+	}
+
+	// a deleted node leaves with its files
+	b.run(t, b.nodes[0], "/usr/bin/kubectl --kubeconfig=/etc/kubernetes/admin.conf delete node worker-2 --ignore-not-found")
+	if got := b.k8sNodes(t); len(got) != 2 {
+		t.Errorf("nodes of cluster b after a delete: %v", got)
+	}
+	if _, ok := e.File(b.nodes[2].UUID, kubeletConfPath); ok {
+		t.Error("deleted node kept its kubelet.conf")
+	}
+
+	// so do the nodes of a deleted cluster
+	for _, n := range a.nodes {
+		if err := cloud.DeleteServer(n.UUID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := b.k8sNodes(t); len(got) != 2 {
+		t.Errorf("nodes of cluster b after the delete of a: %v", got)
+	}
+	if _, ok := e.File(a.nodes[0].UUID, adminConfPath); ok {
+		t.Error("node of a deleted cluster kept its admin.conf")
+	}
+	// and the endpoint can be initialized again
+	newCluster(t, e, cloud, "192.0.2.1:6443", "v1.21.2", "master-1")
+}
+
+func TestKubernetesFailures(t *testing.T) {
+	e := New(nil)
+	e.Kubernetes(nil)
+	n := &models.Node{UUID: "server-1", Name: "worker-1"}
+	c := &testCluster{e: e}
+
+	tests := []struct {
+		name   string
+		config string
+		cmd    string
+	}{
+		{name: "kubectl before init", cmd: "/usr/bin/kubectl --kubeconfig=/etc/kubernetes/admin.conf get nodes -o json"},
+		{name: "init without a configuration", cmd: "kubeadm init --config " + kubeadmConfigPath},
+		{name: "init without a ca", config: fmt.Sprintf(initConfig, "master-1", "v1.21.2", "192.0.2.1:6443"),
+			cmd: "kubeadm init --config " + kubeadmConfigPath},
+		{name: "join of an unknown cluster", config: fmt.Sprintf(joinConfig, "worker-1", "192.0.2.9:6443"),
+			cmd: "kubeadm join --config " + kubeadmConfigPath},
+	}
+	for _, tt := range tests {
+		if tt.config != "" {
+			c.upload(t, n, kubeadmConfigPath, tt.config)
+		}
+		_, err := e.Run(context.Background(), n, executor.Command{Cmd: tt.cmd})
+		if _, ok := err.(*executor.ExitError); !ok {
+			t.Errorf("%s: got error %v, want an exit error", tt.name, err)
+		}
+	}
+}
+
+func TestShellWords(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{cmd: "get nodes -o json", want: []string{"get", "nodes", "-o", "json"}},
+		{cmd: "'get' 'node' 'worker-1'", want: []string{"get", "node", "worker-1"}},
+		{cmd: `'it'\''s' 'a b' ''`, want: []string{"it's", "a b", ""}},
+		{cmd: "  ", want: []string{}},
+	}
+	for _, tt := range tests {
+		if got := shellWords(tt.cmd); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package executor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/sulochan/kaas/models"
+)
+
+// scpAck reads the reply of the remote scp to the last message, a zero byte
+// or an error line.
+func scpAck(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := r.ReadString('\n')
+	return errors.New(strings.TrimSpace(msg))
+}
+
+// scp runs the remote end of scp with cmd on n and speaks the protocol with
+// it through transfer.
+func (s *SSH) scp(ctx context.Context, n *models.Node, cmd string, transfer func(w io.Writer, r *bufio.Reader) error) error {
+	ctx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+	defer cancel()
+
+	client, session, err := s.session(n)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	w, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	if err := session.Start(cmd); err != nil {
+		s.drop(n, client)
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := transfer(w, bufio.NewReader(r))
+		w.Close()
+		// wait even if the transfer failed, stderr is only complete then
+		waitErr := session.Wait()
+		if err != nil {
+			done <- err
+			return
+		}
+		done <- waitErr
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		s.drop(n, client)
+		return fmt.Errorf("transfer on %s given up: %v", n.Name, ctx.Err())
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// scpTo copies content to path on n.
+func (s *SSH) scpTo(ctx context.Context, n *models.Node, path string, content []byte) error {
+	return s.scp(ctx, n, "scp -qt "+Quote(path), func(w io.Writer, r *bufio.Reader) error {
+		if err := scpAck(r); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "C%04o %d %s\n", DefaultMode, len(content), filepath.Base(path))
+		if err := scpAck(r); err != nil {
+			return err
+		}
+		if _, err := w.Write(content); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte{0}); err != nil {
+			return err
+		}
+		return scpAck(r)
+	})
+}
+
+// scpFrom copies path from n.
+func (s *SSH) scpFrom(ctx context.Context, n *models.Node, path string) ([]byte, error) {
+	var content []byte
+	err := s.scp(ctx, n, "scp -qf "+Quote(path), func(w io.Writer, r *bufio.Reader) error {
+		if _, err := w.Write([]byte{0}); err != nil {
+			return err
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != 'C' {
+			msg, _ := r.ReadString('\n')
+			return errors.New(strings.TrimSpace(msg))
+		}
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		var mode, size int64
+		var name string
+		if _, err := fmt.Sscanf(header, "%o %d %s", &mode, &size, &name); err != nil {
+			return fmt.Errorf("scp: invalid header %q: %v", header, err)
+		}
+		if _, err := w.Write([]byte{0}); err != nil {
+			return err
+		}
+		content = make([]byte, size)
+		if _, err := io.ReadFull(r, content); err != nil {
+			return err
+		}
+		if err := scpAck(r); err != nil {
+			return err
+		}
+		_, err = w.Write([]byte{0})
+		return err
+	})
+	return content, err
+}
+
+func (s *SSH) Upload(ctx context.Context, n *models.Node, path string, content []byte, opts FileOpts) error {
+	tmp := tempPath(path)
+	if _, err := s.Run(ctx, n, Command{Cmd: "mkdir -p " + Quote(filepath.Dir(path))}); err != nil {
+		return fmt.Errorf("upload of %s to %s: %v", path, n.Name, err)
+	}
+	err := s.scpTo(ctx, n, tmp, content)
+	if err == nil {
+		var out string
+		out, err = s.Run(ctx, n, Command{Cmd: finishUpload(tmp, opts)})
+		if err == nil && checksumOf(out) != Checksum(content) {
+			err = fmt.Errorf("checksum mismatch: got %s, sent %s", checksumOf(out), Checksum(content))
+		}
+	}
+	if err == nil {
+		_, err = s.Run(ctx, n, Command{Cmd: "mv -f " + Quote(tmp) + " " + Quote(path)})
+	}
+	if err != nil {
+		s.Run(ctx, n, Command{Cmd: "rm -f " + Quote(tmp)})
+		return fmt.Errorf("upload of %s to %s: %v", path, n.Name, err)
+	}
+	return nil
+}
+
+func (s *SSH) Download(ctx context.Context, n *models.Node, path string) ([]byte, error) {
+	content, err := s.scpFrom(ctx, n, path)
+	if err != nil {
+		return nil, fmt.Errorf("download of %s from %s: %v", path, n.Name, err)
+	}
+	out, err := s.Run(ctx, n, Command{Cmd: "sha256sum " + Quote(path)})
+	if err != nil {
+		return nil, fmt.Errorf("download of %s from %s: %v", path, n.Name, err)
+	}
+	if checksumOf(out) != Checksum(content) {
+		return nil, fmt.Errorf("download of %s from %s: checksum mismatch: got %s, expected %s",
+			path, n.Name, Checksum(content), checksumOf(out))
+	}
+	return content, nil
+}
@@ -0,0 +1,141 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/sulochan/kaas/models"
+)
+
+// Dialer opens an ssh connection to node n, authenticated as root.
+type Dialer func(n *models.Node) (*ssh.Client, error)
+
+// SSH is the Executor of real nodes. It keeps one connection per node open
+// until Close, dialing it again if it broke.
+type SSH struct {
+	dial Dialer
+	sink Sink
+
+	mu      sync.Mutex
+	clients map[string]*ssh.Client
+}
+
+// NewSSH returns an SSH executor connecting with dial and streaming the
+// output of the commands to sink, which may be nil.
+func NewSSH(dial Dialer, sink Sink) *SSH {
+	return &SSH{dial: dial, sink: sink, clients: map[string]*ssh.Client{}}
+}
+
+// hostKey is what the connection to n is cached by.
+func hostKey(n *models.Node) string {
+	return n.UUID + "/" + n.IP
+}
+
+// client returns the connection to n, dialing it if there is none.
+func (s *SSH) client(n *models.Node) (*ssh.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if client, ok := s.clients[hostKey(n)]; ok {
+		return client, nil
+	}
+	client, err := s.dial(n)
+	if err != nil {
+		return nil, err
+	}
+	s.clients[hostKey(n)] = client
+	return client, nil
+}
+
+// drop closes the connection to n if it is still client.
+func (s *SSH) drop(n *models.Node, client *ssh.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clients[hostKey(n)] == client {
+		delete(s.clients, hostKey(n))
+	}
+	client.Close()
+}
+
+// session opens a session on n. A cached connection that broke since its
+// last use is dialed again once.
+func (s *SSH) session(n *models.Node) (*ssh.Client, *ssh.Session, error) {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var client *ssh.Client
+		client, err = s.client(n)
+		if err != nil {
+			return nil, nil, err
+		}
+		var session *ssh.Session
+		session, err = client.NewSession()
+		if err == nil {
+			return client, session, nil
+		}
+		s.drop(n, client)
+	}
+	return nil, nil, err
+}
+
+func (s *SSH) Run(ctx context.Context, n *models.Node, cmd Command) (string, error) {
+	timeout := cmd.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client, session, err := s.session(n)
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	out := &output{node: n, sink: s.sink}
+	stdout, stderr := out.writer(Stdout), out.writer(Stderr)
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if cmd.Stdin != nil {
+		session.Stdin = cmd.Stdin
+	}
+	if err := session.Start(cmd.Cmd); err != nil {
+		s.drop(n, client)
+		return "", err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		// the command may hold the connection, do not reuse it
+		s.drop(n, client)
+		return out.String(), fmt.Errorf("command on %s given up: %v", n.Name, ctx.Err())
+	}
+	stdout.flush()
+	stderr.flush()
+
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return out.String(), &ExitError{Status: exitErr.ExitStatus(), Output: out.String()}
+	}
+	if err != nil {
+		s.drop(n, client)
+		return out.String(), err
+	}
+	return out.String(), nil
+}
+
+func (s *SSH) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, client := range s.clients {
+		client.Close()
+		delete(s.clients, key)
+	}
+	return nil
+}
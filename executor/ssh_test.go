@@ -0,0 +1,393 @@
+package executor
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/sulochan/kaas/models"
+)
+
+// sshServer is an ssh server running the commands it is sent with the local
+// bash, standing in for a node.
+type sshServer struct {
+	t      *testing.T
+	config *ssh.ServerConfig
+	ln     net.Listener
+	dials  int32
+
+	mu    sync.Mutex
+	conns []ssh.Conn
+	// rewrite, if set, changes the commands before they run.
+	rewrite func(cmd string) string
+	// drop is a command on which the server closes the connection instead
+	// of running it.
+	drop string
+}
+
+func newSSHServer(t *testing.T) *sshServer {
+	t.Helper()
+	for _, bin := range []string{"bash", "scp", "sha256sum"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s is not installed", bin)
+		}
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sshServer{t: t, config: &ssh.ServerConfig{NoClientAuth: true}, ln: ln}
+	s.config.AddHostKey(signer)
+	t.Cleanup(func() {
+		ln.Close()
+		s.closeConns()
+	})
+	go s.serve()
+	return s
+}
+
+// dial is the Dialer of the nodes of s, it counts the connections.
+func (s *sshServer) dial(n *models.Node) (*ssh.Client, error) {
+	atomic.AddInt32(&s.dials, 1)
+	return ssh.Dial("tcp", s.ln.Addr().String(), &ssh.ClientConfig{
+		User:            "root",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+}
+
+func (s *sshServer) dialCount() int {
+	return int(atomic.LoadInt32(&s.dials))
+}
+
+// closeConns breaks the connections open so far, as a rebooted node would.
+func (s *sshServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *sshServer) setRewrite(rewrite func(cmd string) string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rewrite = rewrite
+}
+
+func (s *sshServer) serve() {
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			conn, chans, reqs, err := ssh.NewServerConn(nc, s.config)
+			if err != nil {
+				nc.Close()
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go ssh.DiscardRequests(reqs)
+			for newChan := range chans {
+				if newChan.ChannelType() != "session" {
+					newChan.Reject(ssh.UnknownChannelType, "session only")
+					continue
+				}
+				ch, reqs, err := newChan.Accept()
+				if err != nil {
+					continue
+				}
+				go s.session(conn, ch, reqs)
+			}
+		}()
+	}
+}
+
+// session runs the exec request of a session with bash and kills it on a
+// signal request.
+func (s *sshServer) session(conn ssh.Conn, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	var cmd *exec.Cmd
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if cmd != nil || ssh.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			s.mu.Lock()
+			command, drop := payload.Command, s.drop
+			if s.rewrite != nil {
+				command = s.rewrite(command)
+			}
+			s.mu.Unlock()
+			if drop != "" && command == drop {
+				conn.Close()
+				return
+			}
+			cmd = exec.Command("bash", "-c", command)
+			cmd.Stdout = ch
+			cmd.Stderr = ch.Stderr()
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				s.t.Error(err)
+				req.Reply(false, nil)
+				continue
+			}
+			if err := cmd.Start(); err != nil {
+				s.t.Error(err)
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go func() {
+				io.Copy(stdin, ch)
+				stdin.Close()
+			}()
+			go func(cmd *exec.Cmd) {
+				status := 0
+				if err := cmd.Wait(); err != nil {
+					status = 255
+					var exitErr *exec.ExitError
+					if errors.As(err, &exitErr) && exitErr.ExitCode() >= 0 {
+						status = exitErr.ExitCode()
+					}
+				}
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+				ch.Close()
+			}(cmd)
+		case "signal":
+			if cmd != nil && cmd.Process != nil {
+				cmd.Process.Kill()
+			}
+			req.Reply(true, nil)
+		default:
+			req.Reply(false, nil)
+		}
+	}
+	if cmd != nil && cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
+
+// line is a line of output as handed to a sink.
+type line struct {
+	node, stream, text string
+}
+
+// recorder is a Sink keeping the lines.
+type recorder struct {
+	mu    sync.Mutex
+	lines []line
+}
+
+func (r *recorder) sink(n *models.Node, stream, text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = append(r.lines, line{n.Name, stream, text})
+}
+
+func (r *recorder) get() []line {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]line(nil), r.lines...)
+}
+
+func testNode(name string) *models.Node {
+	return &models.Node{UUID: "uuid-" + name, Name: name, IP: "10.0.0.4"}
+}
+
+func TestRun(t *testing.T) {
+	srv := newSSHServer(t)
+	var rec recorder
+	s := NewSSH(srv.dial, rec.sink)
+	defer s.Close()
+	n := testNode("node-1")
+	ctx := context.Background()
+
+	out, err := s.Run(ctx, n, Command{Cmd: "echo one; printf two"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "one\ntwo" {
+		t.Errorf("output %q", out)
+	}
+	out, err = s.Run(ctx, n, Command{Cmd: "echo three >&2"})
+	if err != nil || out != "three\n" {
+		t.Errorf("stderr got %q, %v", out, err)
+	}
+	want := []line{{"node-1", Stdout, "one"}, {"node-1", Stdout, "two"}, {"node-1", Stderr, "three"}}
+	if got := rec.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sink got %v, want %v", got, want)
+	}
+
+	out, err = s.Run(ctx, n, Command{Cmd: "tr a-z A-Z", Stdin: strings.NewReader("stdin\n")})
+	if err != nil || out != "STDIN\n" {
+		t.Errorf("with stdin got %q, %v", out, err)
+	}
+}
+
+func TestRunExitError(t *testing.T) {
+	srv := newSSHServer(t)
+	s := NewSSH(srv.dial, nil)
+	defer s.Close()
+	n := testNode("node-1")
+
+	out, err := s.Run(context.Background(), n, Command{Cmd: "echo starting >&2; echo no such unit >&2; exit 3"})
+	exitErr, ok := err.(*ExitError)
+	if !ok {
+		t.Fatalf("got %T %v, want an ExitError", err, err)
+	}
+	if exitErr.Status != 3 || exitErr.Output != "starting\nno such unit\n" || out != exitErr.Output {
+		t.Errorf("got status %d, output %q, returned %q", exitErr.Status, exitErr.Output, out)
+	}
+	if want := "command exited with status 3: no such unit"; err.Error() != want {
+		t.Errorf("error %q, want %q", err, want)
+	}
+
+	// a command failing is not a broken connection
+	if _, err := s.Run(context.Background(), n, Command{Cmd: "true"}); err != nil {
+		t.Fatal(err)
+	}
+	if srv.dialCount() != 1 {
+		t.Errorf("dialed %d times, want 1", srv.dialCount())
+	}
+}
+
+func TestRunTransportError(t *testing.T) {
+	dialErr := errors.New("connection refused")
+	s := NewSSH(func(n *models.Node) (*ssh.Client, error) {
+		return nil, dialErr
+	}, nil)
+	if _, err := s.Run(context.Background(), testNode("node-1"), Command{Cmd: "true"}); err != dialErr {
+		t.Errorf("got %v, want the dial error", err)
+	}
+
+	srv := newSSHServer(t)
+	srv.mu.Lock()
+	srv.drop = "reboot"
+	srv.mu.Unlock()
+	s = NewSSH(srv.dial, nil)
+	defer s.Close()
+	n := testNode("node-1")
+	_, err := s.Run(context.Background(), n, Command{Cmd: "reboot"})
+	if err == nil {
+		t.Fatal("no error on a dropped connection")
+	}
+	if _, ok := err.(*ExitError); ok {
+		t.Fatalf("got an ExitError %v for a dropped connection", err)
+	}
+	if _, err := s.Run(context.Background(), n, Command{Cmd: "true"}); err != nil {
+		t.Fatal(err)
+	}
+	if srv.dialCount() != 2 {
+		t.Errorf("dialed %d times, want 2", srv.dialCount())
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	srv := newSSHServer(t)
+	s := NewSSH(srv.dial, nil)
+	defer s.Close()
+	n := testNode("node-1")
+
+	start := time.Now()
+	out, err := s.Run(context.Background(), n, Command{Cmd: "echo waiting; sleep 30", Timeout: 200 * time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "command on node-1 given up") {
+		t.Fatalf("got %v, want the command given up", err)
+	}
+	if _, ok := err.(*ExitError); ok {
+		t.Errorf("got an ExitError %v for a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("gave up after %v", elapsed)
+	}
+	if out != "waiting\n" {
+		t.Errorf("output %q", out)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	if _, err := s.Run(ctx, n, Command{Cmd: "sleep 30"}); err == nil {
+		t.Fatal("no error on a canceled context")
+	}
+
+	// the connections the commands held are not reused
+	if _, err := s.Run(context.Background(), n, Command{Cmd: "true"}); err != nil {
+		t.Fatal(err)
+	}
+	if srv.dialCount() != 3 {
+		t.Errorf("dialed %d times, want 3", srv.dialCount())
+	}
+}
+
+func TestConnectionReuse(t *testing.T) {
+	srv := newSSHServer(t)
+	s := NewSSH(srv.dial, nil)
+	defer s.Close()
+	ctx := context.Background()
+	n := testNode("node-1")
+
+	for i := 0; i < 3; i++ {
+		if _, err := s.Run(ctx, n, Command{Cmd: "true"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if srv.dialCount() != 1 {
+		t.Fatalf("dialed %d times for one node, want 1", srv.dialCount())
+	}
+
+	// a node whose address changed is dialed again
+	moved := *n
+	moved.IP = "10.0.0.5"
+	if _, err := s.Run(ctx, &moved, Command{Cmd: "true"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Run(ctx, testNode("node-2"), Command{Cmd: "true"}); err != nil {
+		t.Fatal(err)
+	}
+	if srv.dialCount() != 3 {
+		t.Fatalf("dialed %d times for three nodes, want 3", srv.dialCount())
+	}
+
+	// connections broken while idle are dialed again
+	srv.closeConns()
+	if _, err := s.Run(ctx, n, Command{Cmd: "true"}); err != nil {
+		t.Fatalf("after the connection broke: %v", err)
+	}
+	if srv.dialCount() != 4 {
+		t.Fatalf("dialed %d times after the connection broke, want 4", srv.dialCount())
+	}
+
+	s.Close()
+	if _, err := s.Run(ctx, n, Command{Cmd: "true"}); err != nil {
+		t.Fatal(err)
+	}
+	if srv.dialCount() != 5 {
+		t.Errorf("dialed %d times after Close, want 5", srv.dialCount())
+	}
+}
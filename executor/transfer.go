@@ -0,0 +1,62 @@
+package executor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultMode is the mode of the files uploaded without one, only root can
+// read them.
+const DefaultMode os.FileMode = 0600
+
+// FileOpts are the attributes of an uploaded file.
+type FileOpts struct {
+	// Mode is the permissions of the file, zero is DefaultMode.
+	Mode os.FileMode
+	// Owner is the user:group owning the file, empty leaves it to root.
+	Owner string
+}
+
+// Quote returns s single quoted for the shell of the nodes.
+func Quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Checksum returns the sha256 of content as printed by sha256sum.
+func Checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// checksumOf returns the checksum in the output of sha256sum.
+func checksumOf(out string) string {
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// tempPath is where an upload of path is written before it is renamed over
+// path, in the same directory so that the rename is atomic.
+func tempPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".kaas-upload")
+}
+
+// finishUpload is the command giving the upload of path at tmp its mode and
+// owner and printing its checksum.
+func finishUpload(tmp string, opts FileOpts) string {
+	mode := opts.Mode
+	if mode == 0 {
+		mode = DefaultMode
+	}
+	cmd := fmt.Sprintf("chmod %o %s", mode.Perm(), Quote(tmp))
+	if opts.Owner != "" {
+		cmd += " && chown " + Quote(opts.Owner) + " " + Quote(tmp)
+	}
+	return cmd + " && sha256sum " + Quote(tmp)
+}
@@ -0,0 +1,206 @@
+package executor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	tests := map[string]string{
+		"":                 "''",
+		"/etc/kubernetes":  "'/etc/kubernetes'",
+		"it's":             `'it'\''s'`,
+		"$(reboot) `id` *": "'$(reboot) `id` *'",
+	}
+	for s, want := range tests {
+		if got := Quote(s); got != want {
+			t.Errorf("Quote(%q) = %s, want %s", s, got, want)
+		}
+	}
+}
+
+func TestFinishUpload(t *testing.T) {
+	tests := []struct {
+		opts FileOpts
+		want string
+	}{
+		{FileOpts{}, "chmod 600 '/etc/.a.kaas-upload' && sha256sum '/etc/.a.kaas-upload'"},
+		{FileOpts{Mode: 0755}, "chmod 755 '/etc/.a.kaas-upload' && sha256sum '/etc/.a.kaas-upload'"},
+		{FileOpts{Mode: 0640, Owner: "etcd:etcd"},
+			"chmod 640 '/etc/.a.kaas-upload' && chown 'etcd:etcd' '/etc/.a.kaas-upload' && sha256sum '/etc/.a.kaas-upload'"},
+	}
+	for _, tt := range tests {
+		if got := finishUpload(tempPath("/etc/a"), tt.opts); got != tt.want {
+			t.Errorf("finishUpload(%+v) = %s, want %s", tt.opts, got, tt.want)
+		}
+	}
+}
+
+// commandLog makes srv record the commands it runs.
+func commandLog(srv *sshServer) func() []string {
+	var mu sync.Mutex
+	var cmds []string
+	srv.setRewrite(func(cmd string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		cmds = append(cmds, cmd)
+		return cmd
+	})
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), cmds...)
+	}
+}
+
+// badChecksums makes srv lie about the checksum of every file.
+func badChecksums(srv *sshServer) {
+	srv.setRewrite(func(cmd string) string {
+		return strings.Replace(cmd, "sha256sum", "echo 0000", -1)
+	})
+}
+
+// listDir returns the names in dir.
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+func TestUpload(t *testing.T) {
+	srv := newSSHServer(t)
+	s := NewSSH(srv.dial, nil)
+	defer s.Close()
+	n := testNode("node-1")
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "it's here")
+	path := filepath.Join(dir, "admin.conf")
+	commands := commandLog(srv)
+
+	if err := s.Upload(ctx, n, path, []byte("first"), FileOpts{Mode: 0640}); err != nil {
+		t.Fatal(err)
+	}
+	tmp := tempPath(path)
+	want := []string{
+		"mkdir -p " + Quote(dir),
+		"scp -qt " + Quote(tmp),
+		finishUpload(tmp, FileOpts{Mode: 0640}),
+		"mv -f " + Quote(tmp) + " " + Quote(path),
+	}
+	if got := commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil || string(content) != "first" {
+		t.Fatalf("uploaded %q, %v", content, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("mode %o, want 640", info.Mode().Perm())
+	}
+
+	if err := s.Upload(ctx, n, path, []byte("second"), FileOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "second" {
+		t.Errorf("replaced with %q", content)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != DefaultMode {
+		t.Errorf("mode %o, want %o", info.Mode().Perm(), DefaultMode)
+	}
+	if names := listDir(t, dir); !reflect.DeepEqual(names, []string{"admin.conf"}) {
+		t.Errorf("left %v in the directory", names)
+	}
+}
+
+func TestUploadFailure(t *testing.T) {
+	srv := newSSHServer(t)
+	s := NewSSH(srv.dial, nil)
+	defer s.Close()
+	n := testNode("node-1")
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "admin.conf")
+	if err := ioutil.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		setup   func()
+		opts    FileOpts
+		wantErr string
+	}{
+		{
+			name:    "checksum mismatch",
+			setup:   func() { badChecksums(srv) },
+			wantErr: "checksum mismatch: got 0000, sent " + Checksum([]byte("new")),
+		},
+		{
+			name:    "unknown owner",
+			setup:   func() { srv.setRewrite(nil) },
+			opts:    FileOpts{Owner: "kaas-no-such-user"},
+			wantErr: "command exited with status 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			err := s.Upload(ctx, n, path, []byte("new"), tt.opts)
+			if err == nil || !strings.HasPrefix(err.Error(), "upload of "+path+" to node-1: "+tt.wantErr) {
+				t.Fatalf("got %v, want %s", err, tt.wantErr)
+			}
+			// the file is left as it was and the temporary file removed
+			if content, _ := ioutil.ReadFile(path); string(content) != "old" {
+				t.Errorf("file changed to %q", content)
+			}
+			if names := listDir(t, dir); !reflect.DeepEqual(names, []string{"admin.conf"}) {
+				t.Errorf("left %v in the directory", names)
+			}
+		})
+	}
+}
+
+func TestDownload(t *testing.T) {
+	srv := newSSHServer(t)
+	s := NewSSH(srv.dial, nil)
+	defer s.Close()
+	n := testNode("node-1")
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "ca.crt")
+	if err := ioutil.WriteFile(path, []byte("certificate\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := s.Download(ctx, n, path)
+	if err != nil || string(content) != "certificate\n" {
+		t.Fatalf("got %q, %v", content, err)
+	}
+
+	_, err = s.Download(ctx, n, path+".missing")
+	if err == nil || !strings.HasPrefix(err.Error(), "download of "+path+".missing from node-1: ") {
+		t.Errorf("got %v for a missing file", err)
+	}
+
+	badChecksums(srv)
+	_, err = s.Download(ctx, n, path)
+	if want := "checksum mismatch: got " + Checksum([]byte("certificate\n")) + ", expected 0000"; err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("got %v, want %s", err, want)
+	}
+}
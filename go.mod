@@ -12,6 +12,8 @@ require (
 	github.com/os-pc/gocloudlb v0.0.0-20210529010120-65b17b6d1ffa
 	github.com/pborman/uuid v1.2.1
 	github.com/sirupsen/logrus v1.8.1
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
+	gopkg.in/yaml.v2 v2.4.0
 )
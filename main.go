@@ -1,16 +1,90 @@
 package main
 
 import (
-	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
 
 	"github.com/gorilla/mux"
 	"github.com/justinas/alice"
 	log "github.com/sirupsen/logrus"
 	"github.com/sulochan/kaas/api"
+	"github.com/sulochan/kaas/cloudinit"
+	"github.com/sulochan/kaas/config"
+	"github.com/sulochan/kaas/db/backend"
+	"github.com/sulochan/kaas/executor"
+	fakeexec "github.com/sulochan/kaas/executor/fake"
+	"github.com/sulochan/kaas/models"
+	"github.com/sulochan/kaas/provider"
+	"github.com/sulochan/kaas/provider/fake"
+	"github.com/sulochan/kaas/secret"
+	"golang.org/x/crypto/ssh"
 )
 
 func main() {
+	conf, err := config.Load(os.Args[0], os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	api.SetConfig(conf)
+
+	key, err := secret.ParseKey(conf.EncryptionKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	box, err := secret.NewBox(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	api.SetSecretBox(box)
+
+	templates, err := cloudinit.Load(conf.Machine.UserDataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	api.SetCloudInit(templates)
+
+	if conf.SSH.BastionKeyFile != "" {
+		content, err := ioutil.ReadFile(conf.SSH.BastionKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bastionKey, err := ssh.ParsePrivateKey(content)
+		if err != nil {
+			log.Fatal("bastion key: ", err)
+		}
+		api.SetBastionKey(bastionKey)
+	}
+
+	store, err := backend.Open(backend.Options{
+		Backend:  conf.DB.Backend,
+		MongoURL: conf.DB.MongoURL,
+		BoltPath: conf.DB.BoltPath,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	api.SetStore(store)
+
+	if conf.Provider == "fake" {
+		// one cloud shared by every request, so clusters survive between calls
+		fakeCloud := fake.New()
+		api.SetProvider(func(models.AuthOpts, *models.Cluster) (provider.Provider, error) {
+			return fakeCloud, nil
+		})
+		// its servers are not real either, they play one kubeadm cluster
+		// per kaas cluster
+		fakeNodes := fakeexec.New(nil)
+		fakeNodes.Kubernetes(fakeCloud)
+		api.SetExecutor(func(executor.Dialer, executor.Sink) executor.Executor {
+			return fakeNodes
+		})
+	}
+
+	if err := api.ResumeProvisioning(); err != nil {
+		log.Error("Error resuming cluster provisioning: ", err)
+	}
+
 	chain := alice.New()
 	router := mux.NewRouter()
 	http.Handle("/", router)
@@ -25,18 +99,25 @@ func main() {
 	apiRouter.Handle("/clusters", chain.Append(api.SetContext).ThenFunc(api.GetAllClusters)).Methods("GET")
 	apiRouter.Handle("/clusters/{cluster:[[A-Z,a-z,0-9,-]+}", chain.Append(api.SetContext).ThenFunc(api.GetCluster)).Methods("GET")
 	apiRouter.Handle("/clusters/{cluster:[A-Z,a-z,0-9,-]+}/nodes", chain.Append(api.SetContext).ThenFunc(api.GetClusterNodes)).Methods("GET")
+	apiRouter.Handle("/clusters/{cluster:[A-Z,a-z,0-9,-]+}/kubeconfig", chain.Append(api.SetContext).ThenFunc(api.GetKubeconfig)).Methods("GET")
+	apiRouter.Handle("/clusters/{cluster:[A-Z,a-z,0-9,-]+}/operations", chain.Append(api.SetContext).ThenFunc(api.GetClusterOperations)).Methods("GET")
+	apiRouter.Handle("/cloud-init/preview", chain.Append(api.SetContext).ThenFunc(api.PreviewCloudInit)).Methods("POST")
+	apiRouter.Handle("/kubernetes/versions", chain.Append(api.SetContext).ThenFunc(api.GetKubernetesVersions)).Methods("GET")
+	apiRouter.Handle("/operations/{id:[A-Z,a-z,0-9,-]+}", chain.Append(api.SetContext).ThenFunc(api.GetOperation)).Methods("GET")
 
 	apiRouter.Handle("/clusters", chain.Append(api.SetContext).ThenFunc(api.CreateCluster)).Methods("POST")
 	apiRouter.Handle("/clusters/{cluster:[[A-Z,a-z,0-9,-]+}", chain.Append(api.SetContext).ThenFunc(api.UpdateCluster)).Methods("POST")
 
+	apiRouter.Handle("/clusters/{cluster:[A-Z,a-z,0-9,-]+}/upgrade", chain.Append(api.SetContext).ThenFunc(api.UpgradeCluster)).Methods("POST")
+
 	apiRouter.Handle("/clusters/{cluster:[A-Z,a-z,0-9,-]+}", chain.Append(api.SetContext).ThenFunc(api.DeleteCluster)).Methods("DELETE")
 	apiRouter.Handle("/clusters/{cluster:[[A-Z,a-z,0-9,-]+}/nodes/{node:[A-Z,a-z,0-9,-]+}", chain.Append(api.SetContext).ThenFunc(api.DeleteClusterNode)).Methods("DELETE")
 
 	apiRouter.Handle("/get_next_job", chain.Append(api.SetContext).ThenFunc(api.GetNextJob)).Methods("GET")
 	apiRouter.Handle("/update_job", chain.Append(api.SetContext).ThenFunc(api.UpdateJob)).Methods("GET")
 
-	if err := http.ListenAndServe(fmt.Sprintf(":%s", "9191"), nil); err != nil {
-		log.Info("http.ListendAndServer() failed with %s\n", err)
+	if err := http.ListenAndServe(conf.Listen, nil); err != nil {
+		log.Infof("http.ListendAndServer() failed with %s\n", err)
 	}
 	log.Info("Exited\n")
 }
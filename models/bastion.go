@@ -0,0 +1,15 @@
+package models
+
+// Bastion is the jump host kaas reaches the nodes of a cluster on a private
+// network through. FirstMaster jumps through the first master of the
+// cluster, which must have a public address, instead of a host of its own.
+type Bastion struct {
+	FirstMaster bool `yaml:"first_master" json:"first_master"`
+	// Address is the host:port of the bastion, kaas logs in as User with
+	// the bastion key of the server.
+	Address string `yaml:"address" json:"address"`
+	User    string `yaml:"user" json:"user"`
+	// HostKey is the SHA256 fingerprint of the ssh host key of the bastion,
+	// as printed by ssh-keygen -l.
+	HostKey string `yaml:"host_key" json:"host_key"`
+}
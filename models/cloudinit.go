@@ -0,0 +1,21 @@
+package models
+
+// Container runtimes of the nodes.
+const (
+	RuntimeContainerd = "containerd"
+	RuntimeDocker     = "docker"
+)
+
+// CloudInitSpec is what the cloud-init of the VMs of a cluster is rendered
+// with, next to its kubernetes version. An empty ContainerRuntime is
+// containerd.
+type CloudInitSpec struct {
+	ContainerRuntime string `json:"container_runtime"`
+	HTTPProxy        string `json:"http_proxy"`
+	HTTPSProxy       string `json:"https_proxy"`
+	NoProxy          string `json:"no_proxy"`
+	// RegistryMirrors are pulled from instead of docker.io.
+	RegistryMirrors []string          `json:"registry_mirrors"`
+	ExtraPackages   []string          `json:"extra_packages"`
+	Sysctls         map[string]string `json:"sysctls"`
+}
@@ -3,28 +3,89 @@ package models
 import (
 	"time"
 
-	"github.com/gophercloud/gophercloud"
 	"github.com/os-pc/gocloudlb/loadbalancers"
 )
 
+// Cluster statuses. A cluster goes Pending -> ProvisioningInfra ->
+// Bootstrapping -> Joining -> Ready, or ends up Failed when provisioning gives
+// up. Degraded is a cluster whose control plane is up but that could not be
+// fully provisioned. A Ready or Degraded cluster goes through Scaling when its
+// worker count changes, through Repairing when a node is removed or replaced
+// and through Upgrading when its kubernetes version changes. Deleting and
+// Deleted are set by DeleteCluster.
+const (
+	StatusPending           = "Pending"
+	StatusProvisioningInfra = "ProvisioningInfra"
+	StatusBootstrapping     = "Bootstrapping"
+	StatusJoining           = "Joining"
+	StatusReady             = "Ready"
+	StatusDegraded          = "Degraded"
+	StatusScaling           = "Scaling"
+	StatusRepairing         = "Repairing"
+	StatusUpgrading         = "Upgrading"
+	StatusFailed            = "Failed"
+	StatusDeleting          = "Deleting"
+	StatusDeleted           = "Deleted"
+)
+
 type Cluster struct {
 	UUID         string `json:"uuid"`
 	Name         string `json:"name"`
-	Config       string `json:"config"`
-	URL          string `json:"url"`
+	Config       string `json:"config"` // admin kubeconfig, sealed with the server key
+	URL          string `json:"url"`    // api server of Config
 	LBNode       *loadbalancers.LoadBalancer
-	Master       int     `json:"master"`
-	MasterNodes  []*Node `json:"masternodes"`
-	Worker       int     `json:"worker"`
-	WorkerNodes  []*Node `json:"workernodes"`
-	Etcd         int     `json:"etcd"`
-	EtcdNodes    []*Node `json:"etcdnodes"`
-	ExternalEtcd bool    `json:"externaletcd"`
-	Nodes        []*Node `json:"nodes"`
-	OSClient     *gophercloud.ServiceClient
+	Master       int       `json:"master"`
+	MasterNodes  []*Node   `json:"masternodes"`
+	Worker       int       `json:"worker"`
+	WorkerNodes  []*Node   `json:"workernodes"`
+	Etcd         int       `json:"etcd"`
+	EtcdNodes    []*Node   `json:"etcdnodes"`
+	ExternalEtcd bool      `json:"externaletcd"`
+	Nodes        []*Node   `json:"nodes"`
 	CreatedAt    time.Time `json:"createdat"`
 	Deleted      int       `json:"deleted"`
 	Status       string    `json:"status"`
+	StatusReason string    `json:"status_reason"`
+	// Revision is bumped by the store on every update and used for
+	// compare-and-swap, see db.ClusterStore.
+	Revision     int64        `json:"revision"`
+	Provisioning Provisioning `json:"provisioning"`
+	// LoadBalancer is the api lb of the cluster. LBNode is the Rackspace lb
+	// of clusters created before it existed, only read to upgrade them.
+	LoadBalancer *LoadBalancer `json:"loadbalancer"`
+	// LBProvider is the lb service of the cluster. It is empty on clusters
+	// created before it existed, which all use LBProviderCloudLB.
+	LBProvider string `json:"lb_provider"`
+	// Machines are the VMs of each role, see MachineSpec.
+	Machines MachineSpecs `json:"machines"`
+	// EtcdCA signs the certificates of an ExternalEtcd cluster, its members
+	// and the api servers talking to it.
+	EtcdCA *SealedKeyPair `json:"etcd_ca"`
+	// Kubeadm is the spec of the kubeadm configuration of the cluster.
+	Kubeadm KubeadmSpec `json:"kubeadm"`
+	// CNI is the pod network of the cluster, see CNISpec. It is empty on
+	// clusters created before it existed, which all run calico.
+	CNI CNISpec `json:"cni"`
+	// KubernetesVersion is the version the packages of the nodes are pinned
+	// to. It is empty on clusters created before it existed.
+	KubernetesVersion string `json:"kubernetes_version"`
+	// CloudInit is what the user-data of the VMs is rendered with.
+	CloudInit CloudInitSpec `json:"cloud_init"`
+	// CA is the kubernetes CA, created before kubeadm init. Clusters
+	// initialized before it existed only have its certificate.
+	CA *SealedKeyPair `json:"ca"`
+	// BootstrapToken and CertificateKey are the credentials of the last
+	// kubeadm join, generated by kaas and sealed with the server key.
+	BootstrapToken string `json:"bootstrap_token"`
+	CertificateKey string `json:"certificate_key"`
+	// SSHPublicKey is the authorized_keys line of the ed25519 key kaas logs
+	// in to the nodes with, SSHPrivateKey its private key sealed with the
+	// server key. Both are empty on clusters created before they existed.
+	SSHPublicKey  string `json:"ssh_public_key"`
+	SSHPrivateKey string `json:"ssh_private_key"`
+	// Bastion is the jump host of the cluster. Without one the bastion of
+	// its region in the server configuration is used, if any.
+	Bastion *Bastion `json:"bastion"`
 	// accounted related info
 	ProjectId string `json:"projectid"`
 	CreatedBy string `json:"createdby"`
@@ -42,7 +103,13 @@ type Node struct {
 	InternalIP string
 	Roles      []string
 	Name       string
-	Password   string
-	UUID       string
-	Type       string
+	// Password is the root password of nodes created before clusters had an
+	// ssh key, only kept until the key is authorized on them.
+	Password string `json:"-" bson:",omitempty"`
+	UUID     string
+	Type     string
+	// HostKeys are the SHA256 fingerprints of the ssh host keys of the node,
+	// read from its console when it was built. Connections to a node
+	// presenting another key are refused.
+	HostKeys []string
 }
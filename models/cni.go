@@ -0,0 +1,20 @@
+package models
+
+// CNI plugins a cluster can be deployed with. CNINone leaves the pod network
+// to the user.
+const (
+	CNICalico  = "calico"
+	CNIFlannel = "flannel"
+	CNICilium  = "cilium"
+	CNINone    = "none"
+)
+
+// CNIPlugins are the valid CNISpec plugins.
+var CNIPlugins = []string{CNICalico, CNIFlannel, CNICilium, CNINone}
+
+// CNISpec is the pod network plugin of a cluster. An empty Version is the
+// default version of the plugin.
+type CNISpec struct {
+	Plugin  string `json:"plugin"`
+	Version string `json:"version"`
+}
@@ -10,4 +10,6 @@ type Job struct {
 	Category   string `json:"category"`
 	Command    string `json:"command"`
 	Data       string `json:"data"`
+	ProjectId  string `json:"projectid"`
+	Deleted    int    `json:"deleted"`
 }
@@ -0,0 +1,14 @@
+package models
+
+// KeyPair is a PEM encoded certificate and its private key.
+type KeyPair struct {
+	Cert []byte `json:"cert"`
+	Key  []byte `json:"key"`
+}
+
+// SealedKeyPair is a KeyPair as stored, its private key sealed with the
+// server key. Key is empty when only the certificate is known.
+type SealedKeyPair struct {
+	Cert []byte `json:"cert"`
+	Key  string `json:"key"`
+}
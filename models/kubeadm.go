@@ -0,0 +1,31 @@
+package models
+
+// Networks of clusters created without them.
+const (
+	DefaultPodSubnet     = "192.168.0.0/16"
+	DefaultServiceSubnet = "10.96.0.0/12"
+)
+
+// KubeadmSpec is what the kubeadm configuration of a cluster is rendered
+// from.
+type KubeadmSpec struct {
+	PodSubnet     string `json:"pod_subnet"`
+	ServiceSubnet string `json:"service_subnet"`
+	// CertSANs are added to the api server certificate, next to the lb vip.
+	CertSANs []string `json:"cert_sans"`
+	// FeatureGates are passed to the control plane components and the
+	// kubelets.
+	FeatureGates     map[string]bool   `json:"feature_gates"`
+	KubeletExtraArgs map[string]string `json:"kubelet_extra_args"`
+}
+
+// WithDefaults returns s with the default networks where it has none.
+func (s KubeadmSpec) WithDefaults() KubeadmSpec {
+	if s.PodSubnet == "" {
+		s.PodSubnet = DefaultPodSubnet
+	}
+	if s.ServiceSubnet == "" {
+		s.ServiceSubnet = DefaultServiceSubnet
+	}
+	return s
+}
@@ -0,0 +1,20 @@
+package models
+
+// Load balancer services a cluster can put its api behind.
+const (
+	LBProviderCloudLB = "cloudlb"
+	LBProviderOctavia = "octavia"
+)
+
+// LoadBalancer is the api lb of a cluster, as reported by the provider that
+// created it.
+type LoadBalancer struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Port   int    `json:"port"`
+	// VIP is the public virtual ip the control plane endpoint points at.
+	VIP string `json:"vip"`
+	// Nodes are the addresses of the attached members.
+	Nodes []string `json:"nodes"`
+}
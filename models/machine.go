@@ -0,0 +1,33 @@
+package models
+
+// MachineSpec describes the VMs of a role. Flavor and Image are filled in
+// from the server configuration when a cluster is created without them.
+type MachineSpec struct {
+	Flavor string `json:"flavor"`
+	Image  string `json:"image"`
+	// VolumeSize, in GB, boots the VMs from a volume of VolumeType instead
+	// of the local disk of the flavor.
+	VolumeSize       int               `json:"volume_size"`
+	VolumeType       string            `json:"volume_type"`
+	AvailabilityZone string            `json:"availability_zone"`
+	Metadata         map[string]string `json:"metadata"`
+}
+
+// MachineSpecs are the machine specs of each role of a cluster.
+type MachineSpecs struct {
+	Master MachineSpec `json:"master"`
+	Worker MachineSpec `json:"worker"`
+	Etcd   MachineSpec `json:"etcd"`
+}
+
+// For returns the spec of role, master, worker or etcd.
+func (m *MachineSpecs) For(role string) *MachineSpec {
+	switch role {
+	case "master":
+		return &m.Master
+	case "etcd":
+		return &m.Etcd
+	default:
+		return &m.Worker
+	}
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"time"
+)
+
+// Operation types
+const (
+	OperationCreate  = "create"
+	OperationUpdate  = "update"
+	OperationDelete  = "delete"
+	OperationUpgrade = "upgrade"
+)
+
+// Operation states
+const (
+	OperationPending   = "Pending"
+	OperationRunning   = "Running"
+	OperationSucceeded = "Succeeded"
+	OperationFailed    = "Failed"
+)
+
+// Operation tracks a long running change to a cluster. The API answers
+// create, update and delete requests with one and callers poll it.
+type Operation struct {
+	ID          string `json:"id"`
+	Type        string `json:"type"`
+	ClusterUUID string `json:"cluster_uuid"`
+	State       string `json:"state"`
+	// Progress is a percentage, 100 once the operation succeeded.
+	Progress   int       `json:"progress"`
+	Message    string    `json:"message"`
+	Error      string    `json:"error"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// Nodes is the progress of each node of an upgrade, in the order they
+	// are upgraded.
+	Nodes []NodeProgress `json:"nodes,omitempty"`
+	// Output is the last lines printed by the commands run on the nodes.
+	Output []string `json:"output,omitempty"`
+	// accounted related info
+	ProjectId string `json:"projectid"`
+	CreatedBy string `json:"created_by"`
+}
+
+// NodeProgress is the state of one node in an operation, one of the
+// operation states.
+type NodeProgress struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
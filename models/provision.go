@@ -0,0 +1,125 @@
+package models
+
+import (
+	"time"
+)
+
+// Provisioning steps, run in this order by the provisioning worker.
+const (
+	StepCreateLB          = "CreateLB"
+	StepCreateVMs         = "CreateVMs"
+	StepTrackVMBuild      = "TrackVMBuild"
+	StepAttachFirstMaster = "AttachFirstMaster"
+	StepDeployEtcd        = "DeployEtcd"
+	StepRunDeploy         = "RunDeploy"
+	StepAttachMastersToLB = "AttachMastersToLB"
+)
+
+// Scaling steps, run in this order when the worker count changes. Scaling
+// reuses StepCreateVMs and StepTrackVMBuild for the new workers.
+const (
+	StepRemoveWorkers = "RemoveWorkers"
+	StepJoinWorkers   = "JoinWorkers"
+)
+
+// Node removal steps. A replacement also runs StepCreateVMs and
+// StepTrackVMBuild between them.
+const (
+	StepRemoveNode = "RemoveNode"
+	StepJoinNodes  = "JoinNodes"
+)
+
+// Upgrade steps, run in this order when the kubernetes version changes. A
+// failed upgrade step is not retried, the upgrade halts on the first node
+// that fails.
+const (
+	StepUpgradePreflight   = "UpgradePreflight"
+	StepUpgradeFirstMaster = "UpgradeFirstMaster"
+	StepUpgradeMasters     = "UpgradeMasters"
+	StepUpgradeWorkers     = "UpgradeWorkers"
+)
+
+// Step statuses
+const (
+	StepPending = "Pending"
+	StepRunning = "Running"
+	StepDone    = "Done"
+	StepFailed  = "Failed"
+)
+
+// Step is the persisted state of one provisioning step.
+type Step struct {
+	Name       string    `json:"name"`
+	Status     string    `json:"status"`
+	Attempts   int       `json:"attempts"`
+	Error      string    `json:"error"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// Provisioning is the persisted state machine of a cluster build. Active is
+// true until every step is done or one of them failed for good; a restarted
+// kaas resumes every active cluster from its first step that is not done.
+type Provisioning struct {
+	Active bool   `json:"active"`
+	Steps  []Step `json:"steps"`
+	// Type is the type of the operation the steps belong to, OperationCreate
+	// for the build of the cluster, OperationUpdate for a scaling or a node
+	// removal, or OperationUpgrade. It is empty on clusters created before
+	// it existed.
+	Type string `json:"type"`
+	// Node is the uuid of the node a removal is about.
+	Node string `json:"node"`
+	// Version is the kubernetes version an upgrade moves to.
+	Version string `json:"version"`
+	// OperationId is the operation reporting the progress.
+	OperationId string `json:"operation_id"`
+	// Credentials are the AuthOpts of the user who started the operation,
+	// sealed with the server key, kept so that a restarted kaas can resume it
+	// on their behalf. They are cleared once provisioning is not active.
+	Credentials string `json:"credentials"`
+}
+
+func newProvisioning(opType string, credentials string, steps ...string) Provisioning {
+	p := Provisioning{Active: true, Type: opType, Credentials: credentials}
+	for _, name := range steps {
+		p.Steps = append(p.Steps, Step{Name: name, Status: StepPending})
+	}
+	return p
+}
+
+// NewProvisioning returns an active state machine building a cluster, with
+// every step pending.
+func NewProvisioning(credentials string) Provisioning {
+	return newProvisioning(OperationCreate, credentials, StepCreateLB, StepCreateVMs, StepTrackVMBuild,
+		StepAttachFirstMaster, StepDeployEtcd, StepRunDeploy, StepAttachMastersToLB)
+}
+
+// NewScaling returns an active state machine bringing the workers of a
+// cluster to its worker count, with every step pending.
+func NewScaling(credentials string) Provisioning {
+	return newProvisioning(OperationUpdate, credentials, StepRemoveWorkers, StepCreateVMs, StepTrackVMBuild,
+		StepJoinWorkers)
+}
+
+// NewNodeRemoval returns an active state machine removing node from a
+// cluster, and creating a node of the same role in its place if replace is
+// set.
+func NewNodeRemoval(credentials string, node string, replace bool) Provisioning {
+	p := newProvisioning(OperationUpdate, credentials, StepRemoveNode)
+	if replace {
+		p = newProvisioning(OperationUpdate, credentials, StepRemoveNode, StepCreateVMs, StepTrackVMBuild,
+			StepJoinNodes)
+	}
+	p.Node = node
+	return p
+}
+
+// NewUpgrade returns an active state machine upgrading a cluster to
+// kubernetes version, with every step pending.
+func NewUpgrade(credentials string, version string) Provisioning {
+	p := newProvisioning(OperationUpgrade, credentials, StepUpgradePreflight, StepUpgradeFirstMaster,
+		StepUpgradeMasters, StepUpgradeWorkers)
+	p.Version = version
+	return p
+}
@@ -0,0 +1,158 @@
+// Package pki creates the certificate authorities and certificates kaas
+// hands out to cluster nodes. Keys are ECDSA P-256, everything is PEM encoded
+// in a models.KeyPair.
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/sulochan/kaas/models"
+)
+
+// CAValidity is how long a CA created by NewCA is valid.
+const CAValidity = 10 * 365 * 24 * time.Hour
+
+// CertOpts describes a certificate to sign.
+type CertOpts struct {
+	CommonName   string
+	Organization []string
+	IPs          []net.IP
+	DNSNames     []string
+	Usages       []x509.ExtKeyUsage
+	Validity     time.Duration
+}
+
+func newKey() (*ecdsa.PrivateKey, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// NewCA returns a self signed certificate authority named commonName.
+func NewCA(commonName string) (*models.KeyPair, error) {
+	key, keyPEM, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(CAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &models.KeyPair{Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), Key: keyPEM}, nil
+}
+
+// parse returns the certificate and the key of ca.
+func parse(ca *models.KeyPair) (*x509.Certificate, crypto.Signer, error) {
+	block, _ := pem.Decode(ca.Cert)
+	if block == nil {
+		return nil, nil, errors.New("pki: no certificate in ca")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _ = pem.Decode(ca.Key)
+	if block == nil {
+		return nil, nil, errors.New("pki: no key in ca")
+	}
+	var key crypto.Signer
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, nil, errors.New("pki: unsupported key type " + block.Type)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// Sign returns a new key and its certificate described by opts, signed by
+// ca.
+func Sign(ca *models.KeyPair, opts CertOpts) (*models.KeyPair, error) {
+	caCert, caKey, err := parse(ca)
+	if err != nil {
+		return nil, err
+	}
+	key, keyPEM, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: opts.CommonName, Organization: opts.Organization},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(opts.Validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  opts.Usages,
+		IPAddresses:  opts.IPs,
+		DNSNames:     opts.DNSNames,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, key.Public(), caKey)
+	if err != nil {
+		return nil, err
+	}
+	return &models.KeyPair{Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), Key: keyPEM}, nil
+}
+
+// PublicKeyHash returns the sha256 hash of the public key of the PEM
+// certificate cert, as kubeadm pins a CA with.
+func PublicKeyHash(cert []byte) (string, error) {
+	block, _ := pem.Decode(cert)
+	if block == nil {
+		return "", errors.New("pki: no certificate")
+	}
+	c, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,124 @@
+package pki
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sulochan/kaas/models"
+)
+
+func parseCert(t *testing.T, content []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(content)
+	if block == nil {
+		t.Fatal("no PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestSign(t *testing.T) {
+	ca, err := NewCA("kubernetes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewCA("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(parseCert(t, ca.Cert))
+	otherRoots := x509.NewCertPool()
+	otherRoots.AddCert(parseCert(t, other.Cert))
+
+	tests := []struct {
+		name  string
+		opts  CertOpts
+		usage x509.ExtKeyUsage
+	}{
+		{
+			name: "client",
+			opts: CertOpts{CommonName: "alice", Organization: []string{"dev", "ops"},
+				Usages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, Validity: time.Hour},
+			usage: x509.ExtKeyUsageClientAuth,
+		},
+		{
+			name: "server",
+			opts: CertOpts{CommonName: "etcd-1", IPs: []net.IP{net.ParseIP("10.0.0.4")}, DNSNames: []string{"etcd-1"},
+				Usages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, Validity: 24 * time.Hour},
+			usage: x509.ExtKeyUsageServerAuth,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signed, err := Sign(ca, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert := parseCert(t, signed.Cert)
+			if cert.Subject.CommonName != tt.opts.CommonName {
+				t.Errorf("common name %q, want %q", cert.Subject.CommonName, tt.opts.CommonName)
+			}
+			if len(cert.Subject.Organization) != len(tt.opts.Organization) {
+				t.Errorf("organizations %v, want %v", cert.Subject.Organization, tt.opts.Organization)
+			}
+			if d := cert.NotAfter.Sub(time.Now()); d > tt.opts.Validity || d < tt.opts.Validity-time.Minute {
+				t.Errorf("valid for %v more, want %v", d, tt.opts.Validity)
+			}
+			_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{tt.usage}})
+			if err != nil {
+				t.Errorf("not signed by the ca: %v", err)
+			}
+			_, err = cert.Verify(x509.VerifyOptions{Roots: otherRoots, KeyUsages: []x509.ExtKeyUsage{tt.usage}})
+			if err == nil {
+				t.Error("verified by another ca")
+			}
+
+			// the key must be the one of the certificate
+			if _, _, err := parse(signed); err != nil {
+				t.Errorf("key pair does not parse: %v", err)
+			}
+		})
+	}
+
+	// a ca read back from a node has no key
+	if _, err := Sign(&models.KeyPair{Cert: ca.Cert}, CertOpts{CommonName: "alice", Validity: time.Hour}); err == nil {
+		t.Error("signed without a ca key")
+	}
+}
+
+func TestPublicKeyHash(t *testing.T) {
+	ca, err := NewCA("kubernetes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(parseCert(t, ca.Cert).RawSubjectPublicKeyInfo)
+
+	tests := []struct {
+		name    string
+		cert    []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "ca", cert: ca.Cert, want: "sha256:" + hex.EncodeToString(sum[:])},
+		{name: "not PEM", cert: []byte("not a certificate"), wantErr: true},
+		{name: "not a certificate", cert: ca.Key, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := PublicKeyHash(tt.cert)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
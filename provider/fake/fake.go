@@ -0,0 +1,322 @@
+// Package fake is a deterministic, in-memory provider.Provider for running
+// the provisioning pipeline without a cloud. Servers and load balancers go
+// from BUILD to ACTIVE after a fixed number of Get calls, get sequential ip
+// addresses, and can be told to fail.
+package fake
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/sulochan/kaas/models"
+	"github.com/sulochan/kaas/provider"
+)
+
+// NotFound is returned for unknown server and load balancer ids.
+// DeleteServer returns provider.ErrNotFound instead, as Servers asks.
+var NotFound = errors.New("fake: not found")
+
+type lb struct {
+	models.LoadBalancer
+	polls int
+}
+
+type server struct {
+	provider.Server
+	polls int
+	// hostKey is the authorized_keys line of the ssh host key of the
+	// server, printed on its console once ACTIVE.
+	hostKey string
+}
+
+// Provider is the fake implementation of provider.Provider. The exported
+// fields may be changed at any time.
+type Provider struct {
+	// BuildPolls is how many GetServer calls a server stays in BUILD.
+	BuildPolls int
+	// LBBuildPolls is how many GetLoadBalancer calls a lb stays in BUILD.
+	LBBuildPolls int
+	// CreateErrors maps a server or lb name to the error creating it returns.
+	CreateErrors map[string]error
+	// BuildErrors lists the server names that go to ERROR instead of ACTIVE.
+	BuildErrors map[string]bool
+	// Missing lists the flavor and image ids that do not exist, every other
+	// id does.
+	Missing map[string]bool
+
+	mu      sync.Mutex
+	nextID  int
+	servers map[string]*server
+	lbs     map[string]*lb
+}
+
+// New returns an empty Provider where everything becomes ACTIVE on the
+// second Get.
+func New() *Provider {
+	return &Provider{
+		BuildPolls:   1,
+		LBBuildPolls: 1,
+		CreateErrors: map[string]error{},
+		BuildErrors:  map[string]bool{},
+		Missing:      map[string]bool{},
+		servers:      map[string]*server{},
+		lbs:          map[string]*lb{},
+	}
+}
+
+// id returns the next sequence number, it must be called with mu held.
+func (p *Provider) id() int {
+	p.nextID++
+	return p.nextID
+}
+
+func (p *Provider) CreateServer(opts provider.CreateServerOpts) (*provider.Server, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.CreateErrors[opts.Name]; err != nil {
+		return nil, err
+	}
+
+	n := p.id()
+	metadata := map[string]string{}
+	for k, v := range opts.Metadata {
+		metadata[k] = v
+	}
+	s := &server{Server: provider.Server{
+		ID:        fmt.Sprintf("server-%d", n),
+		Name:      opts.Name,
+		Status:    provider.ServerBuild,
+		AdminPass: fmt.Sprintf("password-%d", n),
+		Metadata:  metadata,
+	}}
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	s.hostKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub)))
+	p.servers[s.ID] = s
+
+	created := s.Server
+	return &created, nil
+}
+
+func (p *Provider) GetServer(id string) (*provider.Server, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.servers[id]
+	if !ok {
+		return nil, NotFound
+	}
+
+	if s.Status == provider.ServerBuild {
+		if s.polls < p.BuildPolls {
+			s.polls++
+		} else if p.BuildErrors[s.Name] {
+			s.Status = provider.ServerError
+		} else {
+			s.Status = provider.ServerActive
+			s.AccessIPv4 = ipFor(id)
+			s.PrivateIPv4 = privateIPFor(id)
+		}
+	}
+
+	got := s.Server
+	got.AdminPass = ""
+	return &got, nil
+}
+
+// ipFor derives a stable address from a fake id like server-12.
+func ipFor(id string) string {
+	n, _ := strconv.Atoi(id[len("server-"):])
+	return fmt.Sprintf("10.0.%d.%d", n/250, n%250+1)
+}
+
+// ConsoleOutput prints the host key of an ACTIVE server the way cloud-init
+// does, and nothing while it builds.
+func (p *Provider) ConsoleOutput(id string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.servers[id]
+	if !ok {
+		return "", NotFound
+	}
+	if s.Status != provider.ServerActive {
+		return "", nil
+	}
+	return "-----BEGIN SSH HOST KEY KEYS-----\n" + s.hostKey + "\n-----END SSH HOST KEY KEYS-----\n", nil
+}
+
+// privateIPFor derives a stable tenant network address from a fake id.
+func privateIPFor(id string) string {
+	n, _ := strconv.Atoi(id[len("server-"):])
+	return fmt.Sprintf("192.168.%d.%d", n/250, n%250+1)
+}
+
+func (p *Provider) ListServers(name string) ([]provider.Server, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := []provider.Server{}
+	for _, s := range p.servers {
+		if name == "" || s.Name == name {
+			got := s.Server
+			got.AdminPass = ""
+			list = append(list, got)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+func (p *Provider) DeleteServer(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.servers[id]; !ok {
+		return provider.ErrNotFound
+	}
+	delete(p.servers, id)
+	return nil
+}
+
+func (p *Provider) GetFlavor(id string) (*provider.Flavor, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Missing[id] {
+		return nil, provider.ErrNotFound
+	}
+	return &provider.Flavor{ID: id, Name: id, VCPUs: 2, RAM: 4096, Disk: 40}, nil
+}
+
+func (p *Provider) GetImage(id string) (*provider.Image, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Missing[id] {
+		return nil, provider.ErrNotFound
+	}
+	return &provider.Image{ID: id, Name: id, Status: provider.ImageActive, MinDisk: 10}, nil
+}
+
+func (p *Provider) CreateLoadBalancer(opts provider.CreateLoadBalancerOpts) (*models.LoadBalancer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.CreateErrors[opts.Name]; err != nil {
+		return nil, err
+	}
+
+	n := p.id()
+	l := &lb{LoadBalancer: models.LoadBalancer{
+		ID:     strconv.Itoa(n),
+		Name:   opts.Name,
+		Status: "BUILD",
+		Port:   opts.Port,
+		VIP:    fmt.Sprintf("192.0.2.%d", n%250+1),
+		Nodes:  []string{},
+	}}
+	p.lbs[l.ID] = l
+
+	created := l.LoadBalancer
+	created.Nodes = []string{}
+	return &created, nil
+}
+
+func (p *Provider) GetLoadBalancer(id string) (*models.LoadBalancer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l, ok := p.lbs[id]
+	if !ok {
+		return nil, NotFound
+	}
+
+	if l.Status != provider.LBActive {
+		if l.polls < p.LBBuildPolls {
+			l.polls++
+		} else {
+			l.Status = provider.LBActive
+		}
+	}
+
+	got := l.LoadBalancer
+	got.Nodes = append([]string{}, l.Nodes...)
+	return &got, nil
+}
+
+func (p *Provider) ListLoadBalancers() ([]models.LoadBalancer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := []models.LoadBalancer{}
+	for _, l := range p.lbs {
+		got := l.LoadBalancer
+		got.Nodes = append([]string{}, l.Nodes...)
+		list = append(list, got)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+func (p *Provider) DeleteLoadBalancer(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.lbs[id]; !ok {
+		return NotFound
+	}
+	delete(p.lbs, id)
+	return nil
+}
+
+func (p *Provider) AttachNodes(id string, addresses []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l, ok := p.lbs[id]
+	if !ok {
+		return NotFound
+	}
+	if l.Status != provider.LBActive {
+		return errors.New("fake: lb is not ACTIVE")
+	}
+	for _, a := range addresses {
+		for _, n := range l.Nodes {
+			if n == a {
+				return fmt.Errorf("fake: %s is already attached", a)
+			}
+		}
+		l.Nodes = append(l.Nodes, a)
+	}
+	return nil
+}
+
+func (p *Provider) DetachNodes(id string, addresses []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l, ok := p.lbs[id]
+	if !ok {
+		return NotFound
+	}
+	if l.Status != provider.LBActive {
+		return errors.New("fake: lb is not ACTIVE")
+	}
+	keep := []string{}
+	for _, n := range l.Nodes {
+		detach := false
+		for _, a := range addresses {
+			if n == a {
+				detach = true
+			}
+		}
+		if !detach {
+			keep = append(keep, n)
+		}
+	}
+	l.Nodes = keep
+	return nil
+}
@@ -0,0 +1,158 @@
+package openstack
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/pagination"
+	"github.com/os-pc/gocloudlb"
+	"github.com/os-pc/gocloudlb/loadbalancers"
+	"github.com/os-pc/gocloudlb/nodes"
+	"github.com/os-pc/gocloudlb/virtualips"
+
+	"github.com/sulochan/kaas/models"
+	"github.com/sulochan/kaas/provider"
+)
+
+// CloudLB implements provider.LoadBalancers with Rackspace Cloud Load
+// Balancers.
+type CloudLB struct {
+	client *gophercloud.ServiceClient
+}
+
+// GetLbaasService - get Rackspace lbaas service
+func GetLbaasService(client *gophercloud.ProviderClient, region string) (*gophercloud.ServiceClient, error) {
+	return gocloudlb.NewLB(client, gophercloud.EndpointOpts{
+		Region: region,
+	})
+}
+
+func lbID(id string) (uint64, error) {
+	return strconv.ParseUint(id, 10, 64)
+}
+
+// NewLoadBalancer converts a Rackspace lb to its models representation.
+func NewLoadBalancer(raxlb *loadbalancers.LoadBalancer) *models.LoadBalancer {
+	lb := &models.LoadBalancer{
+		ID:     strconv.FormatUint(raxlb.ID, 10),
+		Name:   raxlb.Name,
+		Status: raxlb.Status,
+		Port:   int(raxlb.Port),
+		Nodes:  []string{},
+	}
+	if len(raxlb.VirtualIps) > 0 {
+		lb.VIP = raxlb.VirtualIps[0].Address
+	}
+	for _, n := range raxlb.Nodes {
+		lb.Nodes = append(lb.Nodes, n.Address)
+	}
+	return lb
+}
+
+func (p *CloudLB) CreateLoadBalancer(lb provider.CreateLoadBalancerOpts) (*models.LoadBalancer, error) {
+	viptype := virtualips.CreateOpts{Type: "PUBLIC"}
+
+	opts := loadbalancers.CreateOpts{
+		Name:       lb.Name,
+		Port:       int32(lb.Port),
+		Protocol:   lb.Protocol,
+		VirtualIps: []virtualips.CreateOpts{viptype},
+		Nodes:      []nodes.CreateOpts{},
+	}
+
+	fmt.Println(opts)
+	lbout, err := loadbalancers.Create(p.client, opts).Extract()
+	log.Println(lbout)
+	if err != nil {
+		return nil, err
+	}
+	return NewLoadBalancer(lbout), nil
+}
+
+func (p *CloudLB) DeleteLoadBalancer(id string) error {
+	raxID, err := lbID(id)
+	if err != nil {
+		return err
+	}
+
+	result := loadbalancers.Delete(p.client, raxID)
+	fmt.Println(result)
+	return result.ExtractErr()
+}
+
+func (p *CloudLB) GetLoadBalancer(id string) (*models.LoadBalancer, error) {
+	raxID, err := lbID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	newraxlb, err := loadbalancers.Get(p.client, raxID).Extract()
+	if err != nil {
+		fmt.Println("Error extracting lb: ", err)
+		return nil, err
+	}
+	return NewLoadBalancer(newraxlb), nil
+}
+
+func (p *CloudLB) ListLoadBalancers() ([]models.LoadBalancer, error) {
+	lbpager := loadbalancers.List(p.client, nil)
+
+	lblist := []models.LoadBalancer{}
+
+	err := lbpager.EachPage(func(page pagination.Page) (bool, error) {
+		lbList, err := loadbalancers.ExtractLoadBalancers(page)
+		if err != nil {
+			return false, err
+		}
+
+		for i := range lbList {
+			lblist = append(lblist, *NewLoadBalancer(&lbList[i]))
+		}
+		return true, nil
+	})
+
+	return lblist, err
+}
+
+func (p *CloudLB) AttachNodes(id string, lbnodes []string) error {
+	lb, err := p.GetLoadBalancer(id)
+	if err != nil {
+		return err
+	}
+	raxID, _ := lbID(id)
+
+	opts := []nodes.CreateOpts{}
+	for _, i := range lbnodes {
+		n := nodes.CreateOpts{Address: i, Port: int32(lb.Port), Condition: "ENABLED"}
+		opts = append(opts, n)
+	}
+
+	nodeList := nodes.Create(p.client, raxID, opts)
+	fmt.Println("Created Node list: ", nodeList)
+	return nodeList.Err
+}
+
+func (p *CloudLB) DetachNodes(id string, addresses []string) error {
+	raxID, err := lbID(id)
+	if err != nil {
+		return err
+	}
+
+	raxlb, err := loadbalancers.Get(p.client, raxID).Extract()
+	if err != nil {
+		return err
+	}
+	for _, n := range raxlb.Nodes {
+		for _, address := range addresses {
+			if n.Address != address {
+				continue
+			}
+			if err := nodes.Delete(p.client, raxID, n.ID).ExtractErr(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package openstack
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/sulochan/kaas/provider"
+)
+
+// cloudLB are the responses describing lb 42 with port 6443 and two nodes.
+func cloudLB() map[string]response {
+	return map[string]response{
+		"GET /loadbalancers/42": {http.StatusOK, `{"loadBalancer": {"id": 42, "name": "k8s-test", "port": 6443,
+			"status": "ACTIVE", "virtualIps": [{"address": "203.0.113.10", "type": "PUBLIC"}],
+			"nodes": [{"id": 1, "address": "10.0.0.4", "port": 6443}, {"id": 2, "address": "10.0.0.5", "port": 6443}]}}`},
+	}
+}
+
+func TestCloudLBCreateLoadBalancer(t *testing.T) {
+	api, client := newFakeAPI(t, map[string]response{
+		"POST /loadbalancers": {http.StatusAccepted, `{"loadBalancer": {"id": 42, "name": "k8s-test", "port": 6443,
+			"status": "BUILD", "virtualIps": [{"address": "203.0.113.10", "type": "PUBLIC"}]}}`},
+	})
+	p := &CloudLB{client: client}
+
+	lb, err := p.CreateLoadBalancer(provider.CreateLoadBalancerOpts{Name: "k8s-test", Port: 6443, Protocol: "TCP"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lb.ID != "42" || lb.VIP != "203.0.113.10" || lb.Status != "BUILD" || lb.Port != 6443 {
+		t.Errorf("got %+v", lb)
+	}
+	sent := api.request("POST /loadbalancers")["loadBalancer"].(map[string]interface{})
+	vips, _ := sent["virtualIps"].([]interface{})
+	if sent["name"] != "k8s-test" || sent["port"] != 6443.0 || sent["protocol"] != "TCP" || len(vips) != 1 {
+		t.Errorf("sent %v", sent)
+	}
+}
+
+func TestCloudLBGetLoadBalancer(t *testing.T) {
+	_, client := newFakeAPI(t, cloudLB())
+	p := &CloudLB{client: client}
+
+	lb, err := p.GetLoadBalancer("42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lb.Name != "k8s-test" || lb.VIP != "203.0.113.10" || !reflect.DeepEqual(lb.Nodes, []string{"10.0.0.4", "10.0.0.5"}) {
+		t.Errorf("got %+v", lb)
+	}
+	if _, err := p.GetLoadBalancer("lb-1"); err == nil {
+		t.Error("got an lb for a non numeric id")
+	}
+}
+
+func TestCloudLBAttachNodes(t *testing.T) {
+	responses := cloudLB()
+	responses["POST /loadbalancers/42/nodes"] = response{http.StatusAccepted, `{"nodes": []}`}
+	api, client := newFakeAPI(t, responses)
+	p := &CloudLB{client: client}
+
+	if err := p.AttachNodes("42", []string{"10.0.0.6"}); err != nil {
+		t.Fatal(err)
+	}
+	sent, _ := api.request("POST /loadbalancers/42/nodes")["nodes"].([]interface{})
+	if len(sent) != 1 {
+		t.Fatalf("sent nodes %v, want one", sent)
+	}
+	node := sent[0].(map[string]interface{})
+	if node["address"] != "10.0.0.6" || node["port"] != 6443.0 || node["condition"] != "ENABLED" {
+		t.Errorf("sent node %v", node)
+	}
+}
+
+func TestCloudLBDetachNodes(t *testing.T) {
+	responses := cloudLB()
+	responses["DELETE /loadbalancers/42/nodes/2"] = response{http.StatusAccepted, `{}`}
+	api, client := newFakeAPI(t, responses)
+	p := &CloudLB{client: client}
+
+	if err := p.DetachNodes("42", []string{"10.0.0.5", "10.0.0.9"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"GET /loadbalancers/42", "DELETE /loadbalancers/42/nodes/2"}; !reflect.DeepEqual(api.order, want) {
+		t.Errorf("sent %v, want %v", api.order, want)
+	}
+}
+
+func TestCloudLBDeleteLoadBalancer(t *testing.T) {
+	_, client := newFakeAPI(t, map[string]response{
+		"DELETE /loadbalancers/42": {http.StatusAccepted, ``},
+	})
+	p := &CloudLB{client: client}
+
+	if err := p.DeleteLoadBalancer("42"); err != nil {
+		t.Fatal(err)
+	}
+}
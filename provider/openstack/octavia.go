@@ -0,0 +1,212 @@
+package openstack
+
+import (
+	"errors"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/loadbalancer/v2/listeners"
+	"github.com/gophercloud/gophercloud/openstack/loadbalancer/v2/loadbalancers"
+	"github.com/gophercloud/gophercloud/openstack/loadbalancer/v2/monitors"
+	"github.com/gophercloud/gophercloud/openstack/loadbalancer/v2/pools"
+	"github.com/gophercloud/gophercloud/pagination"
+
+	"github.com/sulochan/kaas/models"
+	"github.com/sulochan/kaas/provider"
+)
+
+// Octavia implements provider.LoadBalancers with the OpenStack lbaas v2 api.
+// Every lb gets a single TCP listener with a round robin pool and a TCP
+// health monitor; the api servers terminate TLS themselves.
+type Octavia struct {
+	client   *gophercloud.ServiceClient
+	subnetID string
+}
+
+// octaviaStatus maps the provisioning and operating statuses of lb onto the
+// statuses kaas polls for. An lb whose provisioning is ACTIVE takes changes.
+// Its operating status only reflects the health of the members, which are
+// down until the control plane is bootstrapped, so only an lb taken OFFLINE
+// by its admin is not reported as active.
+func octaviaStatus(lb *loadbalancers.LoadBalancer) string {
+	switch lb.ProvisioningStatus {
+	case "ACTIVE":
+		if lb.OperatingStatus == "OFFLINE" {
+			return "OFFLINE"
+		}
+		return provider.LBActive
+	case "ERROR":
+		return "ERROR"
+	case "PENDING_DELETE", "DELETED":
+		return "DELETED"
+	default:
+		// PENDING_CREATE and PENDING_UPDATE
+		return "BUILD"
+	}
+}
+
+func newOctaviaLoadBalancer(lb *loadbalancers.LoadBalancer) *models.LoadBalancer {
+	return &models.LoadBalancer{
+		ID:     lb.ID,
+		Name:   lb.Name,
+		Status: octaviaStatus(lb),
+		VIP:    lb.VipAddress,
+		Nodes:  []string{},
+	}
+}
+
+func (p *Octavia) CreateLoadBalancer(lb provider.CreateLoadBalancerOpts) (*models.LoadBalancer, error) {
+	// the listener, pool and monitor are created along with the lb, Octavia
+	// refuses changes to an lb that is still building
+	opts := loadbalancers.CreateOpts{
+		Name:        lb.Name,
+		VipSubnetID: p.subnetID,
+		Listeners: []listeners.CreateOpts{{
+			Name:         lb.Name,
+			Protocol:     listeners.ProtocolTCP,
+			ProtocolPort: lb.Port,
+			DefaultPool: &pools.CreateOpts{
+				Name:     lb.Name,
+				LBMethod: pools.LBMethodRoundRobin,
+				Protocol: pools.ProtocolTCP,
+				Monitor: &monitors.CreateOpts{
+					Name:       lb.Name,
+					Type:       monitors.TypeTCP,
+					Delay:      10,
+					Timeout:    5,
+					MaxRetries: 3,
+				},
+			},
+		}},
+	}
+
+	created, err := loadbalancers.Create(p.client, opts).Extract()
+	if err != nil {
+		return nil, err
+	}
+	out := newOctaviaLoadBalancer(created)
+	out.Port = lb.Port
+	return out, nil
+}
+
+func (p *Octavia) DeleteLoadBalancer(id string) error {
+	return loadbalancers.Delete(p.client, id, loadbalancers.DeleteOpts{Cascade: true}).ExtractErr()
+}
+
+// get returns lb id with its port and members, and the id of its pool.
+func (p *Octavia) get(id string) (*models.LoadBalancer, string, error) {
+	octlb, err := loadbalancers.Get(p.client, id).Extract()
+	if err != nil {
+		return nil, "", err
+	}
+	lb := newOctaviaLoadBalancer(octlb)
+
+	if len(octlb.Listeners) == 0 || len(octlb.Pools) == 0 {
+		// not populated until the create went through
+		return lb, "", nil
+	}
+
+	listener, err := listeners.Get(p.client, octlb.Listeners[0].ID).Extract()
+	if err != nil {
+		return nil, "", err
+	}
+	lb.Port = listener.ProtocolPort
+
+	poolID := octlb.Pools[0].ID
+	err = pools.ListMembers(p.client, poolID, nil).EachPage(func(page pagination.Page) (bool, error) {
+		members, err := pools.ExtractMembers(page)
+		if err != nil {
+			return false, err
+		}
+		for _, m := range members {
+			lb.Nodes = append(lb.Nodes, m.Address)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return lb, poolID, nil
+}
+
+func (p *Octavia) GetLoadBalancer(id string) (*models.LoadBalancer, error) {
+	lb, _, err := p.get(id)
+	return lb, err
+}
+
+// ListLoadBalancers does not fill in the port and members of the lbs, use
+// GetLoadBalancer for those.
+func (p *Octavia) ListLoadBalancers() ([]models.LoadBalancer, error) {
+	lblist := []models.LoadBalancer{}
+
+	err := loadbalancers.List(p.client, nil).EachPage(func(page pagination.Page) (bool, error) {
+		lbList, err := loadbalancers.ExtractLoadBalancers(page)
+		if err != nil {
+			return false, err
+		}
+
+		for i := range lbList {
+			lblist = append(lblist, *newOctaviaLoadBalancer(&lbList[i]))
+		}
+		return true, nil
+	})
+
+	return lblist, err
+}
+
+// AttachNodes adds the members in a single batch update of the pool. The
+// batch replaces every member of the pool, so the current ones are sent
+// along.
+func (p *Octavia) AttachNodes(id string, lbnodes []string) error {
+	lb, poolID, err := p.get(id)
+	if err != nil {
+		return err
+	}
+	if poolID == "" {
+		return errors.New("lb " + id + " has no pool yet")
+	}
+
+	return p.setMembers(poolID, lb.Port, append(lb.Nodes, lbnodes...))
+}
+
+// DetachNodes sends the members left in a single batch update of the pool.
+func (p *Octavia) DetachNodes(id string, lbnodes []string) error {
+	lb, poolID, err := p.get(id)
+	if err != nil {
+		return err
+	}
+	if poolID == "" {
+		return nil
+	}
+
+	keep := []string{}
+	for _, address := range lb.Nodes {
+		detach := false
+		for _, n := range lbnodes {
+			if n == address {
+				detach = true
+			}
+		}
+		if !detach {
+			keep = append(keep, address)
+		}
+	}
+	if len(keep) == len(lb.Nodes) {
+		return nil
+	}
+	return p.setMembers(poolID, lb.Port, keep)
+}
+
+// setMembers replaces the members of pool poolID with addresses.
+func (p *Octavia) setMembers(poolID string, port int, addresses []string) error {
+	members := []pools.BatchUpdateMemberOpts{}
+	for _, address := range addresses {
+		subnetID := p.subnetID
+		members = append(members, pools.BatchUpdateMemberOpts{
+			Address:      address,
+			ProtocolPort: port,
+			SubnetID:     &subnetID,
+		})
+	}
+
+	return pools.BatchUpdateMembers(p.client, poolID, members).ExtractErr()
+}
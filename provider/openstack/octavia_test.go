@@ -0,0 +1,244 @@
+package openstack
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/loadbalancer/v2/loadbalancers"
+
+	"github.com/sulochan/kaas/provider"
+)
+
+// response is the canned answer of the fake api to a request.
+type response struct {
+	code int
+	body string
+}
+
+// fakeAPI answers the requests in responses, keyed by method and path, and
+// records the json body of each request it got.
+type fakeAPI struct {
+	t         *testing.T
+	responses map[string]response
+	requests  map[string]interface{}
+	order     []string
+}
+
+// newFakeAPI serves responses and returns a service client for it.
+func newFakeAPI(t *testing.T, responses map[string]response) (*fakeAPI, *gophercloud.ServiceClient) {
+	api := &fakeAPI{t: t, responses: responses, requests: map[string]interface{}{}}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	client := &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{TokenID: "token"},
+		Endpoint:       server.URL + "/",
+		ResourceBase:   server.URL + "/",
+	}
+	return api, client
+}
+
+func (api *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Method + " " + r.URL.Path
+	if r.URL.RawQuery != "" {
+		key += "?" + r.URL.RawQuery
+	}
+	api.order = append(api.order, key)
+	if content, _ := ioutil.ReadAll(r.Body); len(content) > 0 {
+		var body interface{}
+		if err := json.Unmarshal(content, &body); err != nil {
+			api.t.Errorf("%s: %v", key, err)
+		}
+		api.requests[key] = body
+	}
+	resp, ok := api.responses[key]
+	if !ok {
+		api.t.Errorf("unexpected request %s", key)
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.code)
+	w.Write([]byte(resp.body))
+}
+
+// request returns the json body of the request key, decoded into a map.
+func (api *fakeAPI) request(key string) map[string]interface{} {
+	body, _ := api.requests[key].(map[string]interface{})
+	if body == nil {
+		api.t.Fatalf("no request %s, got %v", key, api.order)
+	}
+	return body
+}
+
+func TestOctaviaStatus(t *testing.T) {
+	tests := []struct {
+		provisioning string
+		operating    string
+		want         string
+	}{
+		{provisioning: "ACTIVE", operating: "ONLINE", want: provider.LBActive},
+		// the members are down until the control plane is up
+		{provisioning: "ACTIVE", operating: "ERROR", want: provider.LBActive},
+		{provisioning: "ACTIVE", operating: "OFFLINE", want: "OFFLINE"},
+		{provisioning: "PENDING_CREATE", operating: "OFFLINE", want: "BUILD"},
+		{provisioning: "PENDING_UPDATE", operating: "ONLINE", want: "BUILD"},
+		{provisioning: "ERROR", operating: "ERROR", want: "ERROR"},
+		{provisioning: "PENDING_DELETE", operating: "ONLINE", want: "DELETED"},
+	}
+	for _, tt := range tests {
+		lb := &loadbalancers.LoadBalancer{ProvisioningStatus: tt.provisioning, OperatingStatus: tt.operating}
+		if got := octaviaStatus(lb); got != tt.want {
+			t.Errorf("%s/%s: got %s, want %s", tt.provisioning, tt.operating, got, tt.want)
+		}
+	}
+}
+
+func TestOctaviaCreateLoadBalancer(t *testing.T) {
+	api, client := newFakeAPI(t, map[string]response{
+		"POST /lbaas/loadbalancers": {http.StatusCreated, `{"loadbalancer": {"id": "lb-1", "name": "k8s-test",
+			"vip_address": "10.0.0.10", "provisioning_status": "PENDING_CREATE", "operating_status": "OFFLINE"}}`},
+	})
+	p := &Octavia{client: client, subnetID: "subnet-1"}
+
+	lb, err := p.CreateLoadBalancer(provider.CreateLoadBalancerOpts{Name: "k8s-test", Port: 6443, Protocol: "TCP"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lb.ID != "lb-1" || lb.VIP != "10.0.0.10" || lb.Status != "BUILD" || lb.Port != 6443 {
+		t.Errorf("got %+v", lb)
+	}
+
+	// the listener, pool and monitor are created along with the lb
+	sent := api.request("POST /lbaas/loadbalancers")["loadbalancer"].(map[string]interface{})
+	if sent["vip_subnet_id"] != "subnet-1" {
+		t.Errorf("vip subnet %v, want subnet-1", sent["vip_subnet_id"])
+	}
+	listeners, _ := sent["listeners"].([]interface{})
+	if len(listeners) != 1 {
+		t.Fatalf("sent listeners %v, want one", sent["listeners"])
+	}
+	listener := listeners[0].(map[string]interface{})
+	pool, _ := listener["default_pool"].(map[string]interface{})
+	monitor, _ := pool["healthmonitor"].(map[string]interface{})
+	if listener["protocol"] != "TCP" || listener["protocol_port"] != 6443.0 || pool["protocol"] != "TCP" ||
+		pool["lb_algorithm"] != "ROUND_ROBIN" || monitor["type"] != "TCP" {
+		t.Errorf("sent listener %v", listener)
+	}
+}
+
+// octaviaLB are the responses describing lb-1 with port 6443 and a member.
+func octaviaLB() map[string]response {
+	return map[string]response{
+		"GET /lbaas/loadbalancers/lb-1": {http.StatusOK, `{"loadbalancer": {"id": "lb-1", "name": "k8s-test",
+			"vip_address": "10.0.0.10", "provisioning_status": "ACTIVE", "operating_status": "ONLINE",
+			"listeners": [{"id": "listener-1"}], "pools": [{"id": "pool-1"}]}}`},
+		"GET /lbaas/listeners/listener-1": {http.StatusOK, `{"listener": {"id": "listener-1", "protocol_port": 6443}}`},
+		"GET /lbaas/pools/pool-1/members": {http.StatusOK, `{"members": [{"id": "member-1", "address": "10.0.0.4", "protocol_port": 6443}]}`},
+		"PUT /lbaas/pools/pool-1/members": {http.StatusAccepted, ``},
+	}
+}
+
+// members returns the addresses of the members sent by a batch update.
+func members(t *testing.T, body map[string]interface{}) []string {
+	addresses := []string{}
+	list, _ := body["members"].([]interface{})
+	for _, m := range list {
+		member := m.(map[string]interface{})
+		if member["protocol_port"] != 6443.0 || member["subnet_id"] != "subnet-1" {
+			t.Errorf("sent member %v", member)
+		}
+		addresses = append(addresses, member["address"].(string))
+	}
+	return addresses
+}
+
+func TestOctaviaGetLoadBalancer(t *testing.T) {
+	_, client := newFakeAPI(t, octaviaLB())
+	p := &Octavia{client: client, subnetID: "subnet-1"}
+
+	lb, err := p.GetLoadBalancer("lb-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lb.Status != provider.LBActive || lb.Port != 6443 || !reflect.DeepEqual(lb.Nodes, []string{"10.0.0.4"}) {
+		t.Errorf("got %+v", lb)
+	}
+}
+
+func TestOctaviaAttachNodes(t *testing.T) {
+	api, client := newFakeAPI(t, octaviaLB())
+	p := &Octavia{client: client, subnetID: "subnet-1"}
+
+	if err := p.AttachNodes("lb-1", []string{"10.0.0.5", "10.0.0.6"}); err != nil {
+		t.Fatal(err)
+	}
+	// the batch update replaces the members, so the current one is kept
+	got := members(t, api.request("PUT /lbaas/pools/pool-1/members"))
+	if want := []string{"10.0.0.4", "10.0.0.5", "10.0.0.6"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent members %v, want %v", got, want)
+	}
+}
+
+func TestOctaviaDetachNodes(t *testing.T) {
+	tests := []struct {
+		name   string
+		detach []string
+		// want are the members sent, nil when no update is sent
+		want []string
+	}{
+		{name: "member", detach: []string{"10.0.0.4"}, want: []string{}},
+		{name: "unknown address", detach: []string{"10.0.0.9"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, client := newFakeAPI(t, octaviaLB())
+			p := &Octavia{client: client, subnetID: "subnet-1"}
+
+			if err := p.DetachNodes("lb-1", tt.detach); err != nil {
+				t.Fatal(err)
+			}
+			_, sent := api.requests["PUT /lbaas/pools/pool-1/members"]
+			if tt.want == nil {
+				if sent {
+					t.Error("sent a member update with nothing to detach")
+				}
+				return
+			}
+			got := members(t, api.request("PUT /lbaas/pools/pool-1/members"))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sent members %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOctaviaAttachNodesBuilding(t *testing.T) {
+	_, client := newFakeAPI(t, map[string]response{
+		"GET /lbaas/loadbalancers/lb-1": {http.StatusOK, `{"loadbalancer": {"id": "lb-1", "provisioning_status": "PENDING_CREATE"}}`},
+	})
+	p := &Octavia{client: client, subnetID: "subnet-1"}
+
+	if err := p.AttachNodes("lb-1", []string{"10.0.0.5"}); err == nil {
+		t.Error("attached nodes to an lb without a pool")
+	}
+	if err := p.DetachNodes("lb-1", []string{"10.0.0.5"}); err != nil {
+		t.Errorf("detach from an lb without a pool: %v", err)
+	}
+}
+
+func TestOctaviaDeleteLoadBalancer(t *testing.T) {
+	_, client := newFakeAPI(t, map[string]response{
+		// the listener, pool and monitor go with it
+		"DELETE /lbaas/loadbalancers/lb-1?cascade=true": {http.StatusNoContent, ``},
+	})
+	p := &Octavia{client: client, subnetID: "subnet-1"}
+
+	if err := p.DeleteLoadBalancer("lb-1"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,255 @@
+// Package openstack implements provider.Provider with nova for servers and
+// either Rackspace Cloud Load Balancers or Octavia for the control plane lbs.
+package openstack
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/bootfromvolume"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/images"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/pagination"
+	"github.com/gophercloud/utils/openstack/clientconfig"
+
+	"github.com/sulochan/kaas/models"
+	"github.com/sulochan/kaas/provider"
+)
+
+// Provider is the OpenStack implementation of provider.Provider.
+type Provider struct {
+	compute *gophercloud.ServiceClient
+	provider.LoadBalancers
+}
+
+// Options are the endpoints and the lb service a Provider uses.
+type Options struct {
+	// IdentityURL is the keystone endpoint authOpts are checked against.
+	IdentityURL string
+	Region      string
+	// LoadBalancer is one of the models.LBProvider constants, empty means
+	// models.LBProviderCloudLB.
+	LoadBalancer string
+	// OctaviaSubnetID is the subnet Octavia allocates the vip and reaches
+	// the members on.
+	OctaviaSubnetID string
+}
+
+// New authenticates with authOpts and returns a Provider for opts.Region.
+func New(authOpts models.AuthOpts, opts Options) (*Provider, error) {
+	client, err := GetOpenstackProvider(authOpts, opts.IdentityURL)
+	if err != nil {
+		return nil, err
+	}
+
+	compute, err := openstack.NewComputeV2(client, gophercloud.EndpointOpts{
+		Region: opts.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Provider{compute: compute}
+	switch opts.LoadBalancer {
+	case "", models.LBProviderCloudLB:
+		lbaas, err := GetLbaasService(client, opts.Region)
+		if err != nil {
+			return nil, err
+		}
+		p.LoadBalancers = &CloudLB{client: lbaas}
+	case models.LBProviderOctavia:
+		if opts.OctaviaSubnetID == "" {
+			return nil, errors.New("octavia needs a vip subnet")
+		}
+		lbaas, err := openstack.NewLoadBalancerV2(client, gophercloud.EndpointOpts{
+			Region: opts.Region,
+		})
+		if err != nil {
+			return nil, err
+		}
+		p.LoadBalancers = &Octavia{client: lbaas, subnetID: opts.OctaviaSubnetID}
+	default:
+		return nil, fmt.Errorf("unknown lb provider %q", opts.LoadBalancer)
+	}
+
+	return p, nil
+}
+
+func GetOpenstackProvider(authOpts models.AuthOpts, identityURL string) (*gophercloud.ProviderClient, error) {
+	opts := &clientconfig.ClientOpts{}
+
+	if authOpts.Type == "Token" {
+		fmt.Println("Token passed for auth")
+		opts = &clientconfig.ClientOpts{
+			AuthType: clientconfig.AuthV2Token,
+			AuthInfo: &clientconfig.AuthInfo{
+				AuthURL:     identityURL,
+				Username:    authOpts.Username,
+				Token:       authOpts.Token,
+				ProjectName: authOpts.ProjectId,
+				DomainName:  authOpts.ProjectId,
+			},
+		}
+	} else if authOpts.Type == "Password" {
+		fmt.Println("Password passed for auth")
+		opts = &clientconfig.ClientOpts{
+			AuthInfo: &clientconfig.AuthInfo{
+				AuthURL:     identityURL,
+				Username:    authOpts.Username,
+				Password:    authOpts.Password,
+				ProjectName: authOpts.ProjectId,
+				DomainName:  authOpts.ProjectId,
+			},
+		}
+	} else {
+		fmt.Println("No auth options passed in the headers.")
+	}
+
+	provider, err := clientconfig.AuthenticatedClient(opts)
+	if err != nil {
+		fmt.Println(err)
+		return provider, err
+	}
+
+	return provider, err
+}
+
+func newServer(s *servers.Server) *provider.Server {
+	return &provider.Server{ID: s.ID, Name: s.Name, Status: s.Status, AccessIPv4: s.AccessIPv4,
+		PrivateIPv4: fixedIPv4(s.Addresses), AdminPass: s.AdminPass, Metadata: s.Metadata}
+}
+
+// fixedIPv4 returns the first fixed IPv4 address of the networks of a
+// server, in network name order.
+func fixedIPv4(addresses map[string]interface{}) string {
+	networks := []string{}
+	for name := range addresses {
+		networks = append(networks, name)
+	}
+	sort.Strings(networks)
+
+	for _, name := range networks {
+		list, _ := addresses[name].([]interface{})
+		for _, a := range list {
+			addr, _ := a.(map[string]interface{})
+			if version, _ := addr["version"].(float64); version != 4 {
+				continue
+			}
+			if kind, ok := addr["OS-EXT-IPS:type"].(string); ok && kind != "fixed" {
+				continue
+			}
+			if ip, ok := addr["addr"].(string); ok {
+				return ip
+			}
+		}
+	}
+	return ""
+}
+
+func (p *Provider) CreateServer(opts provider.CreateServerOpts) (*provider.Server, error) {
+	configDrive := true
+	createOpts := servers.CreateOpts{
+		Name:             opts.Name,
+		FlavorRef:        opts.FlavorRef,
+		ImageRef:         opts.ImageRef,
+		AvailabilityZone: opts.AvailabilityZone,
+		Metadata:         opts.Metadata,
+		UserData:         opts.UserData,
+		ConfigDrive:      &configDrive,
+	}
+
+	var builder servers.CreateOptsBuilder = createOpts
+	if opts.VolumeSize > 0 {
+		// the image goes on the volume, nova refuses an image ref as well
+		createOpts.ImageRef = ""
+		builder = bootfromvolume.CreateOptsExt{
+			CreateOptsBuilder: createOpts,
+			BlockDevice: []bootfromvolume.BlockDevice{{
+				SourceType:          bootfromvolume.SourceImage,
+				UUID:                opts.ImageRef,
+				DestinationType:     bootfromvolume.DestinationVolume,
+				VolumeSize:          opts.VolumeSize,
+				VolumeType:          opts.VolumeType,
+				DeleteOnTermination: true,
+			}},
+		}
+	}
+
+	server, err := servers.Create(p.compute, builder).Extract()
+	if err != nil {
+		fmt.Printf("Unable to create server: %s\n", err)
+		return nil, err
+	}
+	return newServer(server), nil
+}
+
+func (p *Provider) GetServer(id string) (*provider.Server, error) {
+	server, err := servers.Get(p.compute, id).Extract()
+	if err != nil {
+		return nil, err
+	}
+	return newServer(server), nil
+}
+
+func (p *Provider) ListServers(name string) ([]provider.Server, error) {
+	list := []provider.Server{}
+	// nova matches the name as a regex, keep exact matches only
+	pager := servers.List(p.compute, servers.ListOpts{Name: name})
+	err := pager.EachPage(func(page pagination.Page) (bool, error) {
+		serverList, err := servers.ExtractServers(page)
+		if err != nil {
+			return false, err
+		}
+		for i := range serverList {
+			if name == "" || serverList[i].Name == name {
+				list = append(list, *newServer(&serverList[i]))
+			}
+		}
+		return true, nil
+	})
+	return list, err
+}
+
+func (p *Provider) GetFlavor(id string) (*provider.Flavor, error) {
+	f, err := flavors.Get(p.compute, id).Extract()
+	if _, ok := err.(gophercloud.ErrDefault404); ok {
+		return nil, provider.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &provider.Flavor{ID: f.ID, Name: f.Name, VCPUs: f.VCPUs, RAM: f.RAM, Disk: f.Disk}, nil
+}
+
+func (p *Provider) GetImage(id string) (*provider.Image, error) {
+	i, err := images.Get(p.compute, id).Extract()
+	if _, ok := err.(gophercloud.ErrDefault404); ok {
+		return nil, provider.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &provider.Image{ID: i.ID, Name: i.Name, Status: i.Status, MinRAM: i.MinRAM, MinDisk: i.MinDisk}, nil
+}
+
+func (p *Provider) DeleteServer(id string) error {
+	result := servers.Delete(p.compute, id)
+	fmt.Println(result)
+	err := result.ExtractErr()
+	if _, ok := err.(gophercloud.ErrDefault404); ok {
+		return provider.ErrNotFound
+	}
+	return err
+}
+
+// consoleLines is how much of the console log ConsoleOutput fetches, enough
+// to reach back to the host keys cloud-init prints once a server booted.
+const consoleLines = 500
+
+func (p *Provider) ConsoleOutput(id string) (string, error) {
+	return servers.ShowConsoleOutput(p.compute, id, servers.ShowConsoleOutputOpts{Length: consoleLines}).Extract()
+}
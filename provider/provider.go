@@ -0,0 +1,120 @@
+// Package provider abstracts the cloud kaas builds clusters on. The api
+// package only talks to servers and load balancers through the Provider
+// interface; the implementations live in the sub packages (openstack, fake).
+package provider
+
+import (
+	"errors"
+
+	"github.com/sulochan/kaas/models"
+)
+
+// ErrNotFound is returned by GetFlavor, GetImage and DeleteServer for ids
+// that do not exist.
+var ErrNotFound = errors.New("not found")
+
+// Server statuses, as reported by the compute API.
+const (
+	ServerBuild  = "BUILD"
+	ServerActive = "ACTIVE"
+	ServerError  = "ERROR"
+)
+
+// LBActive is the status of a load balancer ready to take traffic.
+const LBActive = "ACTIVE"
+
+// ImageActive is the status of an image servers can be built from.
+const ImageActive = "ACTIVE"
+
+// Server is a compute instance.
+type Server struct {
+	ID         string
+	Name       string
+	Status     string
+	AccessIPv4 string
+	// PrivateIPv4 is the fixed address of the server on its tenant network,
+	// the only one of servers without a public address.
+	PrivateIPv4 string
+	// AdminPass is only set on the server returned by CreateServer.
+	AdminPass string
+	Metadata  map[string]string
+}
+
+// CreateServerOpts describes a server to create.
+type CreateServerOpts struct {
+	Name             string
+	FlavorRef        string
+	ImageRef         string
+	AvailabilityZone string
+	// VolumeSize, in GB, boots the server from a new volume of VolumeType
+	// created from the image, instead of the local disk of the flavor.
+	VolumeSize int
+	VolumeType string
+	Metadata   map[string]string
+	UserData   []byte
+}
+
+// Flavor is a compute flavor, RAM is in MB and Disk in GB.
+type Flavor struct {
+	ID    string
+	Name  string
+	VCPUs int
+	RAM   int
+	Disk  int
+}
+
+// Image is a bootable image, MinRAM is in MB and MinDisk in GB.
+type Image struct {
+	ID      string
+	Name    string
+	Status  string
+	MinRAM  int
+	MinDisk int
+}
+
+// CreateLoadBalancerOpts describes a load balancer to create, with one
+// public virtual ip listening on Port.
+type CreateLoadBalancerOpts struct {
+	Name     string
+	Protocol string
+	Port     int
+}
+
+// Servers manages compute instances.
+type Servers interface {
+	CreateServer(opts CreateServerOpts) (*Server, error)
+	GetServer(id string) (*Server, error)
+	// ListServers returns the servers named exactly name, every server if
+	// name is empty.
+	ListServers(name string) ([]Server, error)
+	DeleteServer(id string) error
+	// ConsoleOutput returns the console log of server id, where cloud-init
+	// prints the ssh host keys of the server.
+	ConsoleOutput(id string) (string, error)
+}
+
+// LoadBalancers manages the load balancers in front of the control planes.
+type LoadBalancers interface {
+	CreateLoadBalancer(opts CreateLoadBalancerOpts) (*models.LoadBalancer, error)
+	GetLoadBalancer(id string) (*models.LoadBalancer, error)
+	ListLoadBalancers() ([]models.LoadBalancer, error)
+	DeleteLoadBalancer(id string) error
+	// AttachNodes adds the given addresses as members on the lb port.
+	AttachNodes(id string, addresses []string) error
+	// DetachNodes removes the members with the given addresses, addresses
+	// that are not members are ignored.
+	DetachNodes(id string, addresses []string) error
+}
+
+// Catalog looks up what servers can be built from.
+type Catalog interface {
+	GetFlavor(id string) (*Flavor, error)
+	GetImage(id string) (*Image, error)
+}
+
+// Provider is everything kaas needs from a cloud.
+type Provider interface {
+	Servers
+	LoadBalancers
+	Catalog
+}
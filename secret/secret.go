@@ -0,0 +1,70 @@
+// Package secret seals the secrets kaas stores, such as kubeconfigs, with
+// AES-256-GCM under a key given in the server configuration.
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// KeySize is the size of a key in bytes.
+const KeySize = 32
+
+// Box seals and opens secrets with a single key.
+type Box struct {
+	aead cipher.AEAD
+}
+
+// ParseKey decodes a base64 encoded key.
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("secret: key is not base64: %v", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("secret: key is %d bytes, want %d", len(key), KeySize)
+	}
+	return key, nil
+}
+
+// NewBox returns a Box sealing with key, see ParseKey.
+func NewBox(key []byte) (*Box, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("secret: key is %d bytes, want %d", len(key), KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Box{aead: aead}, nil
+}
+
+// Seal returns plaintext encrypted under a random nonce, base64 encoded.
+func (b *Box) Seal(plaintext []byte) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b.aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+// Open returns the plaintext of a secret sealed by Seal.
+func (b *Box) Open(sealed string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < b.aead.NonceSize() {
+		return nil, errors.New("secret: sealed data too short")
+	}
+	nonce := data[:b.aead.NonceSize()]
+	return b.aead.Open(nil, nonce, data[b.aead.NonceSize():], nil)
+}
@@ -0,0 +1,86 @@
+package secret
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{name: "valid", key: base64.StdEncoding.EncodeToString(make([]byte, KeySize))},
+		{name: "short", key: base64.StdEncoding.EncodeToString(make([]byte, 16)), wantErr: true},
+		{name: "not base64", key: "not base64!", wantErr: true},
+		{name: "empty", key: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		_, err := ParseKey(tt.key)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBox(t *testing.T) {
+	box, err := NewBox(bytes.Repeat([]byte{1}, KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewBox(bytes.Repeat([]byte{2}, KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, plaintext := range [][]byte{[]byte("kubeconfig"), {}, bytes.Repeat([]byte("x"), 1<<16)} {
+		sealed, err := box.Seal(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := box.Seal(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sealed == again {
+			t.Error("sealing twice gives the same secret, the nonce is not random")
+		}
+		got, err := box.Open(sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("opened %q, want %q", got, plaintext)
+		}
+		if _, err := other.Open(sealed); err == nil {
+			t.Error("opened with another key")
+		}
+	}
+
+	sealed, err := box.Seal([]byte("kubeconfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := base64.StdEncoding.DecodeString(sealed)
+	data[len(data)-1] ^= 1
+	tests := []struct {
+		name   string
+		sealed string
+	}{
+		{name: "tampered", sealed: base64.StdEncoding.EncodeToString(data)},
+		{name: "too short", sealed: base64.StdEncoding.EncodeToString([]byte("short"))},
+		{name: "not base64", sealed: "not base64!"},
+		{name: "empty", sealed: ""},
+	}
+	for _, tt := range tests {
+		if _, err := box.Open(tt.sealed); err == nil {
+			t.Errorf("%s: opened", tt.name)
+		}
+	}
+
+	if _, err := NewBox(make([]byte, 16)); err == nil {
+		t.Error("box with a 16 byte key")
+	}
+}